@@ -14,6 +14,13 @@ func ReverseBytes(data []byte) {
 	}
 }
 
+// ReverseHashes reverses a list of hashes in place
+func ReverseHashes(hashes [][]byte) {
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+}
+
 // Base58Encode encodes a byte array to Base58
 func Base58Encode(input []byte) []byte {
 	var result []byte
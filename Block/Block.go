@@ -1,7 +1,8 @@
 package Block
 
 import (
-	"time"
+	"blockchainlearning/consensus"
+	"context"
 	"bytes"
 	"encoding/gob"
 	"log"
@@ -9,25 +10,48 @@ import (
 
 //定义一个区块链结构
 type Block struct {
-	Timestamp    int64          //时间戳
+	BlockHeader                 //区块头
 	Transactions []*Transaction //携带数据
-	PrevHash     []byte         //前一块哈希值
-	Hash         []byte         //哈希
-	Nonce        int            //工作量证明
+	Hash         []byte         //哈希 等于区块头的哈希
 	Height		 int
+	Evidence     []DoubleSignEvidence //PoS中质押者重复签名的证据
+	Commits      []PbftMessage        //PBFT中验证者对区块的提交签名 区块哈希之后产生 不计入merkle根
 }
 
-//生成一个区块并计算它的哈希值和计算量证明
-func NewBlock(transactions []*Transaction, prevBlockHash []byte , height int) (block *Block) {
-	//创建一个区块
-	block = &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0,height}
-	//创建一个新的POW
-	pow := NewproofOfWork(block)
-	//生成哈希值和工作量证明
-	nonce, hash := pow.Run()
-	block.Hash = hash
-	block.Nonce = nonce
-	return
+//生成一个时间戳为timestamp的区块 由共识引擎填写区块头并封装 封装过程可以通过ctx取消
+func (bc *BlockChain) MineNewBlock(ctx context.Context, transactions []*Transaction, prevBlockHash []byte, height int, timestamp int64) (*Block, error) {
+	//创建一个区块 版本中对正在部署的软分叉发出信号
+	version, err := bc.computeBlockVersion(prevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	header := BlockHeader{Version: version, PrevHash: prevBlockHash, Timestamp: timestamp}
+	block := &Block{header, transactions, []byte{}, height, nil, nil}
+	if err := bc.engine.Prepare(bc, &block.BlockHeader, height); err != nil {
+		return nil, err
+	}
+	if be, ok := bc.engine.(bodyEngine); ok {
+		if err := be.finalizeBlock(ctx, bc, block); err != nil {
+			return nil, err
+		}
+		transactions = block.Transactions
+	}
+	//merkle根只在打包时计算一次 封装过程中只改变nonce
+	block.MerkleRoot = block.HashTransactions()
+	for extraNonce := uint64(1); ; extraNonce++ {
+		err := bc.engine.Seal(ctx, bc, &block.BlockHeader, height)
+		if err == consensus.ErrNonceExhausted && len(transactions) > 0 && transactions[0].IsCoinbase() {
+			//nonce空间用尽 修改coinbase的extranonce后重新计算merkle根
+			transactions[0].SetExtraNonce(extraNonce)
+			block.MerkleRoot = block.HashTransactions()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		block.Hash = block.BlockHash()
+		return block, nil
+	}
 }
 
 //序列化块
@@ -52,12 +76,26 @@ func DeserializeBlock(d []byte) *Block {
 	return &block
 }
 
+//解码其他节点发来的区块 数据格式错误时返回错误而不是退出
+func DecodeBlock(d []byte) (*Block, error) {
+	var block Block
+	decoder := gob.NewDecoder(bytes.NewReader(d))
+	if err := decoder.Decode(&block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+//区块内容的merkle根 包括所有交易和作恶证据
 func (b *Block) HashTransactions() []byte {
 	var txHashs = [][]byte{}
 
 	for _, tx := range b.Transactions {
 		txHashs = append(txHashs, tx.Serialize())
 	}
+	for _, evidence := range b.Evidence {
+		txHashs = append(txHashs, evidence.Serialize())
+	}
 
 	mTree := NewMerkleTree(txHashs)
 	return mTree.RootNode.Data
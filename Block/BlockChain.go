@@ -1,6 +1,8 @@
 package Block
 
 import (
+	"blockchainlearning/consensus"
+	"context"
 	"github.com/boltdb/bolt"
 	"log"
 	"encoding/hex"
@@ -9,6 +11,8 @@ import (
 	"errors"
 	"bytes"
 	"crypto/ecdsa"
+	"math/big"
+	"sort"
 )
 
 //数据库文件位置
@@ -20,12 +24,22 @@ const dbFile = "blockchain_%s.db"
 //键："l"   值：链中最后一个块的 hash
 //键：区块的hash    值：区块的信息
 const blocksBucket = "blocks"
+
+//保存每个区块所在分支从创世块开始的累计工作量
+//键：区块的hash    值：累计工作量(big.Int字节)
+const workBucket = "chainwork"
+
+//保存区块链元数据的桶
+//键："engine"   值：创建区块链时选择的共识引擎名称
+//键："chainstate"   值：chainstate的格式版本
+const metaBucket = "meta"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
 //区块链结构
 type BlockChain struct {
-	tip []byte   //保存最新块的hash
-	DB  *bolt.DB //数据库
+	tip    []byte           //保存最新块的hash
+	DB     *bolt.DB         //数据库
+	engine consensus.Engine //共识引擎
 }
 
 //生成区块链迭代器
@@ -75,7 +89,17 @@ func (bc *BlockChain) AddBlock(transactions []*Transaction) {
 */
 
 
-func (bc *BlockChain) AddBlock(block *Block){
+//将区块保存到数据库 没有通过ValidateBlock的块会被拒绝
+//累计工作量超过当前主链的分支会成为新的主链 必要时进行链重组
+func (bc *BlockChain) AddBlock(block *Block) error {
+	if err := bc.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	work := bc.engine.CalcWork(bc, &block.BlockHeader, block.Height)
+	var connected, disconnected []*Block
+	//连接失败的区块和它的后代 在事务回滚之后标记为无效
+	var invalid [][]byte
 	err := bc.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		blockInDb := b.Get(block.Hash)
@@ -83,36 +107,75 @@ func (bc *BlockChain) AddBlock(block *Block){
 		if blockInDb != nil {
 			return nil
 		}
+		if isInvalidBlock(tx, block.Hash) || isInvalidBlock(tx, block.PrevHash) {
+			invalid = [][]byte{block.Hash}
+			return ruleError(ErrInvalidAncestor, fmt.Sprintf("block %x or its parent %x is invalid", block.Hash, block.PrevHash))
+		}
 
 		blockData := block.Serialize()
 		err := b.Put(block.Hash,blockData)
 		if err != nil{
-			log.Panic(err)
+			return err
+		}
+
+		works := tx.Bucket([]byte(workBucket))
+		parentWork := new(big.Int).SetBytes(works.Get(block.PrevHash))
+		blockWork := parentWork.Add(parentWork, work)
+		err = works.Put(block.Hash, blockWork.Bytes())
+		if err != nil {
+			return err
 		}
 
 		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		tipWork := new(big.Int).SetBytes(works.Get(lastHash))
+		if blockWork.Cmp(tipWork) <= 0 {
+			return nil
+		}
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"),block.Hash)
-			if err != nil {
-				log.Panic(err)
+		if bytes.Equal(block.PrevHash, lastHash) {
+			err = UTXOSet{bc}.connectBlock(tx, block)
+			connected = []*Block{block}
+			if _, ok := err.(RuleError); ok {
+				invalid = [][]byte{block.Hash}
 			}
+		} else {
+			connected, disconnected, invalid, err = bc.reorganize(tx, lastHash, block)
+		}
+		if err != nil {
+			return err
+		}
 
-			bc.tip = block.Hash
+		err = b.Put([]byte("l"),block.Hash)
+		if err != nil {
+			return err
+		}
+		if fe, ok := bc.engine.(finalityEngine); ok && fe.isFinal(block) {
+			err = setFinalBlock(tx, block)
+			if err != nil {
+				return err
+			}
 		}
+		bc.tip = block.Hash
 		return nil
 	})
 	if err != nil {
-		 log.Panic(err)
+		if len(invalid) > 0 {
+			bc.markInvalidBlocks(invalid)
+		}
+		return err
 	}
-}
 
+	updateMempool(bc, connected, disconnected)
+	return nil
+}
 
 //生成创世块
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{},0)
+func (bc *BlockChain) NewGenesisBlock(coinbase *Transaction) *Block {
+	block, err := bc.MineNewBlock(context.Background(), []*Transaction{coinbase}, []byte{}, 0, AdjustedTime())
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
 }
 
 func dbExists(file string) bool {
@@ -123,8 +186,8 @@ func dbExists(file string) bool {
 	return true
 }
 
-//生成一条新的区块链
-func CreateBlockchain(address ,nodeID string) (blockChain *BlockChain) {
+//生成一条使用engine共识的新区块链
+func CreateBlockchain(address ,nodeID string, engine consensus.Engine) (blockChain *BlockChain) {
 	dbFile := fmt.Sprintf(dbFile,nodeID)	
 	if dbExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
@@ -136,6 +199,10 @@ func CreateBlockchain(address ,nodeID string) (blockChain *BlockChain) {
 	if err != nil {
 		log.Panic(err)
 	}
+	bc := BlockChain{nil, db, engine}
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
+	genesis := bc.NewGenesisBlock(cbtx)
+	genesisWork := engine.CalcWork(&bc, &genesis.BlockHeader, 0)
 	//更新数据库内容
 	err = db.Update(func(tx *bolt.Tx) error {
 		//读取"blocks"桶中的二进制内容
@@ -143,8 +210,6 @@ func CreateBlockchain(address ,nodeID string) (blockChain *BlockChain) {
 		if err != nil {
 			log.Panic(err)
 		}
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesis := NewGenesisBlock(cbtx)
 		err = b.Put(genesis.Hash, genesis.Serialize())
 		if err != nil {
 			log.Panic(err)
@@ -153,13 +218,41 @@ func CreateBlockchain(address ,nodeID string) (blockChain *BlockChain) {
 		if err != nil {
 			log.Panic(err)
 		}
+		works, err := tx.CreateBucket([]byte(workBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		err = works.Put(genesis.Hash, genesisWork.Bytes())
+		if err != nil {
+			log.Panic(err)
+		}
+		meta, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		err = meta.Put([]byte("engine"), []byte(engine.Name()))
+		if err != nil {
+			log.Panic(err)
+		}
+		if ph, ok := engine.(powHasher); ok {
+			err = meta.Put([]byte("powhash"), []byte(ph.PowHash()))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		if fe, ok := engine.(finalityEngine); ok && fe.isFinal(genesis) {
+			err = setFinalBlock(tx, genesis)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
 		tip = genesis.Hash
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	bc := BlockChain{tip, db}
+	bc.tip = tip
 	fmt.Printf("Hash: %x\n", tip)
 	//blockChain = &BlockChain{[]*Block{NewGenesisBlock()}}
 	return &bc
@@ -172,6 +265,12 @@ func NewBlockchain(nodeID string) *BlockChain {
 		os.Exit(1)
 	}
 	var tip []byte
+	engineName := defaultEngine
+	powHash := legacyPowHash
+	//旧数据库没有记录累计工作量
+	backfill := false
+	//chainstate是旧的格式
+	reindex := false
 	//打开数据库
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
@@ -180,15 +279,86 @@ func NewBlockchain(nodeID string) *BlockChain {
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		tip = b.Get([]byte("l"))
+		works, err := tx.CreateBucketIfNotExists([]byte(workBucket))
+		if err != nil {
+			return err
+		}
+		backfill = works.Get(tip) == nil
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if name := meta.Get([]byte("engine")); name != nil {
+			engineName = string(name)
+		}
+		if name := meta.Get([]byte("powhash")); name != nil {
+			powHash = string(name)
+		}
+		reindex = !bytes.Equal(meta.Get([]byte("chainstate")), []byte(chainstateVersion))
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	bc := &BlockChain{tip, db}
+	engine, err := NewEngine(engineName)
+	if err != nil {
+		log.Panic(err)
+	}
+	if ph, ok := engine.(powHasher); ok {
+		if err := ph.SetPowHash(powHash); err != nil {
+			log.Panic(err)
+		}
+	}
+	bc := &BlockChain{tip, db, engine}
+	if backfill {
+		bc.backfillChainWork()
+	}
+	if reindex {
+		bc.migrateChainstate()
+	}
 	return bc
 }
 
+//为没有记录累计工作量的旧数据库计算所有已保存区块的累计工作量
+//按高度从创世块开始 每个块的累计工作量等于父块的加上自己的
+func (bc *BlockChain) backfillChainWork() {
+	var blocks []*Block
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blocksBucket)).ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, []byte("l")) {
+				blocks = append(blocks, DeserializeBlock(v))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Height < blocks[j].Height })
+
+	works := make(map[string]*big.Int)
+	for _, block := range blocks {
+		work := new(big.Int)
+		if parentWork, ok := works[hex.EncodeToString(block.PrevHash)]; ok {
+			work.Set(parentWork)
+		}
+		works[hex.EncodeToString(block.Hash)] = work.Add(work, bc.engine.CalcWork(bc, &block.BlockHeader, block.Height))
+	}
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(workBucket))
+		for _, block := range blocks {
+			if err := b.Put(block.Hash, works[hex.EncodeToString(block.Hash)].Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Computed the chain work of %d blocks\n", len(blocks))
+}
+
 //生成的迭代器
 //当前链的所有哈希
 func (bc *BlockChain) Iterator() *BlockchainIterator {
@@ -264,45 +434,42 @@ func (bc *BlockChain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
 	return unspentTXs
 }
 */
-//将新的交易保存到数据库
-func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+//将新的交易打包成区块 挖矿后经过ValidateBlock校验再加入链中
+//ctx被取消时(例如主链的链尾发生了变化)停止挖矿并返回ctx的错误
+func (bc *BlockChain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	var lastBlock *Block
 
 	for _, tx := range transactions {
 		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR:Invalid transaction")
+			return nil, ruleError(ErrBadSignature, fmt.Sprintf("transaction %x is invalid", tx.ID))
 		}
 	}
 
 	err := bc.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash := b.Get([]byte("l"))
 
 		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-
-		lastHeight = block.Height
+		lastBlock = DeserializeBlock(blockData)
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	newBlock := NewBlock(transactions, lastHash , lastHeight+1)
-	bc.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err = b.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panic(err)
-		}
-		bc.tip = newBlock.Hash
-		return nil
-	})
-	return newBlock
+	//时间戳必须晚于过去中位时间
+	timestamp := AdjustedTime()
+	if medianTime := bc.CalcPastMedianTime(lastBlock); timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+	newBlock, err := bc.MineNewBlock(ctx, transactions, lastBlock.Hash, lastBlock.Height+1, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	err = bc.AddBlock(newBlock)
+	if err != nil {
+		return nil, err
+	}
+	return newBlock, nil
 }
 
 /**
@@ -326,16 +493,29 @@ func (bc *BlockChain) FindUTXO(address string) []TXOutput {
 func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
+	//被作恶证据没收的coinstake交易和作恶质押者的公钥哈希
+	slashed := make(map[string][]byte)
 	bci := bc.Iterator()
 
 	for {
 		block := bci.Next()
 
-		for _, tx := range block.Transactions {
+		for _, evidence := range block.Evidence {
+			ids, stakerHash := evidence.offendingCoinstakes(bc.findBlock)
+			for _, id := range ids {
+				slashed[hex.EncodeToString(id)] = stakerHash
+			}
+		}
+
+		for i, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Vout {
+				//被没收的coinstake中付款给作恶质押者的输出不存在 但它的输入仍然是花费过的
+				if stakerHash, ok := slashed[txID]; ok && out.IsLockedWithKey(stakerHash) {
+					continue
+				}
 				// Was the output spent?
 				if spentTXOs[txID] != nil {
 					for _, spentOutIdx := range spentTXOs[txID] {
@@ -346,7 +526,10 @@ func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
 				}
 
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				if outs.Outputs == nil {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase() || bc.isCoinstake(block, i)}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
 
@@ -440,15 +623,40 @@ func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
-	prevTXs := make(map[string]Transaction)
+	prevOuts, err := bc.findPrevOuts(tx)
+	if err != nil {
+		return false
+	}
+	return tx.Verify(prevOuts)
+}
+
+//在链上查找交易的输入引用的输出 键为outpointKey
+func (bc *BlockChain) findPrevOuts(tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
 	for _, vin := range tx.Vin {
 		prevTX, err := bc.FindTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return nil, fmt.Errorf("transaction %x has no output %d", vin.Txid, vin.Vout)
+		}
+		prevOuts[outpointKey(vin.Txid, vin.Vout)] = prevTX.Vout[vin.Vout]
+	}
+	return prevOuts, nil
+}
+
+//获取主链最后一个块的hash
+func (bc *BlockChain) TipHash() []byte {
+	var tip []byte
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		tip = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
 	}
-	return tx.Verify(prevTXs)
+	return tip
 }
 
 //获取区块最长的长度
@@ -482,6 +690,28 @@ func (bc *BlockChain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
+//判断数据库中是否已经有这个区块
+func (bc *BlockChain) HasBlock(blockHash []byte) bool {
+	var exists bool
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		exists = len(blockHash) != 0 && tx.Bucket([]byte(blocksBucket)).Get(blockHash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return exists
+}
+
+//通过区块的hash获得对应的区块头 供共识引擎使用
+func (bc *BlockChain) GetHeader(blockHash []byte) (*consensus.Header, error) {
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	return &block.BlockHeader, nil
+}
+
 //通过区块的hash获得对应区块
 func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
@@ -496,9 +726,14 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 		return nil
 	})
 
+	return block, err
+}
+
+//保存的区块 不存在时返回nil
+func (bc *BlockChain) findBlock(blockHash []byte) *Block {
+	block, err := bc.GetBlock(blockHash)
 	if err != nil {
-		log.Panic(err)
+		return nil
 	}
-
-	return block, nil
+	return &block
 }
@@ -0,0 +1,53 @@
+package Block
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func chainWork(t *testing.T, bc *BlockChain, hash []byte) *big.Int {
+	var work []byte
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		work = tx.Bucket([]byte(workBucket)).Get(hash)
+		return nil
+	})
+	if err != nil || work == nil {
+		t.Fatalf("no chain work for block %x: %v", hash, err)
+	}
+	return new(big.Int).SetBytes(work)
+}
+
+//没有累计工作量的旧数据库在打开时从创世块补齐
+func TestChainWorkBackfill(t *testing.T) {
+	bc, wallet, cleanup := newTestChain(t, &PowEngine{})
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		if _, err := mineTestBlock(bc, string(wallet.GetAddress())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := bc.TipHash()
+	expected := chainWork(t, bc, tip)
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(workBucket))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.DB.Close()
+
+	nodeID := "test_" + strings.Replace(t.Name(), "/", "_", -1)
+	reopened := NewBlockchain(nodeID)
+	bc.DB = reopened.DB
+	if !bytes.Equal(reopened.TipHash(), tip) {
+		t.Fatalf("tip changed from %x to %x", tip, reopened.TipHash())
+	}
+	if work := chainWork(t, reopened, tip); work.Cmp(expected) != 0 {
+		t.Fatalf("backfilled chain work is %s, expected %s", work, expected)
+	}
+}
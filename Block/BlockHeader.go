@@ -0,0 +1,17 @@
+package Block
+
+import "blockchainlearning/consensus"
+
+//区块允许的最低版本 之后的区块使用版本位对软分叉部署发出信号
+const blockVersion = 1
+
+//区块头定义在consensus包中 共识引擎只需要区块头就可以封装和校验区块
+type BlockHeader = consensus.Header
+
+//区块头序列化后固定部分的长度
+const BlockHeaderLen = consensus.HeaderLen
+
+//反序列化区块头
+func DeserializeBlockHeader(data []byte) (BlockHeader, error) {
+	return consensus.DeserializeHeader(data)
+}
@@ -1,11 +1,19 @@
 package Block
 
 import (
+	"blockchainlearning/paxos"
+	"blockchainlearning/powhash"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"fmt"
 	"flag"
 	"log"
 	"strconv"
+	"runtime"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -14,14 +22,29 @@ type CLI struct {
 //打印提示操作
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("  auditswap -contract CONTRACT -tx TX - Print the terms of the atomic swap CONTRACT funded by the hex transaction TX, and whether it has been redeemed, with the revealed secret, or refunded on this node's chain")
+	fmt.Println("  createblockchain -address ADDRESS -consensus ENGINE -signers ADDRESSES -orderers NODES -powhash HASH - Create a blockchain using ENGINE (" + strings.Join(EngineNames(), ", ") + ") and send genesis block reward to ADDRESS. For pow, HASH is the proof of work hash function (" + strings.Join(powhash.Names(), ", ") + ", default: " + netParams.PowHash + "). For poa, pbft and raft, ADDRESSES is a comma separated list of initial signers, validators or orderers (default: ADDRESS). For raft, NODES is a comma separated list of the orderers' node addresses in the same order (default: the address of NODE_ID)")
+	fmt.Println("  createmultisig -required M -pubkeys KEYS - Print the address of an output that needs M signatures from the comma separated hex public KEYS (see getpubkey), and the pay-to-script-hash address and redeem script of the same condition")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
+	fmt.Println("  decodescript -script SCRIPT - Disassemble the hex SCRIPT and print the pay-to-script-hash address that uses it as the redeem script")
 	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getdeploymentinfo - Print the version bits state of each soft fork deployment for the next block, and the signalling blocks in the current window")
+	fmt.Println("  getpubkey -address ADDRESS - Print the hex public key of ADDRESS from the wallet file")
+	fmt.Println("  getsupply -height HEIGHT - Print the total supply issued up to HEIGHT (default: current height)")
+	fmt.Println("  initiateswap -from FROM -to TO -amount AMOUNT -fee FEE -timeout SECONDS -mine - Start an atomic swap: create a secret and a contract that pays AMOUNT from FROM to TO when TO reveals the secret, or refunds FROM after SECONDS (default: 48 hours). Print the secret, the contract and the contract transaction")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  participateswap -from FROM -to TO -amount AMOUNT -secrethash HASH -fee FEE -timeout SECONDS -mine - Answer an audited initiateswap on another chain with a contract that pays AMOUNT from FROM to TO when TO reveals the secret with SHA-256 HASH, or refunds FROM after SECONDS (default: 24 hours)")
+	fmt.Println("  paxossim -nodes N -values V -loss P -dup P - Run a Multi-Paxos cluster of N nodes in memory, dropping and duplicating messages with probability P and crashing the leader, and check that every node applies the same V values in the same order")
+	fmt.Println("  raftmember -add NODE -address ADDRESS -remove NODE - Ask the running node with ID specified in NODE_ID env. var. to add the Raft orderer at NODE signing with ADDRESS, or to remove the orderer at NODE")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
+	fmt.Println("  redeemswap -contract CONTRACT -tx TX -secret SECRET -fee FEE -mine - Claim the output of the atomic swap CONTRACT funded by TX with SECRET, which reveals SECRET on this chain")
+	fmt.Println("  refundswap -contract CONTRACT -tx TX -fee FEE -mine - Take back the output of the atomic swap CONTRACT funded by TX after its lock time has passed the median time of past blocks")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -feerate RATE -locktime LOCKTIME -mine - Send AMOUNT of coins from FROM address to TO paying FEE, or RATE per 1000 bytes, to the miner. LOCKTIME delays the transaction until a block height, or a unix time when it is at least " + strconv.Itoa(lockTimeThreshold) + ", compared with the median time of past blocks. Mine on the same node, when -mine is set.")
+	fmt.Println("  sendrawtx -tx TX -mine ADDRESS - Send the fully signed hex transaction TX to the network, or mine it on the same node and send the reward to ADDRESS when -mine is set")
+	fmt.Println("  signrawtx -tx TX -address ADDRESS - Add the signature of ADDRESS from the wallet file to the hex transaction TX and print the result. Cosigners of a multisig output sign in turn until enough signatures are collected")
+	fmt.Println("  spendmultisig -from FROM -redeemscript SCRIPT -to TO -amount AMOUNT -fee FEE - Print an unsigned hex transaction sending AMOUNT from the multisig address FROM to TO, to be signed with signrawtx. When FROM is a pay-to-script-hash address, SCRIPT is its hex multisig redeem script")
+	fmt.Println("  startnode -miner ADDRESS -threads N -authorize ADDRESS -deauthorize ADDRESS -assumevalid=false - Start a node with ID specified in NODE_ID env. var. -miner enables mining on N threads. For poa, pbft and raft, -miner must be a signer, validator or orderer in the wallet file. For poa, -authorize/-deauthorize vote to add or remove a signer. -assumevalid=false checks the signatures of every block, including the ancestors of the network's assume-valid block")
 }
 
 //判断用户输入是否合法 如果不合法打印提示信息 并退出系统
@@ -36,13 +59,18 @@ func (cli *CLI) validateArgs() {
 func (cli *CLI) printChain() {
 	bc := NewBlockchain("")
 	defer bc.DB.Close()
+	_, finalHeight := bc.FinalBlock()
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := NewproofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.IsVaild()))
+		fmt.Printf("Height: %d Bits: %08x\n", block.Height, block.Bits)
+		err := bc.engine.VerifySeal(bc, &block.BlockHeader, block.Height)
+		fmt.Printf("%s: %s\n", bc.engine.Name(), strconv.FormatBool(err == nil))
+		if block.Height <= finalHeight {
+			fmt.Println("Final: true")
+		}
 		fmt.Println()
 		if len(block.PrevHash) == 0 {
 			break
@@ -62,49 +90,180 @@ func (cli *CLI) Run() {
 		fmt.Printf("NODE_ID env. var is not set!")
 		os.Exit(1)
 	}
+	auditSwapCmd := flag.NewFlagSet("auditswap", flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getDeploymentInfoCmd := flag.NewFlagSet("getdeploymentinfo", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
+	createMultiSigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	decodeScriptCmd := flag.NewFlagSet("decodescript", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	initiateSwapCmd := flag.NewFlagSet("initiateswap", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	participateSwapCmd := flag.NewFlagSet("participateswap", flag.ExitOnError)
+	paxosSimCmd := flag.NewFlagSet("paxossim", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	raftMemberCmd := flag.NewFlagSet("raftmember", flag.ExitOnError)
+	redeemSwapCmd := flag.NewFlagSet("redeemswap", flag.ExitOnError)
+	refundSwapCmd := flag.NewFlagSet("refundswap", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
+	signRawTxCmd := flag.NewFlagSet("signrawtx", flag.ExitOnError)
+	spendMultiSigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
+	auditSwapContract := auditSwapCmd.String("contract", "", "Hex encoded atomic swap contract")
+	auditSwapTx := auditSwapCmd.String("tx", "", "Hex encoded contract transaction")
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	decodeScript := decodeScriptCmd.String("script", "", "Hex encoded script")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The wallet address to print the public key of")
+	getSupplyHeight := getSupplyCmd.Int("height", -1, "Height to report the issued supply at")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainEngine := createBlockchainCmd.String("consensus", defaultEngine, "Consensus engine of the new blockchain")
+	createBlockchainSigners := createBlockchainCmd.String("signers", "", "Comma separated addresses of the initial PoA signers, PBFT validators or Raft orderers")
+	createBlockchainOrderers := createBlockchainCmd.String("orderers", "", "Comma separated node addresses of the initial Raft orderers")
+	createBlockchainPowHash := createBlockchainCmd.String("powhash", netParams.PowHash, "PoW hash function of the new blockchain")
+	createMultiSigRequired := createMultiSigCmd.Int("required", 0, "Number of signatures required to spend")
+	createMultiSigPubKeys := createMultiSigCmd.String("pubkeys", "", "Comma separated hex public keys of the cosigners")
+	initiateSwapFrom := initiateSwapCmd.String("from", "", "Source wallet address, refunded after the timeout")
+	initiateSwapTo := initiateSwapCmd.String("to", "", "Participant's address on this chain")
+	initiateSwapAmount := initiateSwapCmd.Int("amount", 0, "Amount to lock in the contract")
+	initiateSwapFee := initiateSwapCmd.Int("fee", 0, "Fee paid to the miner")
+	initiateSwapTimeout := initiateSwapCmd.Int64("timeout", initiatorSwapTimeout, "Seconds before the contract can be refunded")
+	initiateSwapMine := initiateSwapCmd.Bool("mine", false, "Mine immediately on the same node")
+	participateSwapFrom := participateSwapCmd.String("from", "", "Source wallet address, refunded after the timeout")
+	participateSwapTo := participateSwapCmd.String("to", "", "Initiator's address on this chain")
+	participateSwapAmount := participateSwapCmd.Int("amount", 0, "Amount to lock in the contract")
+	participateSwapSecretHash := participateSwapCmd.String("secrethash", "", "Hex encoded secret hash from the initiator's contract")
+	participateSwapFee := participateSwapCmd.Int("fee", 0, "Fee paid to the miner")
+	participateSwapTimeout := participateSwapCmd.Int64("timeout", participantSwapTimeout, "Seconds before the contract can be refunded")
+	participateSwapMine := participateSwapCmd.Bool("mine", false, "Mine immediately on the same node")
+	paxosSimNodes := paxosSimCmd.Int("nodes", 5, "Number of Paxos nodes")
+	paxosSimValues := paxosSimCmd.Int("values", 50, "Number of values to propose")
+	paxosSimLoss := paxosSimCmd.Float64("loss", 0.1, "Probability of dropping a message")
+	paxosSimDup := paxosSimCmd.Float64("dup", 0.1, "Probability of duplicating a message")
+	raftMemberAdd := raftMemberCmd.String("add", "", "Node address of the Raft orderer to add")
+	raftMemberAddress := raftMemberCmd.String("address", "", "The address the added orderer signs blocks with")
+	raftMemberRemove := raftMemberCmd.String("remove", "", "Node address of the Raft orderer to remove")
+	redeemSwapContract := redeemSwapCmd.String("contract", "", "Hex encoded atomic swap contract")
+	redeemSwapTx := redeemSwapCmd.String("tx", "", "Hex encoded contract transaction")
+	redeemSwapSecret := redeemSwapCmd.String("secret", "", "Hex encoded secret")
+	redeemSwapFee := redeemSwapCmd.Int("fee", 0, "Fee paid to the miner")
+	redeemSwapMine := redeemSwapCmd.Bool("mine", false, "Mine immediately on the same node")
+	refundSwapContract := refundSwapCmd.String("contract", "", "Hex encoded atomic swap contract")
+	refundSwapTx := refundSwapCmd.String("tx", "", "Hex encoded contract transaction")
+	refundSwapFee := refundSwapCmd.Int("fee", 0, "Fee paid to the miner")
+	refundSwapMine := refundSwapCmd.Bool("mine", false, "Mine immediately on the same node")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee paid to the miner per 1000 bytes of transaction, overrides -fee")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or unix time before which the transaction cannot be mined")
+	sendRawTx := sendRawTxCmd.String("tx", "", "Hex encoded signed transaction")
+	sendRawTxMine := sendRawTxCmd.String("mine", "", "Mine immediately on the same node and send the reward to ADDRESS")
+	signRawTx := signRawTxCmd.String("tx", "", "Hex encoded transaction")
+	signRawTxAddress := signRawTxCmd.String("address", "", "The wallet address to sign with")
+	spendMultiSigFrom := spendMultiSigCmd.String("from", "", "Source multisig address")
+	spendMultiSigRedeemScript := spendMultiSigCmd.String("redeemscript", "", "Hex encoded multisig redeem script of a pay-to-script-hash FROM address")
+	spendMultiSigTo := spendMultiSigCmd.String("to", "", "Destination address")
+	spendMultiSigAmount := spendMultiSigCmd.Int("amount", 0, "Amount to send")
+	spendMultiSigFee := spendMultiSigCmd.Int("fee", 0, "Fee paid to the miner")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeThreads := startNodeCmd.Int("threads", runtime.NumCPU(), "Number of mining threads")
+	startNodeAuthorize := startNodeCmd.String("authorize", "", "Vote to add ADDRESS to the PoA signers")
+	startNodeDeauthorize := startNodeCmd.String("deauthorize", "", "Vote to remove ADDRESS from the PoA signers")
+	startNodeAssumeValid := startNodeCmd.Bool("assumevalid", true, "Skip signature checks for the assume-valid block and its ancestors, -assumevalid=false verifies every signature")
 	//判断输入内容 执行相应操作
 	switch os.Args[1] {
+	case "auditswap":
+		err := auditSwapCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getdeploymentinfo":
+		err := getDeploymentInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "createmultisig":
+		err := createMultiSigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decodescript":
+		err := decodeScriptCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "initiateswap":
+		err := initiateSwapCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "participateswap":
+		err := participateSwapCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "paxossim":
+		err := paxosSimCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "raftmember":
+		err := raftMemberCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "redeemswap":
+		err := redeemSwapCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "refundswap":
+		err := refundSwapCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -115,6 +274,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "sendrawtx":
+		err := sendRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signrawtx":
+		err := signRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "spendmultisig":
+		err := spendMultiSigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -129,7 +303,7 @@ func (cli *CLI) Run() {
 			createBlockchainCmd.Usage()
 			os.Exit(1)
 		}
-		createBlockchain(*createBlockchainAddress,nodeID)
+		createBlockchain(*createBlockchainAddress,nodeID,*createBlockchainEngine,*createBlockchainSigners,*createBlockchainOrderers,*createBlockchainPowHash)
 	}
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
@@ -138,6 +312,51 @@ func (cli *CLI) Run() {
 		}
 		cli.getBalance(*getBalanceAddress,nodeID)
 	}
+	if createMultiSigCmd.Parsed() {
+		if *createMultiSigRequired <= 0 || *createMultiSigPubKeys == "" {
+			createMultiSigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultiSig(*createMultiSigRequired, *createMultiSigPubKeys)
+	}
+	if decodeScriptCmd.Parsed() {
+		if *decodeScript == "" {
+			decodeScriptCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeScript(*decodeScript)
+	}
+	if getDeploymentInfoCmd.Parsed() {
+		cli.getDeploymentInfo(nodeID)
+	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(*getSupplyHeight, nodeID)
+	}
+	if paxosSimCmd.Parsed() {
+		if *paxosSimNodes < 3 || *paxosSimValues <= 0 || *paxosSimLoss < 0 || *paxosSimLoss >= 1 || *paxosSimDup < 0 || *paxosSimDup >= 1 {
+			paxosSimCmd.Usage()
+			os.Exit(1)
+		}
+		cli.paxosSim(*paxosSimNodes, *paxosSimValues, *paxosSimLoss, *paxosSimDup)
+	}
+	if raftMemberCmd.Parsed() {
+		if (*raftMemberAdd == "") == (*raftMemberRemove == "") || (*raftMemberAdd != "" && *raftMemberAddress == "") {
+			raftMemberCmd.Usage()
+			os.Exit(1)
+		}
+		if *raftMemberAdd != "" {
+			cli.raftMember(nodeID, true, *raftMemberAdd, *raftMemberAddress)
+		} else {
+			cli.raftMember(nodeID, false, *raftMemberRemove, "")
+		}
+	}
 	//打印整个区块链
 	if printChainCmd.Parsed() {
 		cli.printChain()
@@ -147,12 +366,68 @@ func (cli *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendFeeRate < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount,nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendFeeRate, *sendLockTime, nodeID, *sendMine)
+	}
+	if auditSwapCmd.Parsed() {
+		if *auditSwapContract == "" || *auditSwapTx == "" {
+			auditSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.auditSwap(*auditSwapContract, *auditSwapTx, nodeID)
+	}
+	if initiateSwapCmd.Parsed() {
+		if *initiateSwapFrom == "" || *initiateSwapTo == "" || *initiateSwapAmount <= 0 || *initiateSwapFee < 0 || *initiateSwapTimeout <= 0 {
+			initiateSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.initiateSwap(*initiateSwapFrom, *initiateSwapTo, *initiateSwapAmount, *initiateSwapFee, *initiateSwapTimeout, nodeID, *initiateSwapMine)
+	}
+	if participateSwapCmd.Parsed() {
+		if *participateSwapFrom == "" || *participateSwapTo == "" || *participateSwapAmount <= 0 || *participateSwapSecretHash == "" || *participateSwapFee < 0 || *participateSwapTimeout <= 0 {
+			participateSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.participateSwap(*participateSwapFrom, *participateSwapTo, *participateSwapAmount, *participateSwapSecretHash, *participateSwapFee, *participateSwapTimeout, nodeID, *participateSwapMine)
+	}
+	if redeemSwapCmd.Parsed() {
+		if *redeemSwapContract == "" || *redeemSwapTx == "" || *redeemSwapSecret == "" || *redeemSwapFee < 0 {
+			redeemSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendSwap(*redeemSwapContract, *redeemSwapTx, *redeemSwapSecret, *redeemSwapFee, nodeID, *redeemSwapMine)
+	}
+	if refundSwapCmd.Parsed() {
+		if *refundSwapContract == "" || *refundSwapTx == "" || *refundSwapFee < 0 {
+			refundSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendSwap(*refundSwapContract, *refundSwapTx, "", *refundSwapFee, nodeID, *refundSwapMine)
+	}
+	if sendRawTxCmd.Parsed() {
+		if *sendRawTx == "" {
+			sendRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendRawTx(*sendRawTx, nodeID, *sendRawTxMine)
+	}
+	if signRawTxCmd.Parsed() {
+		if *signRawTx == "" || *signRawTxAddress == "" {
+			signRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signRawTx(*signRawTx, *signRawTxAddress, nodeID)
+	}
+	if spendMultiSigCmd.Parsed() {
+		if *spendMultiSigFrom == "" || *spendMultiSigTo == "" || *spendMultiSigAmount <= 0 || *spendMultiSigFee < 0 {
+			spendMultiSigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendMultiSig(*spendMultiSigFrom, *spendMultiSigRedeemScript, *spendMultiSigTo, *spendMultiSigAmount, *spendMultiSigFee, nodeID)
 	}
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
@@ -160,24 +435,69 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		SetMiningWorkers(*startNodeThreads)
+		SetAssumeValid(*startNodeAssumeValid)
+		proposals := make(map[string]bool)
+		if *startNodeAuthorize != "" {
+			proposals[*startNodeAuthorize] = true
+		}
+		if *startNodeDeauthorize != "" {
+			proposals[*startNodeDeauthorize] = false
+		}
+		cli.startNode(nodeID, *startNodeMiner, proposals)
 	}
 }
 
 
 
-func createBlockchain(address ,nodeID string) {
+func createBlockchain(address ,nodeID, engineName, signers, orderers, powHash string) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := CreateBlockchain(address,nodeID)
+	engine, err := NewEngine(engineName)
+	if err != nil {
+		log.Panic(err)
+	}
+	//PoA PBFT和Raft的创世块中记录初始的签名者 默认只有创建者自己
+	var pubKeyHashes [][]byte
+	if gs, ok := engine.(genesisSigner); ok {
+		if signers == "" {
+			signers = address
+		}
+		for _, signer := range strings.Split(signers, ",") {
+			if !ValidateAddress(signer) {
+				log.Panic("ERROR: Signer address is not valid")
+			}
+			pubKeyHash := Base58Decode([]byte(signer))
+			pubKeyHashes = append(pubKeyHashes, pubKeyHash[1:len(pubKeyHash)-4])
+		}
+		gs.SetGenesisSigners(pubKeyHashes)
+	}
+	//Raft的排序节点还需要网络地址 默认只有本节点
+	if raftEngine, ok := engine.(*RaftEngine); ok {
+		if orderers == "" {
+			orderers = fmt.Sprintf("localhost:%s", nodeID)
+		}
+		addresses := strings.Split(orderers, ",")
+		if len(addresses) != len(pubKeyHashes) {
+			log.Panic("ERROR: Every Raft orderer needs both a node address and a signer address")
+		}
+		raftEngine.SetGenesisAddresses(addresses)
+	}
+	//工作量证明的哈希函数在创世时选定 之后不能改变
+	if ph, ok := engine.(powHasher); ok {
+		if err := ph.SetPowHash(powHash); err != nil {
+			log.Panic(err)
+		}
+	}
+	bc := CreateBlockchain(address,nodeID,engine)
 	defer bc.DB.Close()
 	UTXOSet := UTXOSet{bc}
 	UTXOSet.Reindex()
 	fmt.Println("Done!")
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, proposals map[string]bool) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -186,24 +506,102 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	for address := range proposals {
+		if !ValidateAddress(address) {
+			log.Panic("ERROR: Proposed signer address is not valid")
+		}
+	}
+	StartServer(nodeID, minerAddress, proposals)
 }
 
 func (cli *CLI) getBalance(address,nodeID string) {
 	bc := NewBlockchain(nodeID)
 	defer bc.DB.Close()
-	balance := 0
 	UTXOSet := UTXOSet{bc}
-	pubKeyHash := Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1: len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
+	script, err := lockingScript(address)
+	if err != nil {
+		log.Panic(err)
 	}
+	balance, immature := UTXOSet.GetScriptBalance(script)
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature rewards: %d\n", immature)
+	}
 }
 
-func (cli *CLI) send(from, to string, amount int,nodeID string, mineNow bool) {
+//请求本节点增加或者删除一个Raft排序节点 本节点不是领导者时会转发给领导者
+//请求以本节点的名义发出 只有排序节点的命令行能够变更成员
+func (cli *CLI) raftMember(nodeID string, add bool, node, address string) {
+	self := fmt.Sprintf("localhost:%s", nodeID)
+	conf := raftconf{AddrFrom: self, Add: add, Address: node}
+	if add {
+		if !ValidateAddress(address) {
+			log.Panic("ERROR: Orderer address is not valid")
+		}
+		pubKeyHash := Base58Decode([]byte(address))
+		conf.PubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	}
+	sendRaftConf(self, conf)
+	fmt.Println("Membership change sent, check the node's log for the result")
+}
+
+//在内存中模拟一个Multi-Paxos集群 检查所有节点应用的值相同
+func (cli *CLI) paxosSim(nodes, values int, loss, duplicate float64) {
+	err := paxos.Simulate(paxos.SimulationConfig{
+		Nodes:     nodes,
+		Values:    values,
+		Loss:      loss,
+		Duplicate: duplicate,
+		Dir:       os.TempDir(),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("All nodes applied the same values in the same order")
+}
+
+//打印每个软分叉部署在下一个区块的状态 以及当前窗口中发出信号的区块数
+func (cli *CLI) getDeploymentInfo(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	tip, err := bc.GetBlock(bc.TipHash())
+	if err != nil {
+		log.Panic(err)
+	}
+	window := netParams.RetargetInterval
+	elapsed := (tip.Height + 1) % window
+	fmt.Printf("Height: %d\n", tip.Height)
+	fmt.Printf("Window: %d blocks, %d elapsed, threshold %d\n", window, elapsed, netParams.RuleChangeActivationThreshold)
+	for id, deployment := range netParams.Deployments {
+		state, err := bc.thresholdState(tip.Hash, id)
+		if err != nil {
+			log.Panic(err)
+		}
+		count, err := bc.countSignals(&tip, &deployment, elapsed)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("%s: bit %d, start %d, timeout %d\n", deployment.Name, deployment.Bit, deployment.StartTime, deployment.Timeout)
+		fmt.Printf("  State: %s\n", state)
+		if state == ThresholdStarted {
+			fmt.Printf("  Signalling: %d/%d\n", count, elapsed)
+		}
+	}
+}
+
+//打印到某个高度为止发行的货币总量 高度为负数时使用当前链的高度
+func (cli *CLI) getSupply(height int, nodeID string) {
+	if height < 0 {
+		bc := NewBlockchain(nodeID)
+		height = bc.GetBestHeight()
+		bc.DB.Close()
+	}
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Block subsidy: %d\n", CalcBlockSubsidy(height))
+	fmt.Printf("Total supply: %d / %d\n", TotalSupply(height), netParams.MaxMoney)
+}
+
+func (cli *CLI) send(from, to string, amount, fee, feeRate int, lockTime int64, nodeID string, mineNow bool) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -218,18 +616,340 @@ func (cli *CLI) send(from, to string, amount int,nodeID string, mineNow bool) {
 		log.Panic(err)
 	}
 	wallet := wallets.GetWallet(from)
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	var tx *Transaction
+	if feeRate > 0 {
+		tx, fee = NewUTXOTransactionWithFeeRate(&wallet, to, amount, feeRate, lockTime, &UTXOSet)
+	} else {
+		tx = NewUTXOTransaction(&wallet, to, amount, fee, lockTime, &UTXOSet)
+	}
+	fmt.Printf("Fee: %d\n", fee)
 	if mineNow{
-		cbTx := NewCoinbaseTX(from, "")
+		if _, ok := bc.engine.(*PbftEngine); ok {
+			log.Panic("ERROR: PBFT blocks are committed by the validators, send the transaction to a node instead")
+		}
+		cbTx := NewCoinbaseTX(from, "", bc.GetBestHeight()+1, fee)
 		txs :=[]*Transaction{cbTx,tx}
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err := bc.MineBlock(context.Background(), txs)
+		if err != nil {
+			log.Panic(err)
+		}
 	}else {
 		sendTx(knownNodes[0],tx)
 	}
 	fmt.Println("Success!")
 }
 
+//打印钱包中地址的公钥 用于创建多重签名地址
+func (cli *CLI) getPubKey(address, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet file")
+	}
+	fmt.Printf("Public key: %x\n", wallet.PublickKey)
+}
+
+//用逗号分隔的十六进制公钥生成需要required个签名的多重签名地址
+func (cli *CLI) createMultiSig(required int, pubKeys string) {
+	var keys [][]byte
+	for _, pubKey := range strings.Split(pubKeys, ",") {
+		key, err := hex.DecodeString(pubKey)
+		if err != nil || len(key) == 0 {
+			log.Panic("ERROR: Public key is not valid hex: ", pubKey)
+		}
+		keys = append(keys, key)
+	}
+	script, err := multiSigScript(required, keys)
+	if err != nil {
+		log.Panic(err)
+	}
+	disasm, _ := DisasmScript(script)
+	fmt.Printf("Address: %s\n", MultiSigAddress(script))
+	fmt.Printf("P2SH address: %s\n", ScriptHashAddress(script))
+	fmt.Printf("Redeem script: %x\n", script)
+	fmt.Printf("Script: %s\n", disasm)
+}
+
+//反汇编十六进制的脚本 并打印以它为赎回脚本的脚本哈希地址
+func (cli *CLI) decodeScript(scriptHex string) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		log.Panic("ERROR: Script is not valid hex")
+	}
+	disasm, err := DisasmScript(script)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Script: %s\n", disasm)
+	fmt.Printf("P2SH address: %s\n", ScriptHashAddress(script))
+}
+
+//生成花费多重签名地址的未签名交易
+func (cli *CLI) spendMultiSig(from, redeemScriptHex, to string, amount, fee int, nodeID string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	redeemScript, err := hex.DecodeString(redeemScriptHex)
+	if err != nil {
+		log.Panic("ERROR: Redeem script is not valid hex")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	tx := NewMultiSigTransaction(from, redeemScript, to, amount, fee, &UTXOSet{bc})
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+}
+
+//用钱包中的私钥为交易签名 打印签名后的交易和每个多重签名输入已有的签名数
+func (cli *CLI) signRawTx(txHex, address, nodeID string) {
+	tx := decodeRawTx(txHex)
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet file")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	bc.SignTransaction(&tx, wallet.PrivateKey)
+	prevOuts, err := bc.findPrevOuts(&tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	for inID, vin := range tx.Vin {
+		script := prevOuts[outpointKey(vin.Txid, vin.Vout)].ScriptPubKey
+		if redeemScript := tx.redeemScript(inID, script); redeemScript != nil {
+			script = redeemScript
+		}
+		if required, _ := extractMultiSig(script); required > 0 {
+			fmt.Printf("Input %d: %d/%d signatures\n", inID, len(tx.multiSigSignatures(inID, script)), required)
+		}
+	}
+	fmt.Printf("Complete: %t\n", tx.Verify(prevOuts))
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+}
+
+//发送签名完成的交易 签名不足的交易不会被发送
+//minerAddress不为空时在本节点挖出包含交易的区块 奖励发给minerAddress
+func (cli *CLI) sendRawTx(txHex, nodeID, minerAddress string) {
+	if minerAddress != "" && !ValidateAddress(minerAddress) {
+		log.Panic("ERROR: Miner address is not valid")
+	}
+	tx := decodeRawTx(txHex)
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	prevOuts, err := bc.findPrevOuts(&tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := tx.verifyScripts(prevOuts); err != nil {
+		log.Panic("ERROR: Transaction is not fully signed: ", err)
+	}
+	submitTransaction(bc, &tx, minerAddress)
+	fmt.Println("Success!")
+}
+
+//minerAddress不为空时在本节点挖出包含交易的区块 奖励发给minerAddress 否则把交易发送给中心节点
+func submitTransaction(bc *BlockChain, tx *Transaction, minerAddress string) {
+	if minerAddress == "" {
+		sendTx(knownNodes[0], tx)
+		return
+	}
+	if _, ok := bc.engine.(*PbftEngine); ok {
+		log.Panic("ERROR: PBFT blocks are committed by the validators, send the transaction to a node instead")
+	}
+	height := bc.GetBestHeight() + 1
+	fee, err := UTXOSet{bc}.CheckTransactionInputs(tx, height)
+	if err != nil {
+		log.Panic(err)
+	}
+	cbTx := NewCoinbaseTX(minerAddress, "", height, fee)
+	_, err = bc.MineBlock(context.Background(), []*Transaction{cbTx, tx})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//原子交换的发起方 生成秘密并创建合约 对方审核合约后在另一条链上用同一个秘密哈希创建合约
+func (cli *CLI) initiateSwap(from, to string, amount, fee int, timeout int64, nodeID string, mineNow bool) {
+	secret := newSwapSecret()
+	secretHash := sha256.Sum256(secret)
+	fmt.Printf("Secret: %x\n", secret)
+	cli.createSwap(from, to, amount, fee, secretHash[:], timeout, nodeID, mineNow)
+}
+
+//原子交换的参与方 发起方在这条链上赎回时会公开秘密 参与方再用秘密赎回发起方的合约
+//参与方合约的超时应该比发起方的短 保证发起方退款之前参与方还有时间赎回
+func (cli *CLI) participateSwap(from, to string, amount int, secretHashHex string, fee int, timeout int64, nodeID string, mineNow bool) {
+	secretHash, err := hex.DecodeString(secretHashHex)
+	if err != nil || len(secretHash) != sha256.Size {
+		log.Panic("ERROR: Secret hash is not a valid hex SHA-256 hash")
+	}
+	cli.createSwap(from, to, amount, fee, secretHash, timeout, nodeID, mineNow)
+}
+
+//创建并发送原子交换的合约交易 from在超时之后可以退款 to公开秘密后可以赎回
+func (cli *CLI) createSwap(from, to string, amount, fee int, secretHash []byte, timeout int64, nodeID string, mineNow bool) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	toScript, err := lockingScript(to)
+	if err != nil {
+		log.Panic(err)
+	}
+	recipientHash := extractPubKeyHash(toScript)
+	if recipientHash == nil {
+		log.Panic("ERROR: Recipient address must be a public key hash address")
+	}
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[from]
+	if !ok {
+		log.Panic("ERROR: Sender address is not in the wallet file")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	c := swapContract{recipientHash, HashPubKey(wallet.PublickKey), secretHash, AdjustedTime() + timeout}
+	contract := c.Script()
+	tx := NewSwapContractTransaction(wallet, contract, amount, fee, &UTXOSet{bc})
+	minerAddress := ""
+	if mineNow {
+		minerAddress = from
+	}
+	submitTransaction(bc, tx, minerAddress)
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	fmt.Printf("Locktime: %s\n", time.Unix(c.LockTime, 0).UTC())
+	fmt.Printf("Contract address: %s\n", ScriptHashAddress(contract))
+	fmt.Printf("Contract: %x\n", contract)
+	fmt.Printf("Contract transaction: %x\n", tx.Serialize())
+}
+
+//secretHex不为空时用秘密赎回合约 否则在锁定时间之后退款 付款给合约中对应的钱包地址
+func (cli *CLI) spendSwap(contractHex, txHex, secretHex string, fee int, nodeID string, mineNow bool) {
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		log.Panic("ERROR: Contract is not valid hex")
+	}
+	c, err := extractSwapContract(contract)
+	if err != nil {
+		log.Panic(err)
+	}
+	contractTx := decodeRawTx(txHex)
+	var secret []byte
+	pubKeyHash := c.RefundHash
+	if secretHex != "" {
+		if secret, err = hex.DecodeString(secretHex); err != nil {
+			log.Panic("ERROR: Secret is not valid hex")
+		}
+		pubKeyHash = c.RecipientHash
+	}
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	address := encodeAddress(version, pubKeyHash)
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address ", address, " of the contract is not in the wallet file")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	if secret == nil {
+		tip, err := bc.GetBlock(bc.TipHash())
+		if err != nil {
+			log.Panic(err)
+		}
+		if medianTime := bc.CalcPastMedianTime(&tip); medianTime <= c.LockTime {
+			log.Panic(fmt.Sprintf("ERROR: Contract can be refunded after %s, the median time of past blocks is %s",
+				time.Unix(c.LockTime, 0).UTC(), time.Unix(medianTime, 0).UTC()))
+		}
+	}
+
+	tx, err := NewSwapSpendTransaction(wallet, &contractTx, contract, secret, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	minerAddress := ""
+	if mineNow {
+		minerAddress = address
+	}
+	submitTransaction(bc, tx, minerAddress)
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+	fmt.Println("Success!")
+}
+
+//打印合约的条款 以及合约在本节点的链上是否已经确认 赎回或者退款
+//参与方从发起方的赎回交易中得到秘密
+func (cli *CLI) auditSwap(contractHex, txHex, nodeID string) {
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		log.Panic("ERROR: Contract is not valid hex")
+	}
+	c, err := extractSwapContract(contract)
+	if err != nil {
+		log.Panic(err)
+	}
+	contractTx := decodeRawTx(txHex)
+	if err := CheckTransactionSanity(&contractTx); err != nil {
+		log.Panic(err)
+	}
+	vout, err := findContractOutput(&contractTx, contract)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Contract address: %s\n", ScriptHashAddress(contract))
+	fmt.Printf("Amount: %d\n", contractTx.Vout[vout].Value)
+	fmt.Printf("Recipient address: %s\n", encodeAddress(version, c.RecipientHash))
+	fmt.Printf("Refund address: %s\n", encodeAddress(version, c.RefundHash))
+	fmt.Printf("Secret hash: %x\n", c.SecretHash)
+	fmt.Printf("Locktime: %s\n", time.Unix(c.LockTime, 0).UTC())
+
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+	tip, err := bc.GetBlock(bc.TipHash())
+	if err != nil {
+		log.Panic(err)
+	}
+	if remaining := c.LockTime - bc.CalcPastMedianTime(&tip); remaining >= 0 {
+		fmt.Printf("Locktime reached in: %s\n", time.Duration(remaining)*time.Second)
+	} else {
+		fmt.Println("Locktime reached, the contract can be refunded")
+	}
+	_, err = bc.FindTransaction(contractTx.ID)
+	fmt.Printf("Confirmed: %t\n", err == nil)
+	spend, secret, err := bc.findSwapSpend(&contractTx, contract)
+	if err != nil {
+		log.Panic(err)
+	}
+	switch {
+	case spend == nil:
+		fmt.Println("Spent: false")
+	case secret != nil:
+		fmt.Printf("Redeemed by: %x\n", spend.ID)
+		fmt.Printf("Secret: %x\n", secret)
+	default:
+		fmt.Printf("Refunded by: %x\n", spend.ID)
+	}
+}
+
+func decodeRawTx(txHex string) Transaction {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		log.Panic("ERROR: Transaction is not valid hex")
+	}
+	return DeserializeTransaction(data)
+}
+
 func (cli *CLI) createWallet(nodeID string) {
 	wallets, _ := NewWallets(nodeID)
 	address := wallets.CreateWallet()
@@ -0,0 +1,97 @@
+package Block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+//检查点 主链在Height处的区块必须是Hash
+type Checkpoint struct {
+	Height int
+	Hash   []byte
+}
+
+//检查区块是否与检查点冲突
+//检查点高度上的区块必须与检查点一致 已经有了某个检查点区块之后 不再接受比它低的区块 即不允许在它之前分叉
+func (bc *BlockChain) checkCheckpoints(block *Block) error {
+	for _, checkpoint := range netParams.Checkpoints {
+		if block.Height == checkpoint.Height && !bytes.Equal(block.Hash, checkpoint.Hash) {
+			return ruleError(ErrBadCheckpoint, fmt.Sprintf("block %x at height %d does not match checkpoint %x", block.Hash, block.Height, checkpoint.Hash))
+		}
+		if block.Height < checkpoint.Height && bc.HasBlock(checkpoint.Hash) {
+			return ruleError(ErrForkTooOld, fmt.Sprintf("block %x at height %d forks the chain before checkpoint %d", block.Hash, block.Height, checkpoint.Height))
+		}
+	}
+	return nil
+}
+
+//假定有效的区块及其祖先中的交易签名不再检查 工作量 merkle根和UTXO的检查照常进行
+//祖先由区块头的PrevHash链接决定 可以从数据库中的区块或者同步时收到的区块头得到
+var assumeValid = struct {
+	sync.Mutex
+	enabled   bool
+	ancestors map[string]bool //假定有效的区块和它的全部祖先
+}{enabled: true}
+
+//打开或关闭假定有效 关闭后检查全部签名
+func SetAssumeValid(enabled bool) {
+	assumeValid.Lock()
+	defer assumeValid.Unlock()
+	assumeValid.enabled = enabled
+}
+
+//是否还需要从其他节点的区块头中得到假定有效区块的祖先
+func (bc *BlockChain) needAssumeValidHeaders() bool {
+	assumeValid.Lock()
+	defer assumeValid.Unlock()
+	return assumeValid.enabled && len(netParams.AssumeValid) > 0 && assumeValid.ancestors == nil && !bc.HasBlock(netParams.AssumeValid)
+}
+
+//从按高度排列的连续区块头中找出假定有效的区块 记录它和它的祖先
+//区块头的hash承诺了PrevHash 所以只要链接正确 得到的就是它真正的祖先
+func learnAssumeValid(headers []*BlockHeader) {
+	assumeValid.Lock()
+	defer assumeValid.Unlock()
+	if assumeValid.ancestors != nil {
+		return
+	}
+	for i := len(headers) - 1; i >= 0; i-- {
+		if !bytes.Equal(headers[i].BlockHash(), netParams.AssumeValid) {
+			continue
+		}
+		ancestors := map[string]bool{hex.EncodeToString(netParams.AssumeValid): true}
+		for ; i > 0 && bytes.Equal(headers[i].PrevHash, headers[i-1].BlockHash()); i-- {
+			ancestors[hex.EncodeToString(headers[i].PrevHash)] = true
+		}
+		assumeValid.ancestors = ancestors
+		return
+	}
+}
+
+//在数据库事务中判断区块是否是假定有效的区块或者它的祖先
+func isAssumedValid(tx *bolt.Tx, hash []byte) bool {
+	if len(netParams.AssumeValid) == 0 {
+		return false
+	}
+	assumeValid.Lock()
+	defer assumeValid.Unlock()
+	if !assumeValid.enabled {
+		return false
+	}
+	if assumeValid.ancestors == nil {
+		if blockFromTx(tx, netParams.AssumeValid) == nil {
+			return false
+		}
+		//假定有效的区块已经在数据库中 沿PrevHash找出它的全部祖先
+		ancestors := make(map[string]bool)
+		for block := blockFromTx(tx, netParams.AssumeValid); block != nil; block = blockFromTx(tx, block.PrevHash) {
+			ancestors[hex.EncodeToString(block.Hash)] = true
+		}
+		assumeValid.ancestors = ancestors
+	}
+	return assumeValid.ancestors[hex.EncodeToString(hash)]
+}
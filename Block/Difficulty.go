@@ -0,0 +1,106 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"math/big"
+)
+
+//将紧凑格式的难度(与比特币的nBits相同)还原为目标值
+//最高字节是指数 低三字节是尾数 target = mantissa * 256^(exponent-3)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+	return bn
+}
+
+//将目标值转换为紧凑格式 精度只保留最高的三个字节
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Rsh(n, 8*(exponent-3))
+		mantissa = uint32(tn.Bits()[0])
+	}
+
+	//最高位是符号位 被占用时尾数右移一字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
+
+//计算高度为height 父块为prevHash的区块应该使用的难度 目标值不超过limit
+//每RetargetInterval个块根据上一个窗口实际花费的时间调整一次
+//调整幅度限制在RetargetAdjustmentFactor倍以内 防止难度剧烈波动
+func calcNextRequiredBits(chain consensus.ChainReader, prevHash []byte, height int, limit *big.Int) (uint32, error) {
+	if height == 0 {
+		return BigToCompact(limit), nil
+	}
+	prev, err := chain.GetHeader(prevHash)
+	if err != nil {
+		return 0, err
+	}
+
+	//不在调整点上 沿用上一块的难度
+	if height%netParams.RetargetInterval != 0 {
+		return prev.Bits, nil
+	}
+
+	//找到窗口中的第一个块
+	first := prev
+	for i := 0; i < netParams.RetargetInterval-1; i++ {
+		first, err = chain.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	targetTimespan := netParams.TargetTimePerBlock * int64(netParams.RetargetInterval-1)
+	minTimespan := targetTimespan / netParams.RetargetAdjustmentFactor
+	maxTimespan := targetTimespan * netParams.RetargetAdjustmentFactor
+
+	actualTimespan := prev.Timestamp - first.Timestamp
+	if actualTimespan < minTimespan {
+		actualTimespan = minTimespan
+	} else if actualTimespan > maxTimespan {
+		actualTimespan = maxTimespan
+	}
+
+	//新目标 = 旧目标 * 实际时间 / 期望时间
+	newTarget := CompactToBig(prev.Bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+
+	if newTarget.Cmp(limit) > 0 {
+		newTarget.Set(limit)
+	}
+
+	return BigToCompact(newTarget), nil
+}
+
+//计算一个难度对应的工作量 即平均需要尝试的哈希次数 2^256 / (target+1)
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, bigOne)
+	return new(big.Int).Div(new(big.Int).Lsh(bigOne, 256), denominator)
+}
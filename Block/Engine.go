@@ -0,0 +1,70 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"context"
+	"fmt"
+	"sort"
+)
+
+//没有记录共识引擎的旧数据库使用PoW
+const defaultEngine = "pow"
+
+//可以选择的共识引擎 创建区块链时选定后记录在数据库中
+var engines = map[string]func() consensus.Engine{
+	"pow": func() consensus.Engine { return &PowEngine{} },
+	"poa": func() consensus.Engine { return &PoaEngine{} },
+	"pos": func() consensus.Engine { return &PosEngine{} },
+	"pbft": func() consensus.Engine { return &PbftEngine{} },
+	"raft": func() consensus.Engine { return &RaftEngine{} },
+}
+
+//除了区块头还要决定区块内容的共识引擎 例如PoS要加入coinstake交易和作恶证据
+type bodyEngine interface {
+	//在区块头准备好之后 计算merkle根之前修改区块内容
+	finalizeBlock(ctx context.Context, bc *BlockChain, block *Block) error
+	//检查区块内容是否符合共识
+	verifyBody(bc *BlockChain, block *Block) error
+}
+
+//在创世块中记录初始签名者的共识引擎 例如PoA的签名者 PBFT的验证者和Raft的排序节点
+type genesisSigner interface {
+	SetGenesisSigners(signers [][]byte)
+}
+
+//可以选择工作量证明哈希函数的共识引擎 哈希函数在创建区块链时记录在数据库中
+type powHasher interface {
+	PowHash() string
+	SetPowHash(name string) error
+}
+
+//提供确定性最终性的共识引擎 最终确定的区块加入主链后不能再被链重组回滚
+type finalityEngine interface {
+	//已经通过ValidateBlock的区块是否最终确定
+	isFinal(block *Block) bool
+}
+
+//父块未知时检查区块封装的共识引擎 孤块通过检查后才能放入孤块池
+//例如PoW检查工作量 签名的引擎检查签名
+type orphanSealer interface {
+	verifyOrphanSeal(header *BlockHeader) error
+}
+
+//根据名称创建共识引擎
+func NewEngine(name string) (consensus.Engine, error) {
+	newEngine, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown consensus engine %q", name)
+	}
+	return newEngine(), nil
+}
+
+//所有可选共识引擎的名称
+func EngineNames() []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,49 @@
+package Block
+
+import (
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+//保存最终确定的区块 最终确定的区块和它之前的主链区块不能再被链重组回滚
+//键："f"   值：最新的最终确定区块的hash
+const finalityBucket = "finality"
+
+//在数据库事务中读取最新的最终确定区块 没有时返回nil
+func finalBlockFromTx(tx *bolt.Tx) *Block {
+	b := tx.Bucket([]byte(finalityBucket))
+	if b == nil {
+		return nil
+	}
+	return blockFromTx(tx, b.Get([]byte("f")))
+}
+
+//在数据库事务中把主链上的block记录为最终确定 高度不高于已有最终区块时什么也不做
+func setFinalBlock(tx *bolt.Tx, block *Block) error {
+	if final := finalBlockFromTx(tx); final != nil && final.Height >= block.Height {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(finalityBucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("f"), block.Hash)
+}
+
+//最新的最终确定区块的hash和高度 没有最终确定的区块时返回nil和-1
+func (bc *BlockChain) FinalBlock() ([]byte, int) {
+	var hash []byte
+	height := -1
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		if final := finalBlockFromTx(tx); final != nil {
+			hash = final.Hash
+			height = final.Height
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return hash, height
+}
@@ -0,0 +1,51 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+//公钥正好64字节并且地址能够解码的钱包
+//X或Y以0开头时公钥会变短 验证签名时从中间拆开会得到错误的坐标
+//公钥哈希以0开头时Base58只保留版本号的一个0 地址解码后校验和错误
+func newTestWallet() *Wallet {
+	for {
+		wallet := NewWallet()
+		if len(wallet.PublickKey) == 64 && HashPubKey(wallet.PublickKey)[0] != 0 {
+			return wallet
+		}
+	}
+}
+
+//测试用的区块链 创世块奖励发给返回的钱包 调用返回的函数关闭并删除数据库
+func newTestChain(t *testing.T, engine consensus.Engine) (*BlockChain, *Wallet, func()) {
+	nodeID := "test_" + strings.Replace(t.Name(), "/", "_", -1)
+	file := fmt.Sprintf(dbFile, nodeID)
+	os.Remove(file)
+	wallet := newTestWallet()
+	bc := CreateBlockchain(string(wallet.GetAddress()), nodeID, engine)
+	UTXOSet{bc}.Reindex()
+	return bc, wallet, func() {
+		bc.DB.Close()
+		os.Remove(file)
+	}
+}
+
+//挖出一个包含txs的区块 奖励和手续费发给miner
+func mineTestBlock(bc *BlockChain, miner string, txs ...*Transaction) (*Block, error) {
+	height := bc.GetBestHeight() + 1
+	fees := 0
+	for _, tx := range txs {
+		fee, err := UTXOSet{bc}.CheckTransactionInputs(tx, height)
+		if err != nil {
+			return nil, err
+		}
+		fees += fee
+	}
+	cbTx := NewCoinbaseTX(miner, "", height, fees)
+	return bc.MineBlock(context.Background(), append([]*Transaction{cbTx}, txs...))
+}
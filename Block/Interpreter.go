@@ -0,0 +1,545 @@
+package Block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+//脚本执行的限制 防止恶意脚本消耗过多的资源
+const (
+	maxScriptSize         = 10000 //脚本的最大字节数
+	maxScriptElementSize  = 520   //栈上单个元素的最大字节数
+	maxOpsPerScript       = 201   //每段脚本最多执行多少条非压入指令
+	maxStackSize          = 1000  //栈和条件栈中元素的最大个数
+	maxScriptNumLen       = 4     //算术运算的操作数最多4字节
+	maxPubKeysPerMultiSig = 20    //OP_CHECKMULTISIG最多检查的公钥数
+	maxLockTimeNumLen     = 5     //时间锁的操作数最多5字节 可以表示所有uint32的值
+)
+
+//脚本执行失败的原因
+type ScriptError struct {
+	Description string
+}
+
+func (e ScriptError) Error() string {
+	return e.Description
+}
+
+func scriptError(format string, args ...interface{}) ScriptError {
+	return ScriptError{fmt.Sprintf(format, args...)}
+}
+
+//脚本解释器 在交易tx的第inIndex个输入上依次执行解锁脚本和锁定脚本
+//解释器只能访问栈和正在验证的交易 脚本中没有循环 每段脚本的指令数有上限
+type scriptEngine struct {
+	tx        *Transaction
+	inIndex   int
+	stack     [][]byte
+	condStack []bool //嵌套的OP_IF分支是否执行
+	numOps    int
+	script    []byte //正在执行的脚本 签名检查时作为被签名的锁定脚本
+}
+
+func newScriptEngine(tx *Transaction, inIndex int) *scriptEngine {
+	return &scriptEngine{tx: tx, inIndex: inIndex}
+}
+
+//执行交易第inIndex个输入的解锁脚本和它花费的输出的锁定脚本 最终栈顶为真时通过
+//花费付款给脚本哈希的输出时 解锁脚本最后压入的赎回脚本与哈希相符后 在剩余的栈上再执行赎回脚本
+func verifyInputScript(tx *Transaction, inIndex int, prevOut TXOutput) error {
+	scriptSig := tx.Vin[inIndex].ScriptSig
+	sigPops, err := parseScript(scriptSig)
+	if err != nil {
+		return scriptError("input %d has a malformed scriptSig: %s", inIndex, err)
+	}
+	if !isPushOnly(sigPops) {
+		return scriptError("input %d has a scriptSig that is not push only", inIndex)
+	}
+	e := newScriptEngine(tx, inIndex)
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	sigStack := append([][]byte{}, e.stack...)
+	if err := e.execute(prevOut.ScriptPubKey); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !asBool(e.stack[len(e.stack)-1]) {
+		return scriptError("input %d: script evaluated to false", inIndex)
+	}
+	if extractScriptHash(prevOut.ScriptPubKey) == nil {
+		return nil
+	}
+
+	e.stack = sigStack
+	redeemScript, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if err := e.execute(redeemScript); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !asBool(e.stack[len(e.stack)-1]) {
+		return scriptError("input %d: redeem script evaluated to false", inIndex)
+	}
+	return nil
+}
+
+//执行一段脚本 栈保留给下一段脚本
+func (e *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return scriptError("script of %d bytes exceeds the limit of %d", len(script), maxScriptSize)
+	}
+	pops, err := parseScript(script)
+	if err != nil {
+		return scriptError("malformed script: %s", err)
+	}
+	e.script = script
+	e.numOps = 0
+	e.condStack = nil
+	for i := range pops {
+		if err := e.step(&pops[i]); err != nil {
+			return err
+		}
+		if len(e.stack)+len(e.condStack) > maxStackSize {
+			return scriptError("stack size exceeds the limit of %d", maxStackSize)
+		}
+	}
+	if len(e.condStack) != 0 {
+		return scriptError("OP_IF without OP_ENDIF")
+	}
+	return nil
+}
+
+//当前是否处于执行的分支中
+func (e *scriptEngine) executing() bool {
+	for _, branch := range e.condStack {
+		if !branch {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+func (e *scriptEngine) pushBool(v bool) {
+	if v {
+		e.push([]byte{1})
+	} else {
+		e.push(nil)
+	}
+}
+
+//从栈顶弹出一个元素
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, scriptError("stack underflow")
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+//从栈顶弹出一个数字
+func (e *scriptEngine) popNum() (scriptNum, error) {
+	v, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	n, err := makeScriptNum(v, maxScriptNumLen)
+	if err != nil {
+		return 0, scriptError("%s", err)
+	}
+	return n, nil
+}
+
+func (e *scriptEngine) popBool() (bool, error) {
+	v, err := e.pop()
+	if err != nil {
+		return false, err
+	}
+	return asBool(v), nil
+}
+
+//栈顶向下第n个元素 0表示栈顶
+func (e *scriptEngine) peek(n int) ([]byte, error) {
+	if n >= len(e.stack) {
+		return nil, scriptError("stack underflow")
+	}
+	return e.stack[len(e.stack)-1-n], nil
+}
+
+//全0或者负0为假 其余为真
+func asBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+//执行一条指令
+func (e *scriptEngine) step(pop *parsedOpcode) error {
+	op := pop.opcode
+	if len(pop.data) > maxScriptElementSize {
+		return scriptError("push of %d bytes exceeds the limit of %d", len(pop.data), maxScriptElementSize)
+	}
+	if !pop.isPush() {
+		e.numOps++
+		if e.numOps > maxOpsPerScript {
+			return scriptError("script exceeds the limit of %d operations", maxOpsPerScript)
+		}
+	}
+
+	//不执行的分支中只处理条件指令
+	if !e.executing() && (op < OpIf || op > OpEndIf) {
+		return nil
+	}
+
+	switch {
+	case op <= OpPushData2:
+		e.push(pop.data)
+		return nil
+	case op == Op1Negate || (op >= Op1 && op <= Op16):
+		n := scriptNum(-1)
+		if op != Op1Negate {
+			n = scriptNum(op - Op1 + 1)
+		}
+		e.push(n.Bytes())
+		return nil
+	}
+
+	switch op {
+	case OpNop:
+
+	case OpIf, OpNotIf:
+		branch := false
+		if e.executing() {
+			v, err := e.popBool()
+			if err != nil {
+				return err
+			}
+			branch = v == (op == OpIf)
+		}
+		e.condStack = append(e.condStack, branch)
+	case OpElse:
+		if len(e.condStack) == 0 {
+			return scriptError("OP_ELSE without OP_IF")
+		}
+		e.condStack[len(e.condStack)-1] = !e.condStack[len(e.condStack)-1]
+	case OpEndIf:
+		if len(e.condStack) == 0 {
+			return scriptError("OP_ENDIF without OP_IF")
+		}
+		e.condStack = e.condStack[:len(e.condStack)-1]
+	case OpVerify:
+		return e.verify(op)
+	case OpReturn:
+		return scriptError("script called OP_RETURN")
+
+	case OpDrop:
+		_, err := e.pop()
+		return err
+	case OpDup:
+		v, err := e.peek(0)
+		if err != nil {
+			return err
+		}
+		e.push(v)
+	case OpOver:
+		v, err := e.peek(1)
+		if err != nil {
+			return err
+		}
+		e.push(v)
+	case OpSwap:
+		if len(e.stack) < 2 {
+			return scriptError("stack underflow")
+		}
+		n := len(e.stack)
+		e.stack[n-1], e.stack[n-2] = e.stack[n-2], e.stack[n-1]
+	case OpSize:
+		v, err := e.peek(0)
+		if err != nil {
+			return err
+		}
+		e.push(scriptNum(len(v)).Bytes())
+
+	case OpEqual, OpEqualVerify:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.pushBool(bytes.Equal(a, b))
+		if op == OpEqualVerify {
+			return e.verify(op)
+		}
+
+	case Op1Add, Op1Sub, OpNot, Op0NotEqual:
+		n, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case Op1Add:
+			e.push((n + 1).Bytes())
+		case Op1Sub:
+			e.push((n - 1).Bytes())
+		case OpNot:
+			e.pushBool(n == 0)
+		case Op0NotEqual:
+			e.pushBool(n != 0)
+		}
+
+	case OpAdd, OpSub, OpBoolAnd, OpBoolOr, OpNumEqual, OpNumEqualVerify,
+		OpLessThan, OpGreaterThan, OpLessThanOrEqual, OpGreaterThanOrEqual, OpMin, OpMax:
+		b, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case OpAdd:
+			e.push((a + b).Bytes())
+		case OpSub:
+			e.push((a - b).Bytes())
+		case OpBoolAnd:
+			e.pushBool(a != 0 && b != 0)
+		case OpBoolOr:
+			e.pushBool(a != 0 || b != 0)
+		case OpNumEqual, OpNumEqualVerify:
+			e.pushBool(a == b)
+			if op == OpNumEqualVerify {
+				return e.verify(op)
+			}
+		case OpLessThan:
+			e.pushBool(a < b)
+		case OpGreaterThan:
+			e.pushBool(a > b)
+		case OpLessThanOrEqual:
+			e.pushBool(a <= b)
+		case OpGreaterThanOrEqual:
+			e.pushBool(a >= b)
+		case OpMin:
+			if b < a {
+				a = b
+			}
+			e.push(a.Bytes())
+		case OpMax:
+			if b > a {
+				a = b
+			}
+			e.push(a.Bytes())
+		}
+	case OpWithin:
+		max, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		min, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		e.pushBool(x >= min && x < max)
+
+	case OpRipemd160, OpSha256, OpHash160, OpHash256:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(hashOp(op, v))
+
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := e.tx.signatureHash(e.inIndex, e.script)
+		e.pushBool(verifyHashSignature(pubKey, signature, hash))
+		if op == OpCheckSigVerify {
+			return e.verify(op)
+		}
+
+	case OpCheckLockTimeVerify:
+		return e.checkLockTime()
+	case OpCheckSequenceVerify:
+		return e.checkSequence()
+
+	case OpCheckMultiSig, OpCheckMultiSigVerify:
+		ok, err := e.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		e.pushBool(ok)
+		if op == OpCheckMultiSigVerify {
+			return e.verify(op)
+		}
+
+	default:
+		return scriptError("unknown opcode 0x%02x", op)
+	}
+	return nil
+}
+
+//栈上依次为 <signature1> ... <signatureM> <M> <pubKey1> ... <pubKeyN> <N>
+//签名按顺序与公钥匹配 一个公钥最多匹配一个签名 所有签名都匹配时成功
+//比特币的OP_CHECKMULTISIG会多弹出一个无用的元素 这里没有保留这个问题
+func (e *scriptEngine) checkMultiSig() (bool, error) {
+	n, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultiSig {
+		return false, scriptError("OP_CHECKMULTISIG with %d public keys exceeds the limit of %d", n, maxPubKeysPerMultiSig)
+	}
+	//每个公钥都计入指令数
+	e.numOps += int(n)
+	if e.numOps > maxOpsPerScript {
+		return false, scriptError("script exceeds the limit of %d operations", maxOpsPerScript)
+	}
+	pubKeys := make([][]byte, n)
+	for i := int(n) - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, scriptError("OP_CHECKMULTISIG cannot require %d of %d signatures", m, n)
+	}
+	if int(m) > len(e.stack) {
+		return false, scriptError("OP_CHECKMULTISIG requires %d signatures but only %d are provided", m, len(e.stack))
+	}
+	signatures := make([][]byte, m)
+	for i := int(m) - 1; i >= 0; i-- {
+		signatures[i], _ = e.pop()
+	}
+
+	hash := e.tx.signatureHash(e.inIndex, e.script)
+	key := 0
+	for _, signature := range signatures {
+		for key < len(pubKeys) && !verifyHashSignature(pubKeys[key], signature, hash) {
+			key++
+		}
+		if key == len(pubKeys) {
+			return false, nil
+		}
+		key++
+	}
+	return true, nil
+}
+
+//栈顶的锁定时间与交易的锁定时间类型相同 并且不晚于交易的锁定时间
+//交易的锁定时间只在输入的序号不是最大值时生效 所以还要求这个输入的序号不是最大值
+//栈顶的值不弹出
+func (e *scriptEngine) checkLockTime() error {
+	lockTime, err := e.peekLockNum()
+	if err != nil {
+		return err
+	}
+	txLockTime := e.tx.LockTime
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return scriptError("lock time %d and transaction lock time %d are of different types", lockTime, txLockTime)
+	}
+	if lockTime > txLockTime {
+		return scriptError("lock time %d is later than transaction lock time %d", lockTime, txLockTime)
+	}
+	if e.tx.Vin[e.inIndex].Sequence == maxTxInSequenceNum {
+		return scriptError("input %d has the final sequence number, transaction lock time is disabled", e.inIndex)
+	}
+	return nil
+}
+
+//栈顶的相对锁定与输入序号中的相对锁定类型相同 并且不长于输入的相对锁定
+//栈顶的值设置了禁用位时相当于OP_NOP 栈顶的值不弹出
+func (e *scriptEngine) checkSequence() error {
+	sequence, err := e.peekLockNum()
+	if err != nil {
+		return err
+	}
+	if sequence&sequenceLockTimeDisabled != 0 {
+		return nil
+	}
+	txSequence := int64(e.tx.Vin[e.inIndex].Sequence)
+	if txSequence&sequenceLockTimeDisabled != 0 {
+		return scriptError("input %d has relative lock time disabled", e.inIndex)
+	}
+	if sequence&sequenceLockTimeIsSeconds != txSequence&sequenceLockTimeIsSeconds {
+		return scriptError("relative lock %d and input sequence %d are of different types", sequence, txSequence)
+	}
+	if sequence&sequenceLockTimeMask > txSequence&sequenceLockTimeMask {
+		return scriptError("relative lock %d is longer than input sequence %d", sequence&sequenceLockTimeMask, txSequence&sequenceLockTimeMask)
+	}
+	return nil
+}
+
+//读取栈顶的时间锁 不能为负数
+func (e *scriptEngine) peekLockNum() (int64, error) {
+	v, err := e.peek(0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := makeScriptNum(v, maxLockTimeNumLen)
+	if err != nil {
+		return 0, scriptError("%s", err)
+	}
+	if n < 0 {
+		return 0, scriptError("negative lock time %d", n)
+	}
+	return int64(n), nil
+}
+
+//弹出栈顶 为假时脚本失败
+func (e *scriptEngine) verify(op byte) error {
+	ok, err := e.popBool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return scriptError("%s failed", opcodeNames[op])
+	}
+	return nil
+}
+
+func hashOp(op byte, v []byte) []byte {
+	switch op {
+	case OpRipemd160:
+		hasher := ripemd160.New()
+		hasher.Write(v)
+		return hasher.Sum(nil)
+	case OpSha256:
+		hash := sha256.Sum256(v)
+		return hash[:]
+	case OpHash160:
+		return HashPubKey(v)
+	case OpHash256:
+		first := sha256.Sum256(v)
+		hash := sha256.Sum256(first[:])
+		return hash[:]
+	}
+	panic("not a hash opcode")
+}
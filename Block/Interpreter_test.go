@@ -0,0 +1,121 @@
+package Block
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+//花费一个输出的交易 只有一个输入
+func testSpendTx(lockTime int64, sequence uint32) *Transaction {
+	tx := &Transaction{
+		Vin:      []TXInput{{make([]byte, 32), 0, nil, sequence}},
+		Vout:     []TXOutput{{1, payToPubKeyHashScript(make([]byte, 20))}},
+		LockTime: lockTime,
+	}
+	tx.SetID()
+	return tx
+}
+
+//用钱包的私钥对交易第0个输入签名 subScript是被签名的锁定脚本或赎回脚本
+func testSign(t *testing.T, w *Wallet, tx *Transaction, subScript []byte) []byte {
+	signature, err := signHash(w.PrivateKey, tx.signatureHash(0, subScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+//验证交易第0个输入 errSubstr为空时必须通过 否则错误中必须包含errSubstr
+func checkScript(t *testing.T, name string, tx *Transaction, scriptPubKey []byte, errSubstr string) {
+	err := verifyInputScript(tx, 0, TXOutput{1, scriptPubKey})
+	switch {
+	case errSubstr == "" && err != nil:
+		t.Errorf("%s: %v", name, err)
+	case errSubstr != "" && err == nil:
+		t.Errorf("%s: script passed, want %q", name, errSubstr)
+	case errSubstr != "" && !strings.Contains(err.Error(), errSubstr):
+		t.Errorf("%s: got %v, want %q", name, err, errSubstr)
+	case err != nil && !isScriptError(err):
+		t.Errorf("%s: %v is not a ScriptError", name, err)
+	}
+}
+
+func isScriptError(err error) bool {
+	_, ok := err.(ScriptError)
+	return ok
+}
+
+//count个相同的操作码
+func repeatOp(op byte, count int) []byte {
+	return bytes.Repeat([]byte{op}, count)
+}
+
+//正好maxScriptSize字节并且执行成功的脚本 由最大的压入和OP_DROP组成 剩余的字节用OP_1填满
+func maxSizeScript() []byte {
+	builder := NewScriptBuilder()
+	element := make([]byte, maxScriptElementSize)
+	for len(builder.Script())+len(element)+4 <= maxScriptSize {
+		builder.AddData(element).AddOp(OpDrop)
+	}
+	script := builder.Script()
+	return append(script, repeatOp(Op1, maxScriptSize-len(script))...)
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	w := newTestWallet()
+	other := newTestWallet()
+	lock := payToPubKeyHashScript(HashPubKey(w.PublickKey))
+	tx := testSpendTx(0, maxTxInSequenceNum)
+	signature := testSign(t, w, tx, lock)
+	otherTx := testSpendTx(1, maxTxInSequenceNum)
+
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		errSubstr string
+	}{
+		{"owner signature", payToPubKeyHashSigScript(signature, w.PublickKey), ""},
+		{"key of another wallet", payToPubKeyHashSigScript(testSign(t, other, tx, lock), other.PublickKey), "OP_EQUALVERIFY failed"},
+		{"signature of another transaction", payToPubKeyHashSigScript(testSign(t, w, otherTx, lock), w.PublickKey), "evaluated to false"},
+		{"empty signature", payToPubKeyHashSigScript(nil, w.PublickKey), "evaluated to false"},
+		{"missing signature", NewScriptBuilder().AddData(w.PublickKey).Script(), "stack underflow"},
+		{"empty scriptSig", nil, "stack underflow"},
+	}
+	for _, test := range tests {
+		tx.Vin[0].ScriptSig = test.scriptSig
+		checkScript(t, test.name, tx, lock, test.errSubstr)
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		errSubstr    string
+	}{
+		{"operations at the limit", nil, append(repeatOp(OpNop, maxOpsPerScript), Op1), ""},
+		{"too many operations", nil, append(repeatOp(OpNop, maxOpsPerScript+1), Op1), "exceeds the limit of 201 operations"},
+		{"pushes do not count as operations", nil, repeatOp(Op1, maxOpsPerScript+1), ""},
+		{"stack at the limit", nil, repeatOp(Op1, maxStackSize), ""},
+		{"stack over the limit", nil, repeatOp(Op1, maxStackSize+1), "stack size exceeds the limit of 1000"},
+		{"stack over the limit across scripts", repeatOp(Op1, maxStackSize/2+1), repeatOp(Op1, maxStackSize/2), "stack size exceeds the limit of 1000"},
+		{"script at the size limit", nil, maxSizeScript(), ""},
+		{"script over the size limit", nil, repeatOp(OpNop, maxScriptSize+1), "exceeds the limit of 10000"},
+		{"push at the element limit", nil, NewScriptBuilder().AddData(bytes.Repeat([]byte{1}, maxScriptElementSize)).Script(), ""},
+		{"push over the element limit", nil, NewScriptBuilder().AddData(bytes.Repeat([]byte{1}, maxScriptElementSize+1)).Script(), "push of 521 bytes exceeds the limit of 520"},
+		{"scriptSig with an operation", []byte{Op1, OpDup}, []byte{OpDrop}, "not push only"},
+		{"scriptSig with OP_NOP", []byte{OpNop, Op1}, []byte{Op1}, "not push only"},
+		{"truncated push", []byte{OpPushData1}, []byte{Op1}, "malformed scriptSig"},
+		{"OP_RETURN", nil, []byte{Op1, OpReturn}, "OP_RETURN"},
+		{"OP_IF without OP_ENDIF", nil, []byte{Op1, OpIf, Op1}, "OP_IF without OP_ENDIF"},
+		{"OP_VERIFY on false", nil, []byte{Op0, OpVerify, Op1}, "OP_VERIFY failed"},
+		{"false result", nil, []byte{Op0}, "evaluated to false"},
+	}
+	for _, test := range tests {
+		tx := testSpendTx(0, maxTxInSequenceNum)
+		tx.Vin[0].ScriptSig = test.scriptSig
+		checkScript(t, test.name, tx, test.scriptPubKey, test.errSubstr)
+	}
+}
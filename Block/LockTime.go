@@ -0,0 +1,114 @@
+package Block
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+//交易的锁定时间小于它时表示区块高度 否则表示unix时间戳
+const lockTimeThreshold = 500000000
+
+//输入的序号
+//所有输入的序号都为最大值时锁定时间不起作用
+//最高位为0时低16位是相对锁定 从被花费的输出所在区块开始计算 第22位为1时单位是512秒 否则是区块数
+const (
+	maxTxInSequenceNum          = 0xffffffff
+	sequenceLockTimeDisabled    = 1 << 31
+	sequenceLockTimeIsSeconds   = 1 << 22
+	sequenceLockTimeMask        = 0x0000ffff
+	sequenceLockTimeGranularity = 9
+)
+
+//交易在高度为height 父块过去中位时间为medianTime的区块中是否已经生效
+//锁定时间为0 或者已经过了锁定的高度或时间 或者所有输入的序号都为最大值时生效
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= lockTimeThreshold {
+		limit = medianTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+	for _, vin := range tx.Vin {
+		if vin.Sequence != maxTxInSequenceNum {
+			return false
+		}
+	}
+	return true
+}
+
+//相对锁定要求的最大高度和最晚中位时间 区块的高度和父块的过去中位时间都大于它们时交易才能打包
+//-1表示没有要求
+type sequenceLock struct {
+	MinHeight int
+	MinTime   int64
+}
+
+//在数据库事务中检查交易能否打包进父块为prev 高度为prev.Height+1的区块
+//锁定时间与父块的过去中位时间比较 相对锁定从被花费的输出所在区块开始计算
+func checkTxLocks(tx *bolt.Tx, transaction *Transaction, prev *Block) error {
+	getBlock := func(hash []byte) *Block {
+		return blockFromTx(tx, hash)
+	}
+	height := prev.Height + 1
+	medianTime := pastMedianTime(prev, getBlock)
+	if !transaction.IsFinal(height, medianTime) {
+		return ruleError(ErrUnfinalizedTx, fmt.Sprintf("transaction %x is locked until %d, block height %d, median time %d",
+			transaction.ID, transaction.LockTime, height, medianTime))
+	}
+	if transaction.IsCoinbase() {
+		return nil
+	}
+
+	lock, err := calcSequenceLock(tx, transaction, prev)
+	if err != nil {
+		return err
+	}
+	if lock.MinHeight >= height || lock.MinTime >= medianTime {
+		return ruleError(ErrSequenceLocked, fmt.Sprintf("transaction %x has relative locks until height %d, median time %d, block height %d, median time %d",
+			transaction.ID, lock.MinHeight, lock.MinTime, height, medianTime))
+	}
+	return nil
+}
+
+//根据每个输入的序号计算交易的相对锁定
+//按区块数锁定时 输出所在区块的高度加上锁定的区块数减一
+//按时间锁定时 输出所在区块的父块的过去中位时间加上锁定的秒数减一
+func calcSequenceLock(tx *bolt.Tx, transaction *Transaction, prev *Block) (sequenceLock, error) {
+	lock := sequenceLock{-1, -1}
+	b := tx.Bucket([]byte(utxoBucket))
+	for _, vin := range transaction.Vin {
+		if vin.Sequence&sequenceLockTimeDisabled != 0 {
+			continue
+		}
+		outsBytes := b.Get(vin.Txid)
+		if outsBytes == nil {
+			return lock, ruleError(ErrMissingInput, fmt.Sprintf("transaction %x spends missing output %s", transaction.ID, outpointKey(vin.Txid, vin.Vout)))
+		}
+		outHeight := DeserializeOutputs(outsBytes).Height
+		relative := int64(vin.Sequence & sequenceLockTimeMask)
+
+		if vin.Sequence&sequenceLockTimeIsSeconds == 0 {
+			if minHeight := outHeight + int(relative) - 1; minHeight > lock.MinHeight {
+				lock.MinHeight = minHeight
+			}
+			continue
+		}
+		//沿prev向前找到输出所在区块的父块 创世块的输出使用创世块
+		block := prev
+		for block.Height > outHeight-1 && len(block.PrevHash) != 0 {
+			block = blockFromTx(tx, block.PrevHash)
+		}
+		medianTime := pastMedianTime(block, func(hash []byte) *Block {
+			return blockFromTx(tx, hash)
+		})
+		if minTime := medianTime + relative<<sequenceLockTimeGranularity - 1; minTime > lock.MinTime {
+			lock.MinTime = minTime
+		}
+	}
+	return lock, nil
+}
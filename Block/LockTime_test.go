@@ -0,0 +1,109 @@
+package Block
+
+import (
+	"testing"
+)
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	const height, timestamp = 100, lockTimeThreshold + 1000
+	tests := []struct {
+		name      string
+		lock      int64
+		lockTime  int64
+		sequence  uint32
+		errSubstr string
+	}{
+		{"height one block early", height, height - 1, 0, "lock time 100 is later than transaction lock time 99"},
+		{"height reached", height, height, 0, ""},
+		{"height passed", height, height + 1, 0, ""},
+		{"time one second early", timestamp, timestamp - 1, 0, "is later than transaction lock time"},
+		{"time reached", timestamp, timestamp, 0, ""},
+		{"height against time", height, timestamp, 0, "of different types"},
+		{"time against height", timestamp, height, 0, "of different types"},
+		{"final sequence number", height, height, maxTxInSequenceNum, "final sequence number"},
+		{"negative lock", -1, height, 0, "negative lock time"},
+	}
+	for _, test := range tests {
+		lock := NewScriptBuilder().AddInt64(test.lock).AddOp(OpCheckLockTimeVerify).AddOp(OpDrop).AddOp(Op1).Script()
+		checkScript(t, test.name, testSpendTx(test.lockTime, test.sequence), lock, test.errSubstr)
+	}
+}
+
+func TestCheckSequenceVerify(t *testing.T) {
+	const blocks, seconds = 10, sequenceLockTimeIsSeconds | 10
+	tests := []struct {
+		name      string
+		lock      int64
+		sequence  uint32
+		errSubstr string
+	}{
+		{"one block early", blocks, blocks - 1, "relative lock 10 is longer than input sequence 9"},
+		{"blocks reached", blocks, blocks, ""},
+		{"blocks passed", blocks, blocks + 1, ""},
+		{"one interval early", seconds, seconds - 1, "is longer than input sequence"},
+		{"seconds reached", seconds, seconds, ""},
+		{"blocks against seconds", blocks, seconds, "of different types"},
+		{"seconds against blocks", seconds, blocks, "of different types"},
+		{"relative lock disabled on the input", blocks, sequenceLockTimeDisabled | blocks, "relative lock time disabled"},
+		{"disabled lock is a nop", sequenceLockTimeDisabled, 0, ""},
+	}
+	for _, test := range tests {
+		lock := NewScriptBuilder().AddInt64(test.lock).AddOp(OpCheckSequenceVerify).AddOp(OpDrop).AddOp(Op1).Script()
+		checkScript(t, test.name, testSpendTx(0, test.sequence), lock, test.errSubstr)
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+	const height, timestamp = 100, lockTimeThreshold + 1000
+	tests := []struct {
+		name       string
+		lockTime   int64
+		sequence   uint32
+		height     int
+		medianTime int64
+		final      bool
+	}{
+		{"no lock time", 0, 0, 1, 0, true},
+		{"block at the lock height", height, 0, height, 0, false},
+		{"block after the lock height", height, 0, height + 1, 0, true},
+		{"median time at the lock time", timestamp, 0, 1, timestamp, false},
+		{"median time after the lock time", timestamp, 0, 1, timestamp + 1, true},
+		{"height does not unlock a time lock", timestamp, 0, timestamp + 1, timestamp, false},
+		{"final sequence numbers", height, maxTxInSequenceNum, 1, 0, true},
+	}
+	for _, test := range tests {
+		tx := testSpendTx(test.lockTime, test.sequence)
+		if final := tx.IsFinal(test.height, test.medianTime); final != test.final {
+			t.Errorf("%s: IsFinal returned %v", test.name, final)
+		}
+	}
+}
+
+//相对锁定n个块的输入 在输出所在区块之后第n个块中才能打包
+func TestSequenceLockOnChain(t *testing.T) {
+	bc, wallet, cleanup := newTestChain(t, &PowEngine{})
+	defer cleanup()
+	miner := string(newTestWallet().GetAddress())
+	const blocks = 3
+
+	tx := NewUTXOTransaction(wallet, miner, 1, 1, 0, &UTXOSet{bc})
+	for i := range tx.Vin {
+		tx.Vin[i].Sequence = blocks
+		tx.Vin[i].ScriptSig = nil
+	}
+	tx.SetID()
+	bc.SignTransaction(tx, wallet.PrivateKey)
+
+	//创世块的输出高度为0 高度1和2的区块都太早
+	for height := 1; height < blocks; height++ {
+		if _, err := (UTXOSet{bc}).CheckTransactionInputs(tx, height); !IsErrorCode(err, ErrSequenceLocked) {
+			t.Fatalf("block %d accepted a relative lock of %d blocks: %v", height, blocks, err)
+		}
+		if _, err := mineTestBlock(bc, miner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mineTestBlock(bc, miner, tx); err != nil {
+		t.Fatalf("block %d rejected a relative lock of %d blocks: %v", blocks, blocks, err)
+	}
+}
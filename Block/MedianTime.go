@@ -0,0 +1,146 @@
+package Block
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//计算过去中位时间使用的区块数
+const medianTimeBlocks = 11
+
+//最多记录多少个节点的时间偏移
+const maxMedianTimeEntries = 200
+
+//至少收到这么多个偏移后才调整本地时间
+const minMedianTimeEntries = 5
+
+//偏移的中位数超过这个值时认为本地时钟或者其他节点有问题 不做调整(秒)
+const maxAllowedOffsetSecs = 70 * 60
+
+//同一个IP最多记录多少个节点的时间偏移
+//一台机器上可以运行多个节点 但一个节点不能冒充任意多个节点把网络调整时间推到极限
+const maxTimeSamplesPerIP = 16
+
+//根据其他节点在版本握手中报告的时间计算网络调整时间
+type medianTime struct {
+	mtx     sync.Mutex
+	known   map[string]bool //已经记录过偏移的节点地址
+	perIP   map[string]int  //每个IP记录过的节点数
+	offsets []int64         //每个节点的时间减去本地时间
+	offset  int64           //当前采用的偏移
+}
+
+func newMedianTime() *medianTime {
+	return &medianTime{known: make(map[string]bool), perIP: make(map[string]int)}
+}
+
+var timeSource = newMedianTime()
+
+//网络调整时间 本地时间加上其他节点时间偏移的中位数
+func AdjustedTime() int64 {
+	return timeSource.adjustedTime()
+}
+
+func (m *medianTime) adjustedTime() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return time.Now().Unix() + m.offset
+}
+
+//记录节点在版本消息中报告的时间 每个节点只记录一次
+//节点按它报告的监听地址node区分 node的主机必须就是连接的对端source的IP
+//每条消息使用新的连接 对端端口每次都不同 所以不能按source区分节点
+func AddTimeSample(source net.Addr, node string, timestamp int64) {
+	timeSource.add(source, node, timestamp)
+}
+
+func (m *medianTime) add(source net.Addr, node string, timestamp int64) {
+	ip, ok := sourceIP(source)
+	if !ok || !hostHasIP(node, ip) {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.known[node] || m.perIP[ip.String()] >= maxTimeSamplesPerIP {
+		return
+	}
+	m.known[node] = true
+	m.perIP[ip.String()]++
+
+	if len(m.offsets) == maxMedianTimeEntries {
+		m.offsets = m.offsets[1:]
+	}
+	m.offsets = append(m.offsets, timestamp-time.Now().Unix())
+	if len(m.offsets) < minMedianTimeEntries {
+		return
+	}
+
+	sorted := append([]int64{}, m.offsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+
+	if median > maxAllowedOffsetSecs || median < -maxAllowedOffsetSecs {
+		m.offset = 0
+		return
+	}
+	m.offset = median
+}
+
+//连接对端的IP
+func sourceIP(source net.Addr) (net.IP, bool) {
+	host, _, err := net.SplitHostPort(source.String())
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	return ip, ip != nil
+}
+
+//地址node的主机是否解析为ip 例如localhost:3000和127.0.0.1
+func hostHasIP(node string, ip net.IP) bool {
+	host, _, err := net.SplitHostPort(node)
+	if err != nil {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range ips {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//计算block及其之前共medianTimeBlocks个块时间戳的中位数
+func (bc *BlockChain) CalcPastMedianTime(block *Block) int64 {
+	return pastMedianTime(block, func(hash []byte) *Block {
+		parent, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil
+		}
+		return &parent
+	})
+}
+
+//与CalcPastMedianTime相同 父块由getBlock读取 在数据库事务中计算时使用
+func pastMedianTime(block *Block, getBlock func(hash []byte) *Block) int64 {
+	timestamps := []int64{block.Timestamp}
+	current := block
+	for len(timestamps) < medianTimeBlocks && len(current.PrevHash) != 0 {
+		parent := getBlock(current.PrevHash)
+		if parent == nil {
+			break
+		}
+		timestamps = append(timestamps, parent.Timestamp)
+		current = parent
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
@@ -0,0 +1,47 @@
+package Block
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func localAddr(port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+}
+
+//同一台机器上的多个节点各记录一次 偏移取中位数
+func TestTimeSamplesFromLocalPeers(t *testing.T) {
+	m := newMedianTime()
+	now := time.Now().Unix()
+	offsets := []int64{60, -30, 600, 120, 90}
+	for i, offset := range offsets {
+		node := fmt.Sprintf("localhost:%d", 3000+i)
+		m.add(localAddr(50000+i), node, now+offset)
+		//同一个节点从新的连接再次报告不会被重复记录
+		m.add(localAddr(51000+i), node, now+offset)
+	}
+	if adjusted := m.adjustedTime() - time.Now().Unix(); adjusted < 89 || adjusted > 91 {
+		t.Fatalf("adjusted time is off by %d seconds, expected the median 90", adjusted)
+	}
+}
+
+//报告的地址不在连接的IP上 或者同一个IP冒充太多节点时不记录
+func TestTimeSamplesRejectSpoofedPeers(t *testing.T) {
+	m := newMedianTime()
+	now := time.Now().Unix()
+	for i := 0; i < 5; i++ {
+		m.add(localAddr(50000+i), fmt.Sprintf("10.0.0.%d:3000", i+1), now+3600)
+	}
+	if len(m.offsets) != 0 {
+		t.Fatalf("recorded %d samples from addresses that do not match the connection", len(m.offsets))
+	}
+
+	for i := 0; i < maxTimeSamplesPerIP*2; i++ {
+		m.add(localAddr(50000+i), fmt.Sprintf("127.0.0.1:%d", 3000+i), now+3600)
+	}
+	if len(m.offsets) != maxTimeSamplesPerIP {
+		t.Fatalf("recorded %d samples from one IP, max %d", len(m.offsets), maxTimeSamplesPerIP)
+	}
+}
@@ -0,0 +1,104 @@
+package Block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//交易池 保存等待打包的交易
+var mempool = make(map[string]Transaction)
+var mempoolMtx sync.Mutex
+
+//检查交易后放入交易池
+//交易必须能在下一个块中合法地花费它的输入 也不能与交易池中已有的交易花费同一个输出
+func acceptToMempool(bc *BlockChain, tx *Transaction) error {
+	if tx.IsCoinbase() || tx.IsCoinstake() {
+		return errors.New("coinbase and coinstake transactions cannot be relayed")
+	}
+	if err := CheckTransactionSanity(tx); err != nil {
+		return err
+	}
+	if _, err := (UTXOSet{bc}).CheckTransactionInputs(tx, bc.GetBestHeight()+1); err != nil {
+		return err
+	}
+	if !bc.VerifyTransaction(tx) {
+		return ruleError(ErrBadSignature, fmt.Sprintf("transaction %x has an invalid signature", tx.ID))
+	}
+
+	mempoolMtx.Lock()
+	defer mempoolMtx.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mempool[txID]; ok {
+		return fmt.Errorf("transaction %s is already in the mempool", txID)
+	}
+	for _, pooled := range mempool {
+		for _, pooledIn := range pooled.Vin {
+			for _, vin := range tx.Vin {
+				if pooledIn.Vout == vin.Vout && bytes.Equal(pooledIn.Txid, vin.Txid) {
+					return ruleError(ErrDoubleSpend, fmt.Sprintf("transaction %s spends %s which is already spent by %x in the mempool",
+						txID, outpointKey(vin.Txid, vin.Vout), pooled.ID))
+				}
+			}
+		}
+	}
+	mempool[txID] = *tx
+	return nil
+}
+
+//主链变化后维护交易池
+//已经进入主链的交易 以及和新连接区块花费同一个输出的交易从交易池移除
+//被断开区块中的普通交易重新经过检查后放回交易池 不再有效的交易被丢弃
+func updateMempool(bc *BlockChain, connected, disconnected []*Block) {
+	spent := make(map[string]bool)
+	mempoolMtx.Lock()
+	for _, block := range connected {
+		for _, tx := range block.Transactions {
+			delete(mempool, hex.EncodeToString(tx.ID))
+			if !tx.IsCoinbase() {
+				markSpent(tx, spent)
+			}
+		}
+	}
+	for id, tx := range mempool {
+		if spendsAny(&tx, spent) {
+			delete(mempool, id)
+		}
+	}
+	mempoolMtx.Unlock()
+
+	//disconnected从新到旧 先放回较早区块中的交易
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if !tx.IsCoinbase() && !tx.IsCoinstake() {
+				acceptToMempool(bc, tx)
+			}
+		}
+	}
+}
+
+//把交易花费的输出加入spent
+func markSpent(tx *Transaction, spent map[string]bool) {
+	for _, vin := range tx.Vin {
+		spent[outpointKey(vin.Txid, vin.Vout)] = true
+	}
+}
+
+//交易是否花费了spent中的输出
+func spendsAny(tx *Transaction, spent map[string]bool) bool {
+	for _, vin := range tx.Vin {
+		if spent[outpointKey(vin.Txid, vin.Vout)] {
+			return true
+		}
+	}
+	return false
+}
+
+func mempoolSize() int {
+	mempoolMtx.Lock()
+	defer mempoolMtx.Unlock()
+	return len(mempool)
+}
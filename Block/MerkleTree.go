@@ -18,7 +18,7 @@ func NewMerkleNode(left, right *MerkleNode, Data []byte) *MerkleNode {
 		hash := sha256.Sum256(Data)
 		mNode.Data = hash[:]
 	} else {
-		prevHashs := append(left.Data, right.Data...)
+		prevHashs := append(append([]byte{}, left.Data...), right.Data...)
 		hash := sha256.Sum256(prevHashs)
 		mNode.Data = hash[:]
 	}
@@ -30,17 +30,19 @@ func NewMerkleNode(left, right *MerkleNode, Data []byte) *MerkleNode {
 }
 
 //将数据转成merkle树
+//每一层节点数为奇数时复制最后一个节点 直到只剩根节点
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
-	}
 	for _, datum := range data {
 		node := NewMerkleNode(nil, nil, datum)
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)-2; i++ {
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		var newLevel []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -0,0 +1,113 @@
+package Block
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//挖矿使用的协程数 默认每个CPU核一个
+var miningWorkers = runtime.NumCPU()
+
+//每个协程每计算这么多次哈希检查一次是否取消 并汇报一次统计
+const hashBatchSize = 1 << 12
+
+//内存困难的哈希慢得多 需要更频繁地检查
+const slowHashBatchSize = 1 << 4
+
+//哈希速率的统计周期
+const hashrateInterval = 2 * time.Second
+
+//设置挖矿使用的协程数
+func SetMiningWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	miningWorkers = n
+}
+
+//挖矿的实时统计
+type MiningStats struct {
+	Mining          bool    //当前是否正在挖矿
+	Workers         int     //挖矿协程数
+	TotalHashes     uint64  //启动以来计算的哈希总数
+	HashesPerSecond float64 //最近一个统计周期的哈希速率
+}
+
+type hashStats struct {
+	hashes uint64 //启动以来的哈希总数 原子操作
+
+	mtx     sync.Mutex
+	mining  int
+	workers int
+	rate    float64
+	stop    chan struct{}
+}
+
+var stats = &hashStats{}
+
+//返回当前的挖矿统计
+func GetMiningStats() MiningStats {
+	stats.mtx.Lock()
+	defer stats.mtx.Unlock()
+	return MiningStats{
+		Mining:          stats.mining > 0,
+		Workers:         stats.workers,
+		TotalHashes:     atomic.LoadUint64(&stats.hashes),
+		HashesPerSecond: stats.rate,
+	}
+}
+
+func (s *hashStats) addHashes(n uint64) {
+	atomic.AddUint64(&s.hashes, n)
+}
+
+//开始一次挖矿 第一次开始时启动速率统计
+func (s *hashStats) begin(workers int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.workers = workers
+	s.mining++
+	if s.mining == 1 {
+		s.stop = make(chan struct{})
+		go s.report(s.stop)
+	}
+}
+
+//结束一次挖矿 没有正在进行的挖矿时停止统计
+func (s *hashStats) end() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.mining--
+	if s.mining == 0 {
+		close(s.stop)
+		s.rate = 0
+	}
+}
+
+//定期计算并打印哈希速率
+func (s *hashStats) report(stop chan struct{}) {
+	ticker := time.NewTicker(hashrateInterval)
+	defer ticker.Stop()
+
+	last := atomic.LoadUint64(&s.hashes)
+	lastTime := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			total := atomic.LoadUint64(&s.hashes)
+			rate := float64(total-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = total, now
+
+			s.mtx.Lock()
+			s.rate = rate
+			workers := s.workers
+			s.mtx.Unlock()
+			fmt.Printf("Mining with %d workers: %.0f H/s\n", workers, rate)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package Block
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//孤块池最多保存的块数
+const maxOrphanBlocks = 100
+
+//孤块在池中保留的最长时间
+const orphanExpiration = 20 * time.Minute
+
+//父块还没有收到的区块
+type orphanBlock struct {
+	block      *Block
+	from       string //发送该块的节点
+	expiration time.Time
+}
+
+//孤块池 父块到达后再按顺序把孤块连接到链上
+type orphanPool struct {
+	mtx         sync.Mutex
+	orphans     map[string]*orphanBlock   //孤块hash -> 孤块
+	prevOrphans map[string][]*orphanBlock //父块hash -> 以它为父块的孤块
+}
+
+var orphans = newOrphanPool()
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		orphans:     make(map[string]*orphanBlock),
+		prevOrphans: make(map[string][]*orphanBlock),
+	}
+}
+
+//判断区块是否已经在孤块池中
+func (p *orphanPool) has(hash []byte) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	_, ok := p.orphans[hex.EncodeToString(hash)]
+	return ok
+}
+
+//将孤块加入池中 池满时先清理过期的块 仍然满则淘汰最早过期的块
+func (p *orphanPool) add(block *Block, from string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := p.orphans[hash]; ok {
+		return
+	}
+
+	now := time.Now()
+	for _, orphan := range p.orphans {
+		if now.After(orphan.expiration) {
+			p.remove(orphan)
+		}
+	}
+	if len(p.orphans) >= maxOrphanBlocks {
+		var oldest *orphanBlock
+		for _, orphan := range p.orphans {
+			if oldest == nil || orphan.expiration.Before(oldest.expiration) {
+				oldest = orphan
+			}
+		}
+		p.remove(oldest)
+	}
+
+	orphan := &orphanBlock{block, from, now.Add(orphanExpiration)}
+	p.orphans[hash] = orphan
+	prevHash := hex.EncodeToString(block.PrevHash)
+	p.prevOrphans[prevHash] = append(p.prevOrphans[prevHash], orphan)
+}
+
+//从池中删除孤块 调用者需持有锁
+func (p *orphanPool) remove(orphan *orphanBlock) {
+	delete(p.orphans, hex.EncodeToString(orphan.block.Hash))
+
+	prevHash := hex.EncodeToString(orphan.block.PrevHash)
+	siblings := p.prevOrphans[prevHash]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.prevOrphans, prevHash)
+	} else {
+		p.prevOrphans[prevHash] = siblings
+	}
+}
+
+//取出所有以parentHash为父块的孤块
+func (p *orphanPool) takeChildren(parentHash []byte) []*orphanBlock {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	children := append([]*orphanBlock{}, p.prevOrphans[hex.EncodeToString(parentHash)]...)
+	for _, child := range children {
+		p.remove(child)
+	}
+	return children
+}
+
+//沿着孤块链往前找到最早的孤块 它的父块就是需要向节点请求的块
+func (p *orphanPool) root(hash []byte) *Block {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	orphan := p.orphans[hex.EncodeToString(hash)]
+	if orphan == nil {
+		return nil
+	}
+	for {
+		prev, ok := p.orphans[hex.EncodeToString(orphan.block.PrevHash)]
+		if !ok {
+			return orphan.block
+		}
+		orphan = prev
+	}
+}
+
+//新块加入链之后 依次连接以它为祖先的孤块
+func processOrphans(bc *BlockChain, hash []byte) {
+	queue := [][]byte{hash}
+	for len(queue) > 0 {
+		parentHash := queue[0]
+		queue = queue[1:]
+
+		for _, orphan := range orphans.takeChildren(parentHash) {
+			if err := bc.AddBlock(orphan.block); err != nil {
+				fmt.Printf("Rejected orphan block %x: %s\n", orphan.block.Hash, err)
+				continue
+			}
+			fmt.Printf("Added orphan block %x\n", orphan.block.Hash)
+			queue = append(queue, orphan.block.Hash)
+		}
+	}
+}
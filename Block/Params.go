@@ -0,0 +1,94 @@
+package Block
+
+import "math/big"
+
+//网络参数 共识相关的可调常量都放在这里
+type NetParams struct {
+	PowLimit                 *big.Int //允许的最大目标值 即最低难度
+	PowLimitBits             uint32   //PowLimit的紧凑表示 创世块使用
+	TargetTimePerBlock       int64    //期望的出块间隔(秒)
+	RetargetInterval         int      //每隔多少个块重新计算一次难度
+	RetargetAdjustmentFactor int64    //单次调整允许的最大倍数
+	MaxFutureBlockTime       int64    //区块时间戳最多可以比网络调整时间超前多少秒
+
+	PowHash       string              //新建区块链默认的工作量证明哈希函数
+	PowHashLimits map[string]*big.Int //各哈希函数允许的最大目标值 没有列出的使用PowLimit
+
+	BaseSubsidy            int //创世块开始的出块奖励
+	SubsidyHalvingInterval int //每隔多少个块奖励减半 0表示不减半
+	MaxMoney               int //货币发行总量的上限
+	CoinbaseMaturity       int //coinbase的输出需要多少个块确认后才能花费
+
+	PoaPeriod int64 //PoA中相邻区块的最小时间间隔(秒)
+	PoaEpoch  int   //PoA每隔多少个块设置一个检查点 清空投票并记录全部签名者
+
+	PosLimit    *big.Int //PoS允许的最大目标值
+	PosSlotTime int64    //PoS出块时间槽的长度(秒) 时间戳必须是它的整数倍
+	StakeMinAge int64    //输出至少存在多少秒后才能质押
+	StakeMaxAge int64    //币龄最多按多少秒计算
+
+	PbftRequestTimeout int64 //PBFT等待区块提交的时间(秒) 超时后切换视图 每次切换后加倍
+
+	RaftTickInterval   int64 //Raft逻辑时钟的间隔(毫秒) 领导者每个间隔打包一次交易池
+	RaftSnapshotBlocks int   //Raft每应用多少个区块生成一次快照并压缩日志
+
+	RuleChangeActivationThreshold int                            //一个确认窗口中至少多少个块发出信号 部署才能锁定
+	Deployments                   [definedDeployments]Deployment //软分叉部署 确认窗口等于RetargetInterval
+
+	Checkpoints []Checkpoint //检查点 按高度从低到高排列
+	AssumeValid []byte       //假定有效的区块hash 它和它的祖先不检查交易签名 为空时检查全部签名
+}
+
+var bigOne = big.NewInt(1)
+
+//测试网络的最低难度 2^244-1
+var testNetPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 244), bigOne)
+
+//测试网络上内存困难哈希函数的最低难度 2^250-1
+var testNetSlowPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 250), bigOne)
+
+var defaultNetParams = NetParams{
+	PowLimit:                 testNetPowLimit,
+	PowLimitBits:             BigToCompact(testNetPowLimit),
+	TargetTimePerBlock:       10,
+	RetargetInterval:         20,
+	RetargetAdjustmentFactor: 4,
+	MaxFutureBlockTime:       2 * 60 * 60,
+
+	PowHash: "sha256d",
+	//scrypt和argon2每次哈希需要大约一毫秒 最低难度降低64倍
+	PowHashLimits: map[string]*big.Int{
+		"scrypt": testNetSlowPowLimit,
+		"argon2": testNetSlowPowLimit,
+	},
+
+	BaseSubsidy:            10,
+	SubsidyHalvingInterval: 210,
+	MaxMoney:               3780, //等于按减半计划发行的总量
+	CoinbaseMaturity:       10,
+
+	PoaPeriod: 5,
+	PoaEpoch:  100,
+
+	PosLimit:    testNetPowLimit,
+	PosSlotTime: 2,
+	StakeMinAge: 60,
+	StakeMaxAge: 7 * 24 * 60 * 60,
+
+	PbftRequestTimeout: 10,
+
+	RaftTickInterval:   50,
+	RaftSnapshotBlocks: 100,
+
+	RuleChangeActivationThreshold: 15, //20个块中的75%
+	Deployments: [definedDeployments]Deployment{
+		DeploymentTestDummy: {Name: "testdummy", Bit: 28, StartTime: 0, Timeout: noDeploymentTimeout},
+	},
+
+	//测试网络的创世块在创建区块链时才生成 没有预置的检查点和假定有效区块
+	Checkpoints: nil,
+	AssumeValid: nil,
+}
+
+//当前使用的网络参数
+var netParams = &defaultNetParams
@@ -0,0 +1,383 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+var errPbftNoKey = errors.New("No validator key, cannot take part in PBFT")
+
+//PBFT中验证者之间传递的消息的阶段
+const (
+	pbftPrePrepare = "preprepare"
+	pbftPrepare    = "prepare"
+	pbftCommit     = "commit"
+	pbftViewChange = "viewchange"
+	pbftNewView    = "newview"
+)
+
+//PBFT区块头Extra中保存的数据
+type pbftExtra struct {
+	Validators [][]byte //创世块记录的全部验证者(公钥哈希)
+	View       int      //提议区块时的视图
+	PubKey     []byte   //提议者(主节点)的公钥
+	Signature  []byte   //提议者对区块头(不含签名)的签名
+}
+
+func (e *pbftExtra) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+func decodePbftExtra(header *BlockHeader) (*pbftExtra, error) {
+	var extra pbftExtra
+	decoder := gob.NewDecoder(bytes.NewReader(header.Extra))
+	if err := decoder.Decode(&extra); err != nil {
+		return nil, ruleError(ErrBadSeal, fmt.Sprintf("block %x has malformed PBFT extra data", header.BlockHash()))
+	}
+	return &extra, nil
+}
+
+//签名的内容 即去掉签名之后的区块头
+func pbftSealHash(header *BlockHeader, extra *pbftExtra) []byte {
+	unsigned := *extra
+	unsigned.Signature = nil
+	h := *header
+	h.Extra = unsigned.Serialize()
+	return h.BlockHash()
+}
+
+//PBFT中验证者之间传递的签名消息 提交阶段的消息同时作为区块的提交证明
+type PbftMessage struct {
+	Phase     string   //消息所处的阶段
+	Height    int      //正在达成共识的区块高度
+	View      int      //视图 决定由哪个验证者提议区块
+	Hash      []byte   //区块hash
+	Block     []byte   //preprepare和newview中提议的区块 viewchange中已经prepared的区块
+	Proof     [][]byte //viewchange中的prepared证明 newview中的viewchange消息
+	PubKey    []byte   //发送者的公钥
+	Signature []byte   //发送者对消息(不含签名)的签名
+}
+
+func (m *PbftMessage) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(m)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+func DeserializePbftMessage(data []byte) (*PbftMessage, error) {
+	var msg PbftMessage
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+//签名的内容 即去掉签名之后的消息
+func (m *PbftMessage) signHash() []byte {
+	unsigned := *m
+	unsigned.Signature = nil
+	hash := sha256.Sum256(unsigned.Serialize())
+	return hash[:]
+}
+
+//实用拜占庭容错共识 固定的3f+1个验证者轮流作为主节点提议区块
+//2f+1个验证者提交的区块带有提交证明 加入主链后即为最终确定 不会被链重组回滚
+type PbftEngine struct {
+	genesisValidators [][]byte //创世块中记录的验证者
+
+	mtx        sync.Mutex
+	key        *ecdsa.PrivateKey //签名使用的私钥
+	pubKey     []byte            //签名使用的公钥
+	view       int               //本节点当前的视图 提议区块时写入区块头
+	validators []string          //排序后的验证者 从创世块读取后缓存
+}
+
+func (e *PbftEngine) Name() string {
+	return "pbft"
+}
+
+//设置创世块中的验证者(公钥哈希) 只在创建区块链时使用
+func (e *PbftEngine) SetGenesisSigners(signers [][]byte) {
+	e.genesisValidators = signers
+}
+
+//设置签名使用的私钥 公钥哈希必须在验证者列表中才能参与共识
+func (e *PbftEngine) Authorize(key ecdsa.PrivateKey) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.key = &key
+	e.pubKey = append(key.PublicKey.X.Bytes(), key.PublicKey.Y.Bytes()...)
+}
+
+func (e *PbftEngine) setView(view int) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.view = view
+}
+
+//本节点的公钥哈希 没有设置私钥时为空
+func (e *PbftEngine) self() string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.key == nil {
+		return ""
+	}
+	return hex.EncodeToString(HashPubKey(e.pubKey))
+}
+
+//用本节点的私钥签名消息
+func (e *PbftEngine) signMessage(msg *PbftMessage) error {
+	e.mtx.Lock()
+	key := e.key
+	msg.PubKey = e.pubKey
+	e.mtx.Unlock()
+	if key == nil {
+		return errPbftNoKey
+	}
+	signature, err := signHash(*key, msg.signHash())
+	if err != nil {
+		return err
+	}
+	msg.Signature = signature
+	return nil
+}
+
+//排序后的全部验证者 hash为链上任意一个区块
+//验证者集合固定不变 第一次使用时从创世块读取
+func (e *PbftEngine) validatorList(chain consensus.ChainReader, hash []byte) ([]string, error) {
+	e.mtx.Lock()
+	validators := e.validators
+	e.mtx.Unlock()
+	if validators != nil {
+		return validators, nil
+	}
+
+	header, err := chain.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	for len(header.PrevHash) != 0 {
+		if header, err = chain.GetHeader(header.PrevHash); err != nil {
+			return nil, err
+		}
+	}
+	extra, err := decodePbftExtra(header)
+	if err != nil {
+		return nil, err
+	}
+	for _, validator := range extra.Validators {
+		validators = append(validators, hex.EncodeToString(validator))
+	}
+	sort.Strings(validators)
+
+	e.mtx.Lock()
+	e.validators = validators
+	e.mtx.Unlock()
+	return validators, nil
+}
+
+//最多容忍f个拜占庭验证者
+func pbftFaulty(validators []string) int {
+	return (len(validators) - 1) / 3
+}
+
+//达成一致需要的验证者数量 任意两个法定人数中至少有一个诚实的验证者
+func pbftQuorum(validators []string) int {
+	return len(validators) - pbftFaulty(validators)
+}
+
+//高度为height的区块在视图view中的主节点
+func pbftPrimary(validators []string, height, view int) string {
+	return validators[(height+view)%len(validators)]
+}
+
+func isValidator(validators []string, signer string) bool {
+	i := sort.SearchStrings(validators, signer)
+	return i < len(validators) && validators[i] == signer
+}
+
+//检查消息的签名和发送者 返回发送者的公钥哈希
+func (e *PbftEngine) checkMessage(validators []string, msg *PbftMessage) (string, error) {
+	if !verifyHashSignature(msg.PubKey, msg.Signature, msg.signHash()) {
+		return "", ruleError(ErrBadCommit, fmt.Sprintf("PBFT %s message for height %d has an invalid signature", msg.Phase, msg.Height))
+	}
+	signer := hex.EncodeToString(HashPubKey(msg.PubKey))
+	if !isValidator(validators, signer) {
+		return "", ruleError(ErrUnauthorizedSigner, fmt.Sprintf("PBFT %s message for height %d is signed by non-validator %s", msg.Phase, msg.Height, signer))
+	}
+	return signer, nil
+}
+
+//检查一组消息是否构成法定人数的证明
+//所有消息必须处于同一阶段 同一高度 同一视图并且针对同一个区块 来自不同的验证者 返回它们的视图
+func (e *PbftEngine) checkQuorum(validators []string, msgs []*PbftMessage, phase string, height int, hash []byte) (int, error) {
+	signers := make(map[string]bool)
+	view := -1
+	for _, msg := range msgs {
+		if msg.Phase != phase || msg.Height != height || !bytes.Equal(msg.Hash, hash) {
+			return 0, ruleError(ErrBadCommit, fmt.Sprintf("PBFT %s proof for block %x contains an unrelated message", phase, hash))
+		}
+		if view >= 0 && msg.View != view {
+			return 0, ruleError(ErrBadCommit, fmt.Sprintf("PBFT %s proof for block %x mixes views", phase, hash))
+		}
+		view = msg.View
+		signer, err := e.checkMessage(validators, msg)
+		if err != nil {
+			return 0, err
+		}
+		signers[signer] = true
+	}
+	if len(signers) < pbftQuorum(validators) {
+		return 0, ruleError(ErrBadCommit, fmt.Sprintf("PBFT %s proof for block %x has %d validators, needs %d", phase, hash, len(signers), pbftQuorum(validators)))
+	}
+	return view, nil
+}
+
+//填写难度和视图 所有区块的难度都是1 主链就是最长的链
+func (e *PbftEngine) Prepare(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	header.Nonce = 0
+	header.Bits = 1
+	if height == 0 {
+		header.Extra = (&pbftExtra{Validators: e.genesisValidators}).Serialize()
+		return nil
+	}
+	e.mtx.Lock()
+	header.Extra = (&pbftExtra{View: e.view, PubKey: e.pubKey}).Serialize()
+	e.mtx.Unlock()
+	return nil
+}
+
+//主节点用私钥签名提议的区块
+func (e *PbftEngine) Seal(ctx context.Context, chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块不需要签名
+	if height == 0 {
+		return nil
+	}
+	e.mtx.Lock()
+	key := e.key
+	e.mtx.Unlock()
+	if key == nil {
+		return errPbftNoKey
+	}
+	extra, err := decodePbftExtra(header)
+	if err != nil {
+		return err
+	}
+	signature, err := signHash(*key, pbftSealHash(header, extra))
+	if err != nil {
+		return err
+	}
+	extra.Signature = signature
+	header.Extra = extra.Serialize()
+	return nil
+}
+
+//检查难度和验证者列表
+func (e *PbftEngine) VerifyHeader(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	extra, err := decodePbftExtra(header)
+	if err != nil {
+		return err
+	}
+	if header.Bits != 1 {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has PBFT difficulty %d", header.BlockHash(), header.Bits))
+	}
+	if height > 0 && len(extra.Validators) > 0 {
+		return ruleError(ErrBadVote, fmt.Sprintf("block %x changes the fixed PBFT validator set", header.BlockHash()))
+	}
+	return nil
+}
+
+//检查区块是否由区块头中视图的主节点提议
+func (e *PbftEngine) VerifySeal(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块没有签名
+	if height == 0 {
+		return nil
+	}
+	extra, err := decodePbftExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, pbftSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	validators, err := e.validatorList(chain, header.PrevHash)
+	if err != nil {
+		return err
+	}
+	if extra.View < 0 {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has negative view %d", header.BlockHash(), extra.View))
+	}
+	proposer := hex.EncodeToString(HashPubKey(extra.PubKey))
+	if primary := pbftPrimary(validators, height, extra.View); proposer != primary {
+		return ruleError(ErrUnauthorizedSigner, fmt.Sprintf("block %x is proposed by %s, the primary of view %d is %s", header.BlockHash(), proposer, extra.View, primary))
+	}
+	return nil
+}
+
+//孤块的父块未知 只能检查区块头中的签名
+func (e *PbftEngine) verifyOrphanSeal(header *BlockHeader) error {
+	extra, err := decodePbftExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, pbftSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	return nil
+}
+
+func (e *PbftEngine) CalcWork(chain consensus.ChainReader, header *BlockHeader, height int) *big.Int {
+	return big.NewInt(1)
+}
+
+//PBFT不改变区块内容 提交证明在区块提交之后才加入
+func (e *PbftEngine) finalizeBlock(ctx context.Context, bc *BlockChain, block *Block) error {
+	return nil
+}
+
+//除创世块之外的区块必须带有2f+1个验证者的提交证明
+func (e *PbftEngine) verifyBody(bc *BlockChain, block *Block) error {
+	if len(block.Evidence) > 0 {
+		return ruleError(ErrBadEvidence, fmt.Sprintf("block %x contains evidence its consensus does not use", block.Hash))
+	}
+	if block.Height == 0 {
+		return nil
+	}
+	validators, err := e.validatorList(bc, block.PrevHash)
+	if err != nil {
+		return err
+	}
+	var commits []*PbftMessage
+	for i := range block.Commits {
+		commits = append(commits, &block.Commits[i])
+	}
+	_, err = e.checkQuorum(validators, commits, pbftCommit, block.Height, block.Hash)
+	return err
+}
+
+//通过验证的区块都带有提交证明 一定是最终确定的
+func (e *PbftEngine) isFinal(block *Block) bool {
+	return block.Height == 0 || len(block.Commits) > 0
+}
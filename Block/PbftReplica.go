@@ -0,0 +1,522 @@
+package Block
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//视图切换的等待时间最多加倍的次数
+const pbftMaxBackoff = 5
+
+//PBFT中一个高度上的共识状态 区块提交后进入下一个高度
+type pbftRound struct {
+	height   int
+	parent   []byte //父块hash 即提交时的主链链尾
+	view     int
+	changing bool //已经发出切换到view的请求 还没有收到新视图
+	proposed bool //本节点作为主节点已经在view中提议过
+
+	proposal   *Block                             //view中接受的提议
+	prepares   map[string]map[string]*PbftMessage //区块hash->验证者->prepare消息
+	commits    map[string]map[string]*PbftMessage //区块hash->验证者->commit消息
+	committing bool                               //已经对proposal发出commit
+
+	prepared      *Block   //最近一次prepared的区块 视图切换时交给新的主节点
+	preparedProof [][]byte //prepared的证明 即2f+1个prepare消息
+
+	viewChanges map[int]map[string]*PbftMessage //视图->验证者->viewchange消息
+
+	timer    *time.Timer
+	timeouts int //已经超时的次数 每次超时后等待时间加倍
+}
+
+func newPbftRound(height int, parent []byte) *pbftRound {
+	return &pbftRound{
+		height:      height,
+		parent:      parent,
+		prepares:    make(map[string]map[string]*PbftMessage),
+		commits:     make(map[string]map[string]*PbftMessage),
+		viewChanges: make(map[int]map[string]*PbftMessage),
+	}
+}
+
+//PBFT副本 验证者节点通过它参与三阶段提交和视图切换
+//消息通过broadcast发送给其他节点 区块提交后通过committed通知
+type pbftReplica struct {
+	mtx       sync.Mutex
+	bc        *BlockChain
+	engine    *PbftEngine
+	round     *pbftRound
+	broadcast func(msg *PbftMessage)
+	committed func(block *Block)
+}
+
+func newPbftReplica(bc *BlockChain, engine *PbftEngine, broadcast func(msg *PbftMessage), committed func(block *Block)) *pbftReplica {
+	return &pbftReplica{bc: bc, engine: engine, broadcast: broadcast, committed: committed}
+}
+
+//主链链尾变化后开始下一个高度的共识
+func (r *pbftReplica) syncRound() {
+	tip, err := r.bc.GetBlock(r.bc.TipHash())
+	if err != nil || (r.round != nil && bytes.Equal(r.round.parent, tip.Hash)) {
+		return
+	}
+	if r.round != nil && r.round.timer != nil {
+		r.round.timer.Stop()
+	}
+	r.round = newPbftRound(tip.Height+1, tip.Hash)
+	r.engine.setView(0)
+}
+
+//交易池中有交易等待打包 主节点提议区块 其他验证者开始计时
+func (r *pbftReplica) requestReceived() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.syncRound()
+	if mempoolSize() > 0 && r.round.timer == nil {
+		r.armTimer()
+	}
+	r.tryPropose()
+}
+
+//等待当前视图的区块提交 超时后请求切换到下一个视图
+func (r *pbftReplica) armTimer() {
+	round := r.round
+	if round.timer != nil {
+		round.timer.Stop()
+	}
+	backoff := round.timeouts
+	if backoff > pbftMaxBackoff {
+		backoff = pbftMaxBackoff
+	}
+	timeout := time.Duration(netParams.PbftRequestTimeout) * time.Second << uint(backoff)
+	view := round.view
+	round.timer = time.AfterFunc(timeout, func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		if r.round != round || round.view != view {
+			return
+		}
+		fmt.Printf("PBFT view %d at height %d timed out\n", view, round.height)
+		round.timeouts++
+		r.startViewChange(view + 1)
+	})
+}
+
+//签名并广播本节点的消息 然后像收到其他节点的消息一样处理
+func (r *pbftReplica) send(msg *PbftMessage) {
+	if err := r.engine.signMessage(msg); err != nil {
+		return
+	}
+	r.broadcast(msg)
+	r.handleLocked(msg)
+}
+
+//处理收到的PBFT消息
+func (r *pbftReplica) handle(msg *PbftMessage) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handleLocked(msg)
+}
+
+func (r *pbftReplica) handleLocked(msg *PbftMessage) {
+	r.syncRound()
+	if msg.Height != r.round.height {
+		return
+	}
+	validators, err := r.engine.validatorList(r.bc, r.round.parent)
+	if err != nil {
+		return
+	}
+	signer, err := r.engine.checkMessage(validators, msg)
+	if err != nil {
+		fmt.Printf("Rejected PBFT %s message: %s\n", msg.Phase, err)
+		return
+	}
+
+	switch msg.Phase {
+	case pbftPrePrepare:
+		r.onPrePrepare(validators, msg, signer)
+	case pbftPrepare, pbftCommit:
+		r.onVote(validators, msg, signer)
+	case pbftViewChange:
+		r.onViewChange(validators, msg, signer)
+	case pbftNewView:
+		r.onNewView(validators, msg, signer)
+	}
+}
+
+//当前视图的主节点在还没有提议时 把交易池中的交易打包成区块并提议
+func (r *pbftReplica) tryPropose() {
+	round := r.round
+	validators, err := r.engine.validatorList(r.bc, round.parent)
+	if err != nil || round.changing || round.proposed || round.proposal != nil || mempoolSize() == 0 {
+		return
+	}
+	if pbftPrimary(validators, round.height, round.view) != r.engine.self() {
+		return
+	}
+	block, err := r.newProposal()
+	if err != nil {
+		fmt.Printf("PBFT proposal failed: %s\n", err)
+		return
+	}
+	round.proposed = true
+	fmt.Printf("Proposing block %x at height %d in view %d\n", block.Hash, round.height, round.view)
+	r.send(&PbftMessage{Phase: pbftPrePrepare, Height: round.height, View: round.view, Hash: block.Hash, Block: block.Serialize()})
+}
+
+//在父块上打包交易池中的交易 区块头中记录当前视图
+func (r *pbftReplica) newProposal() (*Block, error) {
+	round := r.round
+	parent, err := r.bc.GetBlock(round.parent)
+	if err != nil {
+		return nil, err
+	}
+	txs, fees := selectMempoolTransactions(r.bc)
+	cbTx := NewCoinbaseTX(miningAddress, "", round.height, fees)
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	timestamp := AdjustedTime()
+	if medianTime := r.bc.CalcPastMedianTime(&parent); timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+	r.engine.setView(round.view)
+	return r.bc.MineNewBlock(context.Background(), txs, round.parent, round.height, timestamp)
+}
+
+//检查提议的区块 除了提交证明之外必须能够加入主链
+func (r *pbftReplica) checkProposal(block *Block) error {
+	if block.Height != r.round.height || !bytes.Equal(block.PrevHash, r.round.parent) {
+		return fmt.Errorf("proposal %x does not extend the chain tip", block.Hash)
+	}
+	parent, err := r.bc.checkBlockHeader(block)
+	if err != nil {
+		return err
+	}
+	if err := r.bc.checkBlockContext(block, parent); err != nil {
+		return err
+	}
+	return UTXOSet{r.bc}.checkConnectBlock(block)
+}
+
+//接受当前视图的提议并发出prepare
+func (r *pbftReplica) acceptProposal(block *Block) {
+	round := r.round
+	round.proposal = block
+	r.armTimer()
+	r.send(&PbftMessage{Phase: pbftPrepare, Height: round.height, View: round.view, Hash: block.Hash})
+	r.checkPrepared()
+}
+
+func (r *pbftReplica) onPrePrepare(validators []string, msg *PbftMessage, signer string) {
+	round := r.round
+	if msg.View != round.view || round.changing || round.proposal != nil {
+		return
+	}
+	if signer != pbftPrimary(validators, round.height, round.view) {
+		fmt.Printf("Rejected PBFT proposal from %s, not the primary of view %d\n", signer, round.view)
+		return
+	}
+	block, err := DecodeBlock(msg.Block)
+	if err != nil {
+		fmt.Printf("Rejected PBFT proposal from %s: malformed block\n", signer)
+		return
+	}
+	extra, err := decodePbftExtra(&block.BlockHeader)
+	if err == nil && (extra.View != msg.View || !bytes.Equal(block.Hash, msg.Hash)) {
+		err = fmt.Errorf("proposal %x does not match its pre-prepare message", block.Hash)
+	}
+	if err == nil {
+		err = r.checkProposal(block)
+	}
+	if err != nil {
+		fmt.Printf("Rejected PBFT proposal %x: %s\n", block.Hash, err)
+		return
+	}
+	r.acceptProposal(block)
+}
+
+//记录prepare和commit 达到法定人数后进入下一阶段
+func (r *pbftReplica) onVote(validators []string, msg *PbftMessage, signer string) {
+	round := r.round
+	if msg.View != round.view {
+		return
+	}
+	votes := round.prepares
+	if msg.Phase == pbftCommit {
+		votes = round.commits
+	}
+	hash := hex.EncodeToString(msg.Hash)
+	if votes[hash] == nil {
+		votes[hash] = make(map[string]*PbftMessage)
+	}
+	votes[hash][signer] = msg
+
+	if msg.Phase == pbftPrepare {
+		r.checkPrepared()
+	} else {
+		r.checkCommitted()
+	}
+}
+
+//2f+1个验证者prepare了同一个提议后 提议在这个视图中prepared 发出commit
+func (r *pbftReplica) checkPrepared() {
+	round := r.round
+	if round.proposal == nil || round.committing {
+		return
+	}
+	validators, err := r.engine.validatorList(r.bc, round.parent)
+	if err != nil {
+		return
+	}
+	prepares := round.prepares[hex.EncodeToString(round.proposal.Hash)]
+	if len(prepares) < pbftQuorum(validators) {
+		return
+	}
+	round.committing = true
+	round.prepared = round.proposal
+	round.preparedProof = nil
+	for _, prepare := range prepares {
+		round.preparedProof = append(round.preparedProof, prepare.Serialize())
+	}
+	r.send(&PbftMessage{Phase: pbftCommit, Height: round.height, View: round.view, Hash: round.proposal.Hash})
+	r.checkCommitted()
+}
+
+//2f+1个验证者commit了同一个提议后 把提交证明加入区块并写入主链
+func (r *pbftReplica) checkCommitted() {
+	round := r.round
+	if round.proposal == nil || !round.committing {
+		return
+	}
+	validators, err := r.engine.validatorList(r.bc, round.parent)
+	if err != nil {
+		return
+	}
+	commits := round.commits[hex.EncodeToString(round.proposal.Hash)]
+	if len(commits) < pbftQuorum(validators) {
+		return
+	}
+	block := *round.proposal
+	block.Commits = nil
+	for _, commit := range commits {
+		block.Commits = append(block.Commits, *commit)
+	}
+	err = r.bc.AddBlock(&block)
+	if err != nil && !IsErrorCode(err, ErrDuplicateBlock) {
+		fmt.Printf("Committed block %x cannot be added: %s\n", block.Hash, err)
+		return
+	}
+	if round.timer != nil {
+		round.timer.Stop()
+	}
+	fmt.Printf("Committed block %x at height %d in view %d\n", block.Hash, block.Height, round.view)
+	r.committed(&block)
+
+	r.syncRound()
+	if mempoolSize() > 0 {
+		r.armTimer()
+	}
+	r.tryPropose()
+}
+
+//放弃当前视图 把已经prepared的区块交给下一个视图的主节点
+func (r *pbftReplica) startViewChange(view int) {
+	round := r.round
+	if view <= round.view {
+		return
+	}
+	round.view = view
+	round.changing = true
+	round.proposed = false
+	round.proposal = nil
+	round.committing = false
+	round.prepares = make(map[string]map[string]*PbftMessage)
+	round.commits = make(map[string]map[string]*PbftMessage)
+	r.engine.setView(view)
+	r.armTimer()
+
+	fmt.Printf("Requesting PBFT view %d at height %d\n", view, round.height)
+	msg := &PbftMessage{Phase: pbftViewChange, Height: round.height, View: view}
+	if round.prepared != nil {
+		msg.Hash = round.prepared.Hash
+		msg.Block = round.prepared.Serialize()
+		msg.Proof = round.preparedProof
+	}
+	r.send(msg)
+}
+
+//检查viewchange中的prepared证明 返回prepared的区块和它所在的视图 没有prepared的区块时返回nil
+func (r *pbftReplica) checkViewChange(validators []string, msg *PbftMessage) (*Block, int, error) {
+	if len(msg.Block) == 0 {
+		return nil, -1, nil
+	}
+	block, err := DecodeBlock(msg.Block)
+	if err != nil {
+		return nil, 0, fmt.Errorf("view change carries a malformed block: %s", err)
+	}
+	if !bytes.Equal(block.Hash, msg.Hash) || !bytes.Equal(block.Hash, block.BlockHash()) {
+		return nil, 0, fmt.Errorf("view change carries a mismatching block %x", block.Hash)
+	}
+	var prepares []*PbftMessage
+	for _, data := range msg.Proof {
+		prepare, err := DeserializePbftMessage(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		prepares = append(prepares, prepare)
+	}
+	view, err := r.engine.checkQuorum(validators, prepares, pbftPrepare, msg.Height, block.Hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if view >= msg.View {
+		return nil, 0, fmt.Errorf("view change to %d carries a block prepared in view %d", msg.View, view)
+	}
+	return block, view, nil
+}
+
+func (r *pbftReplica) onViewChange(validators []string, msg *PbftMessage, signer string) {
+	round := r.round
+	if msg.View < round.view {
+		return
+	}
+	if _, _, err := r.checkViewChange(validators, msg); err != nil {
+		fmt.Printf("Rejected PBFT view change from %s: %s\n", signer, err)
+		return
+	}
+	if round.viewChanges[msg.View] == nil {
+		round.viewChanges[msg.View] = make(map[string]*PbftMessage)
+	}
+	round.viewChanges[msg.View][signer] = msg
+
+	//f+1个验证者请求切换到更高的视图时 至少有一个诚实的验证者超时了 本节点也加入
+	join := -1
+	for view, changes := range round.viewChanges {
+		if view > round.view && len(changes) > pbftFaulty(validators) && (join < 0 || view < join) {
+			join = view
+		}
+	}
+	if join >= 0 {
+		r.startViewChange(join)
+	}
+
+	//新视图的主节点收到2f+1个viewchange后发出新视图
+	view := round.view
+	changes := round.viewChanges[view]
+	if !round.changing || round.proposed || len(changes) < pbftQuorum(validators) {
+		return
+	}
+	if pbftPrimary(validators, round.height, view) != r.engine.self() {
+		return
+	}
+	msg = &PbftMessage{Phase: pbftNewView, Height: round.height, View: view}
+	for _, change := range changes {
+		msg.Proof = append(msg.Proof, change.Serialize())
+	}
+	//必须重新提议在之前视图中可能已经提交的区块
+	block, _, err := r.highestPrepared(validators, changes)
+	if err == nil && block == nil {
+		block, err = r.newProposal()
+	}
+	if err != nil {
+		fmt.Printf("PBFT new view failed: %s\n", err)
+		return
+	}
+	round.proposed = true
+	msg.Hash = block.Hash
+	msg.Block = block.Serialize()
+	fmt.Printf("Starting PBFT view %d at height %d with block %x\n", view, round.height, block.Hash)
+	r.send(msg)
+}
+
+//viewchange消息中在最高视图prepared的区块
+func (r *pbftReplica) highestPrepared(validators []string, changes map[string]*PbftMessage) (*Block, int, error) {
+	var highest *Block
+	highestView := -1
+	for _, change := range changes {
+		block, view, err := r.checkViewChange(validators, change)
+		if err != nil {
+			return nil, 0, err
+		}
+		if block != nil && view > highestView {
+			highest = block
+			highestView = view
+		}
+	}
+	return highest, highestView, nil
+}
+
+//检查新视图中的2f+1个viewchange 提议必须是其中最高视图prepared的区块 没有时由新的主节点重新打包
+func (r *pbftReplica) onNewView(validators []string, msg *PbftMessage, signer string) {
+	round := r.round
+	if msg.View < round.view || (msg.View == round.view && !round.changing) {
+		return
+	}
+	if signer != pbftPrimary(validators, round.height, msg.View) {
+		fmt.Printf("Rejected PBFT new view from %s, not the primary of view %d\n", signer, msg.View)
+		return
+	}
+
+	changes := make(map[string]*PbftMessage)
+	for _, data := range msg.Proof {
+		change, err := DeserializePbftMessage(data)
+		if err != nil || change.Phase != pbftViewChange || change.Height != msg.Height || change.View != msg.View {
+			fmt.Printf("Rejected PBFT new view %d: malformed view change\n", msg.View)
+			return
+		}
+		changeSigner, err := r.engine.checkMessage(validators, change)
+		if err != nil {
+			fmt.Printf("Rejected PBFT new view %d: %s\n", msg.View, err)
+			return
+		}
+		changes[changeSigner] = change
+	}
+	if len(changes) < pbftQuorum(validators) {
+		fmt.Printf("Rejected PBFT new view %d: only %d view changes\n", msg.View, len(changes))
+		return
+	}
+	prepared, _, err := r.highestPrepared(validators, changes)
+	if err != nil {
+		fmt.Printf("Rejected PBFT new view %d: %s\n", msg.View, err)
+		return
+	}
+
+	block, err := DecodeBlock(msg.Block)
+	if err != nil {
+		fmt.Printf("Rejected PBFT new view %d: malformed block\n", msg.View)
+		return
+	}
+	if prepared != nil && !bytes.Equal(prepared.Hash, block.Hash) {
+		fmt.Printf("Rejected PBFT new view %d: it does not re-propose prepared block %x\n", msg.View, prepared.Hash)
+		return
+	}
+	if prepared == nil {
+		extra, err := decodePbftExtra(&block.BlockHeader)
+		if err != nil || extra.View != msg.View {
+			fmt.Printf("Rejected PBFT new view %d: proposal %x is not from this view\n", msg.View, block.Hash)
+			return
+		}
+	}
+	if err := r.checkProposal(block); err != nil {
+		fmt.Printf("Rejected PBFT new view %d: %s\n", msg.View, err)
+		return
+	}
+
+	if msg.View != round.view {
+		round.prepares = make(map[string]map[string]*PbftMessage)
+		round.commits = make(map[string]map[string]*PbftMessage)
+		round.committing = false
+	}
+	round.view = msg.View
+	round.changing = false
+	round.proposed = true
+	r.engine.setView(msg.View)
+	fmt.Printf("Entered PBFT view %d at height %d\n", msg.View, round.height)
+	r.acceptProposal(block)
+}
@@ -0,0 +1,342 @@
+package Block
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//进程内的网络 把副本广播的消息复制后交给其他副本
+//宕机的副本收发的消息全部丢失 drop返回true的消息也会丢失
+type pbftTestNetwork struct {
+	mtx      sync.Mutex
+	replicas map[string]*pbftReplica
+	down     map[string]bool
+	drop     func(msg *PbftMessage) bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func (n *pbftTestNetwork) broadcast(from string) func(msg *PbftMessage) {
+	return func(msg *PbftMessage) {
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+		if n.closed || n.down[from] || (n.drop != nil && n.drop(msg)) {
+			return
+		}
+		for to, r := range n.replicas {
+			if to == from || n.down[to] {
+				continue
+			}
+			copied, err := DeserializePbftMessage(msg.Serialize())
+			if err != nil {
+				panic(err)
+			}
+			n.wg.Add(1)
+			go func(r *pbftReplica) {
+				defer n.wg.Done()
+				r.handle(copied)
+			}(r)
+		}
+	}
+}
+
+//4个验证者的集群 每个验证者有自己的数据库 创世块相同
+type pbftTestCluster struct {
+	t          *testing.T
+	files      []string
+	validators []string
+	network    *pbftTestNetwork
+	engines    map[string]*PbftEngine
+	chains     map[string]*BlockChain
+
+	mtx       sync.Mutex
+	committed map[string]*Block
+
+	oldTimeout    int64
+	oldMiningAddr string
+}
+
+func newPbftTestCluster(t *testing.T, timeout int64) *pbftTestCluster {
+	c := &pbftTestCluster{
+		t:             t,
+		network:       &pbftTestNetwork{replicas: make(map[string]*pbftReplica), down: make(map[string]bool)},
+		engines:       make(map[string]*PbftEngine),
+		chains:        make(map[string]*BlockChain),
+		committed:     make(map[string]*Block),
+		oldTimeout:    netParams.PbftRequestTimeout,
+		oldMiningAddr: miningAddress,
+	}
+	netParams.PbftRequestTimeout = timeout
+
+	var wallets []*Wallet
+	var signers [][]byte
+	for i := 0; i < 4; i++ {
+		wallet := newTestWallet()
+		wallets = append(wallets, wallet)
+		signers = append(signers, HashPubKey(wallet.PublickKey))
+	}
+	funder := newTestWallet()
+	miningAddress = string(funder.GetAddress())
+
+	nodeIDs := make([]string, len(wallets))
+	for i := range wallets {
+		nodeIDs[i] = fmt.Sprintf("test_%s_%d", strings.Replace(t.Name(), "/", "_", -1), i)
+		c.files = append(c.files, fmt.Sprintf(dbFile, nodeIDs[i]))
+		os.Remove(c.files[i])
+	}
+	engine := &PbftEngine{}
+	engine.SetGenesisSigners(signers)
+	bc := CreateBlockchain(miningAddress, nodeIDs[0], engine)
+	UTXOSet{bc}.Reindex()
+	tx := NewUTXOTransaction(funder, string(wallets[0].GetAddress()), 1, 1, 0, &UTXOSet{bc})
+	bc.DB.Close()
+	data, err := ioutil.ReadFile(c.files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range c.files[1:] {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, wallet := range wallets {
+		bc := NewBlockchain(nodeIDs[i])
+		engine := bc.engine.(*PbftEngine)
+		engine.Authorize(wallet.PrivateKey)
+		self := engine.self()
+		c.engines[self] = engine
+		c.chains[self] = bc
+		c.network.replicas[self] = newPbftReplica(bc, engine, c.network.broadcast(self), func(block *Block) {
+			c.mtx.Lock()
+			c.committed[self] = block
+			c.mtx.Unlock()
+		})
+	}
+	for self, engine := range c.engines {
+		if c.validators, err = engine.validatorList(c.chains[self], c.chains[self].TipHash()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := acceptToMempool(c.chains[c.validators[0]], tx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *pbftTestCluster) close() {
+	c.network.mtx.Lock()
+	c.network.closed = true
+	c.network.mtx.Unlock()
+	c.network.wg.Wait()
+	for self, r := range c.network.replicas {
+		r.mtx.Lock()
+		if r.round != nil && r.round.timer != nil {
+			r.round.timer.Stop()
+		}
+		r.mtx.Unlock()
+		c.chains[self].DB.Close()
+	}
+	for _, file := range c.files {
+		os.Remove(file)
+	}
+	mempoolMtx.Lock()
+	mempool = make(map[string]Transaction)
+	mempoolMtx.Unlock()
+	netParams.PbftRequestTimeout = c.oldTimeout
+	miningAddress = c.oldMiningAddr
+}
+
+//交易池中的交易通知给正常的副本
+func (c *pbftTestCluster) request() {
+	for self, r := range c.network.replicas {
+		if !c.network.down[self] {
+			r.requestReceived()
+		}
+	}
+}
+
+//等待正常的副本都提交高度1的区块 它们提交的必须是同一个区块
+func (c *pbftTestCluster) waitCommitted() *Block {
+	for attempt := 0; attempt < 1000; attempt++ {
+		c.mtx.Lock()
+		var block *Block
+		done := true
+		for self := range c.network.replicas {
+			if c.network.down[self] {
+				continue
+			}
+			committed := c.committed[self]
+			if committed == nil {
+				done = false
+				continue
+			}
+			if block != nil && string(block.Hash) != string(committed.Hash) {
+				c.t.Fatalf("replicas committed different blocks %x and %x", block.Hash, committed.Hash)
+			}
+			block = committed
+		}
+		c.mtx.Unlock()
+		if done {
+			return block
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatal("replicas did not commit a block")
+	return nil
+}
+
+//用验证者的私钥签名消息
+func (c *pbftTestCluster) sign(signer string, msg *PbftMessage) *PbftMessage {
+	if err := c.engines[signer].signMessage(msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPbftCommit(t *testing.T) {
+	c := newPbftTestCluster(t, 10)
+	defer c.close()
+	c.request()
+	block := c.waitCommitted()
+	if len(block.Transactions) != 2 {
+		t.Fatalf("committed block has %d transactions, expected the coinbase and the request", len(block.Transactions))
+	}
+	for self, bc := range c.chains {
+		if height := bc.GetBestHeight(); height != 1 {
+			t.Fatalf("%s is at height %d after the commit", self, height)
+		}
+		tip, err := bc.GetBlock(bc.TipHash())
+		if err != nil || len(tip.Commits) < pbftQuorum(c.validators) {
+			t.Fatalf("%s has no commit proof for block %x", self, block.Hash)
+		}
+	}
+}
+
+func TestPbftViewChangeAfterPrimaryTimeout(t *testing.T) {
+	c := newPbftTestCluster(t, 1)
+	defer c.close()
+	primary := pbftPrimary(c.validators, 1, 0)
+	c.network.down[primary] = true
+	c.request()
+
+	block := c.waitCommitted()
+	extra, err := decodePbftExtra(&block.BlockHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.View != 1 {
+		t.Fatalf("committed block was proposed in view %d, expected view 1", extra.View)
+	}
+	if proposer := pbftPrimary(c.validators, 1, extra.View); proposer == primary {
+		t.Fatalf("the crashed primary %s proposed the committed block", primary)
+	}
+}
+
+func TestPbftPreparedBlockCarriedIntoNewView(t *testing.T) {
+	c := newPbftTestCluster(t, 1)
+	defer c.close()
+	//视图0中的提议在所有副本上prepared 但是commit全部丢失
+	c.network.drop = func(msg *PbftMessage) bool {
+		return msg.Phase == pbftCommit && msg.View == 0
+	}
+	c.request()
+
+	block := c.waitCommitted()
+	extra, err := decodePbftExtra(&block.BlockHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.View != 0 {
+		t.Fatalf("new view proposed a block from view %d instead of the block prepared in view 0", extra.View)
+	}
+	for _, commit := range block.Commits {
+		if commit.View == 0 {
+			t.Fatal("block was committed in view 0 although its commits were lost")
+		}
+	}
+}
+
+func TestPbftRejectsMalformedMessages(t *testing.T) {
+	c := newPbftTestCluster(t, 10)
+	defer c.close()
+	primary := pbftPrimary(c.validators, 1, 0)
+	newPrimary := pbftPrimary(c.validators, 1, 1)
+	var target, other string
+	for _, validator := range c.validators {
+		if validator != primary && validator != newPrimary {
+			if target == "" {
+				target = validator
+			} else {
+				other = validator
+			}
+		}
+	}
+	r := c.network.replicas[target]
+	state := func() (int, *Block, int) {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		changes := 0
+		for _, byView := range r.round.viewChanges {
+			changes += len(byView)
+		}
+		return r.round.view, r.round.proposal, changes
+	}
+
+	p := c.network.replicas[primary]
+	p.mtx.Lock()
+	p.syncRound()
+	block, err := p.newProposal()
+	p.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsider := &PbftEngine{}
+	outsider.Authorize(newTestWallet().PrivateKey)
+
+	preprepare := func() *PbftMessage {
+		return &PbftMessage{Phase: pbftPrePrepare, Height: 1, View: 0, Hash: block.Hash, Block: block.Serialize()}
+	}
+	garbage := []byte("not a block")
+	var proof [][]byte
+	for _, validator := range c.validators {
+		if validator != primary {
+			proof = append(proof, c.sign(validator, &PbftMessage{Phase: pbftViewChange, Height: 1, View: 1}).Serialize())
+		}
+	}
+	forged := c.sign(other, preprepare())
+	forged.PubKey = c.sign(primary, preprepare()).PubKey
+	outsiderMsg := preprepare()
+	if err := outsider.signMessage(outsiderMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  *PbftMessage
+	}{
+		{"malformed pre-prepare", c.sign(primary, &PbftMessage{Phase: pbftPrePrepare, Height: 1, View: 0, Hash: block.Hash, Block: garbage})},
+		{"pre-prepare from a backup", c.sign(other, preprepare())},
+		{"pre-prepare with a forged signature", forged},
+		{"pre-prepare from a non-validator", outsiderMsg},
+		{"malformed view change", c.sign(other, &PbftMessage{Phase: pbftViewChange, Height: 1, View: 1, Hash: block.Hash, Block: garbage})},
+		{"malformed new view", c.sign(newPrimary, &PbftMessage{Phase: pbftNewView, Height: 1, View: 1, Hash: block.Hash, Block: garbage, Proof: proof})},
+	}
+	for _, test := range tests {
+		r.handle(test.msg)
+		if view, proposal, changes := state(); view != 0 || proposal != nil || changes != 0 {
+			t.Fatalf("%s changed the replica to view %d, proposal %v, %d view changes", test.name, view, proposal != nil, changes)
+		}
+	}
+
+	//真正的主节点的提议被接受
+	r.handle(c.sign(primary, preprepare()))
+	if _, proposal, _ := state(); proposal == nil || string(proposal.Hash) != string(block.Hash) {
+		t.Fatal("replica rejected the primary's proposal")
+	}
+}
@@ -0,0 +1,323 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+//轮到出块的签名者使用的难度 不轮到的签名者使用1
+//主链是累计难度最大的分支 所以按顺序出块的分支会胜出
+const (
+	poaInTurnBits    = 2
+	poaOutOfTurnBits = 1
+)
+
+//不轮到出块的签名者额外等待的随机时间单位 避免同时出块
+const poaWiggleTime = 500 * time.Millisecond
+
+//最多缓存多少个授权状态
+const poaSnapshotCacheSize = 128
+
+var errPoaUnauthorized = errors.New("Not authorized to seal PoA blocks")
+var errPoaRecentlySigned = errors.New("Signed recently, must wait for others")
+
+//权威证明共识 授权的签名者轮流用私钥签名出块 签名者通过链上投票增减
+type PoaEngine struct {
+	genesisSigners [][]byte //创世块中记录的签名者
+
+	mtx       sync.Mutex
+	key       *ecdsa.PrivateKey       //出块使用的私钥
+	pubKey    []byte                  //出块使用的公钥
+	proposals map[string]bool         //本节点希望投票的对象 true为加入 false为移除
+	snapshots map[string]*poaSnapshot //区块哈希->该区块之后的授权状态
+}
+
+func (e *PoaEngine) Name() string {
+	return "poa"
+}
+
+//设置创世块中的签名者(公钥哈希) 只在创建区块链时使用
+func (e *PoaEngine) SetGenesisSigners(signers [][]byte) {
+	e.genesisSigners = signers
+}
+
+//设置出块使用的私钥 公钥哈希必须在签名者列表中才能出块
+func (e *PoaEngine) Authorize(key ecdsa.PrivateKey) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.key = &key
+	e.pubKey = append(key.PublicKey.X.Bytes(), key.PublicKey.Y.Bytes()...)
+}
+
+//出块时投票加入(authorize为true)或者移除一个签名者 直到投票生效
+func (e *PoaEngine) Propose(pubKeyHash []byte, authorize bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.proposals == nil {
+		e.proposals = make(map[string]bool)
+	}
+	e.proposals[hex.EncodeToString(pubKeyHash)] = authorize
+}
+
+//取消对一个对象的投票
+func (e *PoaEngine) Discard(pubKeyHash []byte) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	delete(e.proposals, hex.EncodeToString(pubKeyHash))
+}
+
+//获取父块之后的授权状态
+//从父块向前找到缓存或者检查点 再依次应用之后的区块
+func (e *PoaEngine) snapshot(chain consensus.ChainReader, hash []byte, height int) (*poaSnapshot, error) {
+	var headers []*BlockHeader
+	var snap *poaSnapshot
+	for snap == nil {
+		e.mtx.Lock()
+		cached := e.snapshots[hex.EncodeToString(hash)]
+		e.mtx.Unlock()
+		if cached != nil {
+			snap = cached
+			break
+		}
+
+		header, err := chain.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		//检查点区块中记录了全部签名者
+		if height%netParams.PoaEpoch == 0 {
+			extra, err := decodePoaExtra(header)
+			if err != nil {
+				return nil, err
+			}
+			snap = newPoaSnapshot(height, hash, extra.Signers)
+			break
+		}
+		headers = append(headers, header)
+		hash = header.PrevHash
+		height--
+	}
+
+	for i := len(headers) - 1; i >= 0; i-- {
+		var err error
+		snap, err = snap.apply(headers[i], snap.Height+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.mtx.Lock()
+	if e.snapshots == nil || len(e.snapshots) >= poaSnapshotCacheSize {
+		e.snapshots = make(map[string]*poaSnapshot)
+	}
+	e.snapshots[hex.EncodeToString(snap.Hash)] = snap
+	e.mtx.Unlock()
+	return snap, nil
+}
+
+//签名的内容 即去掉签名之后的区块头
+func poaSealHash(header *BlockHeader, extra *poaExtra) []byte {
+	unsigned := *extra
+	unsigned.Signature = nil
+	h := *header
+	h.Extra = unsigned.Serialize()
+	return h.BlockHash()
+}
+
+//填写签名者列表 投票 难度和时间戳
+func (e *PoaEngine) Prepare(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	header.Nonce = 0
+	if height == 0 {
+		header.Bits = poaOutOfTurnBits
+		header.Extra = (&poaExtra{Signers: e.genesisSigners}).Serialize()
+		return nil
+	}
+
+	snap, err := e.snapshot(chain, header.PrevHash, height-1)
+	if err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	extra := poaExtra{PubKey: e.pubKey}
+	if height%netParams.PoaEpoch == 0 {
+		extra.Signers = snap.signerBytes()
+	} else {
+		//每个块只投一票 选择一个仍然有意义的提案
+		for target, authorize := range e.proposals {
+			if snap.validVote(target, authorize) {
+				extra.Vote, _ = hex.DecodeString(target)
+				extra.Authorize = authorize
+				break
+			}
+		}
+	}
+	e.mtx.Unlock()
+	header.Extra = extra.Serialize()
+
+	header.Bits = poaOutOfTurnBits
+	if len(extra.PubKey) > 0 && snap.inTurn(height, hex.EncodeToString(HashPubKey(extra.PubKey))) {
+		header.Bits = poaInTurnBits
+	}
+
+	//相邻区块之间至少间隔PoaPeriod秒
+	parent, err := chain.GetHeader(header.PrevHash)
+	if err != nil {
+		return err
+	}
+	if minTime := parent.Timestamp + netParams.PoaPeriod; header.Timestamp < minTime {
+		header.Timestamp = minTime
+	}
+	return nil
+}
+
+//等到区块的时间戳之后用私钥签名 不轮到出块时再随机等待一段时间
+func (e *PoaEngine) Seal(ctx context.Context, chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块不需要签名
+	if height == 0 {
+		return nil
+	}
+
+	e.mtx.Lock()
+	key := e.key
+	e.mtx.Unlock()
+	if key == nil {
+		return errPoaUnauthorized
+	}
+
+	snap, err := e.snapshot(chain, header.PrevHash, height-1)
+	if err != nil {
+		return err
+	}
+	extra, err := decodePoaExtra(header)
+	if err != nil {
+		return err
+	}
+	signer := hex.EncodeToString(HashPubKey(extra.PubKey))
+	if !snap.Signers[signer] {
+		return errPoaUnauthorized
+	}
+	if snap.recentlySigned(height, signer) {
+		return errPoaRecentlySigned
+	}
+
+	delay := time.Until(time.Unix(header.Timestamp, 0))
+	if header.Bits == poaOutOfTurnBits {
+		delay += time.Duration(mrand.Int63n(int64(snap.signerLimit()) * int64(poaWiggleTime)))
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+
+	signature, err := signHash(*key, poaSealHash(header, extra))
+	if err != nil {
+		return err
+	}
+	extra.Signature = signature
+	header.Extra = extra.Serialize()
+	return nil
+}
+
+//检查签名者列表 投票 难度和出块间隔
+func (e *PoaEngine) VerifyHeader(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	extra, err := decodePoaExtra(header)
+	if err != nil {
+		return err
+	}
+	if header.Bits != poaInTurnBits && header.Bits != poaOutOfTurnBits {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has PoA difficulty %d", header.BlockHash(), header.Bits))
+	}
+
+	if height%netParams.PoaEpoch == 0 {
+		//检查点不能投票 并且必须记录父块之后的全部签名者
+		if len(extra.Vote) > 0 {
+			return ruleError(ErrBadVote, fmt.Sprintf("checkpoint block %x contains a vote", header.BlockHash()))
+		}
+		snap, err := e.snapshot(chain, header.PrevHash, height-1)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%x", extra.Signers) != fmt.Sprintf("%x", snap.signerBytes()) {
+			return ruleError(ErrBadVote, fmt.Sprintf("checkpoint block %x has a mismatching signer list", header.BlockHash()))
+		}
+	} else {
+		if len(extra.Signers) > 0 {
+			return ruleError(ErrBadVote, fmt.Sprintf("non-checkpoint block %x contains a signer list", header.BlockHash()))
+		}
+		if len(extra.Vote) > 0 && len(extra.Vote) != 20 {
+			return ruleError(ErrBadVote, fmt.Sprintf("block %x votes for an invalid signer %x", header.BlockHash(), extra.Vote))
+		}
+	}
+
+	parent, err := chain.GetHeader(header.PrevHash)
+	if err != nil {
+		return err
+	}
+	if minTime := parent.Timestamp + netParams.PoaPeriod; header.Timestamp < minTime {
+		return ruleError(ErrTimeTooOld, fmt.Sprintf("block %x timestamp %d is earlier than %d", header.BlockHash(), header.Timestamp, minTime))
+	}
+	return nil
+}
+
+//检查签名 签名者是否有权出块 是否出块过于频繁以及难度是否与出块顺序一致
+func (e *PoaEngine) VerifySeal(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块没有签名
+	if height == 0 {
+		return nil
+	}
+	extra, err := decodePoaExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, poaSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+
+	snap, err := e.snapshot(chain, header.PrevHash, height-1)
+	if err != nil {
+		return err
+	}
+	signer := hex.EncodeToString(HashPubKey(extra.PubKey))
+	if !snap.Signers[signer] {
+		return ruleError(ErrUnauthorizedSigner, fmt.Sprintf("block %x is signed by unauthorized signer %s", header.BlockHash(), signer))
+	}
+	if snap.recentlySigned(height, signer) {
+		return ruleError(ErrRecentlySigned, fmt.Sprintf("signer %s of block %x signed too recently", signer, header.BlockHash()))
+	}
+
+	expected := uint32(poaOutOfTurnBits)
+	if snap.inTurn(height, signer) {
+		expected = poaInTurnBits
+	}
+	if header.Bits != expected {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has PoA difficulty %d, expected %d", header.BlockHash(), header.Bits, expected))
+	}
+	return nil
+}
+
+//孤块的父块未知 只能检查区块头中的签名
+func (e *PoaEngine) verifyOrphanSeal(header *BlockHeader) error {
+	extra, err := decodePoaExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, poaSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	return nil
+}
+
+//按顺序出块的区块权重更大
+func (e *PoaEngine) CalcWork(chain consensus.ChainReader, header *BlockHeader, height int) *big.Int {
+	return big.NewInt(int64(header.Bits))
+}
@@ -0,0 +1,244 @@
+package Block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+)
+
+//PoA区块头Extra中保存的数据
+type poaExtra struct {
+	Signers   [][]byte //检查点区块记录的全部签名者(公钥哈希)
+	Vote      []byte   //投票的对象(公钥哈希) 为空表示不投票
+	Authorize bool     //true为投票加入签名者 false为投票移除
+	PubKey    []byte   //出块者的公钥
+	Signature []byte   //出块者对区块头(不含签名)的签名
+}
+
+func (e *poaExtra) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+func decodePoaExtra(header *BlockHeader) (*poaExtra, error) {
+	var extra poaExtra
+	decoder := gob.NewDecoder(bytes.NewReader(header.Extra))
+	if err := decoder.Decode(&extra); err != nil {
+		return nil, ruleError(ErrBadSeal, fmt.Sprintf("block %x has malformed PoA extra data", header.BlockHash()))
+	}
+	return &extra, nil
+}
+
+//一张投票
+type poaVote struct {
+	Signer    string //投票的签名者
+	Height    int    //投票所在的区块高度
+	Target    string //被投票的对象
+	Authorize bool   //加入还是移除
+}
+
+//对一个对象的计票
+type poaTally struct {
+	Authorize bool
+	Votes     int
+}
+
+//某个区块之后的授权状态
+//签名者和投票对象都用公钥哈希的十六进制表示
+type poaSnapshot struct {
+	Height  int
+	Hash    []byte
+	Signers map[string]bool      //当前的签名者
+	Recents map[int]string       //最近出块的签名者 高度->签名者
+	Votes   []poaVote            //当前周期内有效的投票
+	Tally   map[string]poaTally //每个对象的计票
+}
+
+//根据检查点记录的签名者创建授权状态
+func newPoaSnapshot(height int, hash []byte, signers [][]byte) *poaSnapshot {
+	snap := &poaSnapshot{
+		Height:  height,
+		Hash:    hash,
+		Signers: make(map[string]bool),
+		Recents: make(map[int]string),
+		Tally:   make(map[string]poaTally),
+	}
+	for _, signer := range signers {
+		snap.Signers[hex.EncodeToString(signer)] = true
+	}
+	return snap
+}
+
+func (s *poaSnapshot) copy() *poaSnapshot {
+	cpy := &poaSnapshot{
+		Height:  s.Height,
+		Hash:    s.Hash,
+		Signers: make(map[string]bool),
+		Recents: make(map[int]string),
+		Votes:   append([]poaVote{}, s.Votes...),
+		Tally:   make(map[string]poaTally),
+	}
+	for signer := range s.Signers {
+		cpy.Signers[signer] = true
+	}
+	for height, signer := range s.Recents {
+		cpy.Recents[height] = signer
+	}
+	for target, tally := range s.Tally {
+		cpy.Tally[target] = tally
+	}
+	return cpy
+}
+
+//按字典序排列的签名者 决定轮到谁出块
+func (s *poaSnapshot) signerList() []string {
+	var signers []string
+	for signer := range s.Signers {
+		signers = append(signers, signer)
+	}
+	sort.Strings(signers)
+	return signers
+}
+
+//检查点区块中记录的签名者
+func (s *poaSnapshot) signerBytes() [][]byte {
+	var signers [][]byte
+	for _, signer := range s.signerList() {
+		b, _ := hex.DecodeString(signer)
+		signers = append(signers, b)
+	}
+	return signers
+}
+
+//一个签名者在连续signerLimit个块中最多只能出一个块
+func (s *poaSnapshot) signerLimit() int {
+	return len(s.Signers)/2 + 1
+}
+
+//高度为height的区块是否轮到signer出块
+func (s *poaSnapshot) inTurn(height int, signer string) bool {
+	signers := s.signerList()
+	return len(signers) > 0 && signers[height%len(signers)] == signer
+}
+
+//signer在高度为height时是否因为最近出过块而不能出块
+func (s *poaSnapshot) recentlySigned(height int, signer string) bool {
+	for seen, recent := range s.Recents {
+		if recent == signer && seen > height-s.signerLimit() {
+			return true
+		}
+	}
+	return false
+}
+
+//投票只有在改变签名者列表时才有意义
+func (s *poaSnapshot) validVote(target string, authorize bool) bool {
+	return s.Signers[target] != authorize
+}
+
+func (s *poaSnapshot) cast(target string, authorize bool) bool {
+	if !s.validVote(target, authorize) {
+		return false
+	}
+	tally := s.Tally[target]
+	tally.Authorize = authorize
+	tally.Votes++
+	s.Tally[target] = tally
+	return true
+}
+
+func (s *poaSnapshot) uncast(target string, authorize bool) {
+	tally, ok := s.Tally[target]
+	if !ok || tally.Authorize != authorize {
+		return
+	}
+	if tally.Votes > 1 {
+		tally.Votes--
+		s.Tally[target] = tally
+	} else {
+		delete(s.Tally, target)
+	}
+}
+
+//在授权状态上应用高度为height的区块 返回新的授权状态
+func (s *poaSnapshot) apply(header *BlockHeader, height int) (*poaSnapshot, error) {
+	if height != s.Height+1 {
+		return nil, fmt.Errorf("PoA snapshot at height %d cannot apply block at height %d", s.Height, height)
+	}
+	snap := s.copy()
+
+	//检查点清空所有投票
+	if height%netParams.PoaEpoch == 0 {
+		snap.Votes = nil
+		snap.Tally = make(map[string]poaTally)
+	}
+	//最早的出块记录离开窗口后 该签名者可以再次出块
+	delete(snap.Recents, height-snap.signerLimit())
+
+	extra, err := decodePoaExtra(header)
+	if err != nil {
+		return nil, err
+	}
+	signer := hex.EncodeToString(HashPubKey(extra.PubKey))
+	if !snap.Signers[signer] {
+		return nil, ruleError(ErrUnauthorizedSigner, fmt.Sprintf("block %x is signed by unauthorized signer %s", header.BlockHash(), signer))
+	}
+	if snap.recentlySigned(height, signer) {
+		return nil, ruleError(ErrRecentlySigned, fmt.Sprintf("signer %s of block %x signed too recently", signer, header.BlockHash()))
+	}
+	snap.Recents[height] = signer
+
+	if len(extra.Vote) > 0 {
+		target := hex.EncodeToString(extra.Vote)
+		//同一个签名者对同一个对象的新投票替换旧投票
+		for i, vote := range snap.Votes {
+			if vote.Signer == signer && vote.Target == target {
+				snap.uncast(vote.Target, vote.Authorize)
+				snap.Votes = append(snap.Votes[:i], snap.Votes[i+1:]...)
+				break
+			}
+		}
+		if snap.cast(target, extra.Authorize) {
+			snap.Votes = append(snap.Votes, poaVote{signer, height, target, extra.Authorize})
+		}
+
+		//超过半数签名者同意后生效
+		if tally := snap.Tally[target]; tally.Votes > len(snap.Signers)/2 {
+			if tally.Authorize {
+				snap.Signers[target] = true
+			} else {
+				delete(snap.Signers, target)
+				//签名者减少后出块窗口变小
+				delete(snap.Recents, height-snap.signerLimit())
+				//被移除的签名者之前的投票作废
+				for i := 0; i < len(snap.Votes); i++ {
+					if snap.Votes[i].Signer == target {
+						snap.uncast(snap.Votes[i].Target, snap.Votes[i].Authorize)
+						snap.Votes = append(snap.Votes[:i], snap.Votes[i+1:]...)
+						i--
+					}
+				}
+			}
+			//针对该对象的投票已经完成
+			for i := 0; i < len(snap.Votes); i++ {
+				if snap.Votes[i].Target == target {
+					snap.Votes = append(snap.Votes[:i], snap.Votes[i+1:]...)
+					i--
+				}
+			}
+			delete(snap.Tally, target)
+		}
+	}
+
+	snap.Height = height
+	snap.Hash = header.BlockHash()
+	return snap, nil
+}
@@ -0,0 +1,638 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//保留多少个高度内见过的区块头 用于发现重复签名
+const posEvidenceWindow = 100
+
+//创世块的奖励拆分成多少个输出 创建者可以一边质押一边转账
+const posGenesisOutputs = 10
+
+var errPosNoKey = errors.New("No staking key, cannot produce PoS blocks")
+var errPosNoStake = errors.New("No outputs to stake")
+
+//PoS区块头Extra中保存的数据
+type posExtra struct {
+	Height        int    //区块高度 用于识别同一高度的重复签名
+	StakeModifier []byte //质押修改器 由父块决定 出块者无法选择
+	KernelTxid    []byte //被质押的输出
+	KernelVout    int
+	CoinstakeID   []byte //区块中coinstake交易的ID
+	PubKey        []byte //质押者的公钥
+	Signature     []byte //质押者对区块头(不含签名)的签名
+}
+
+func (e *posExtra) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+func decodePosExtra(header *BlockHeader) (*posExtra, error) {
+	var extra posExtra
+	decoder := gob.NewDecoder(bytes.NewReader(header.Extra))
+	if err := decoder.Decode(&extra); err != nil {
+		return nil, ruleError(ErrBadSeal, fmt.Sprintf("block %x has malformed PoS extra data", header.BlockHash()))
+	}
+	return &extra, nil
+}
+
+//签名的内容 即去掉签名之后的区块头
+func posSealHash(header *BlockHeader, extra *posExtra) []byte {
+	unsigned := *extra
+	unsigned.Signature = nil
+	h := *header
+	h.Extra = unsigned.Serialize()
+	return h.BlockHash()
+}
+
+//质押内核的哈希 只由修改器 被质押的输出和时间槽决定
+//出块者只能在每个时间槽对每个输出尝试一次 无法通过改变区块内容反复尝试
+func stakeKernelHash(modifier, txid []byte, vout int, timestamp int64) []byte {
+	data := bytes.Join([][]byte{
+		modifier,
+		txid,
+		Int64ToBytes(int64(vout)),
+		Int64ToBytes(timestamp / netParams.PosSlotTime),
+	}, []byte{})
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+//内核哈希小于 目标值*金额*币龄 时获得出块权 持有越多越久的输出中签概率越大
+func checkStakeKernel(kernelHash []byte, bits uint32, value int, age int64) bool {
+	if age < netParams.StakeMinAge || value <= 0 {
+		return false
+	}
+	if age > netParams.StakeMaxAge {
+		age = netParams.StakeMaxAge
+	}
+	weight := new(big.Int).Mul(big.NewInt(int64(value)), big.NewInt(age))
+	target := CompactToBig(bits)
+	target.Mul(target, weight)
+	return new(big.Int).SetBytes(kernelHash).Cmp(target) < 0
+}
+
+//子块使用的修改器 由父块的修改器和父块的内核哈希决定
+func nextStakeModifier(parent *BlockHeader) ([]byte, error) {
+	extra, err := decodePosExtra(parent)
+	if err != nil {
+		return nil, err
+	}
+	kernel := stakeKernelHash(extra.StakeModifier, extra.KernelTxid, extra.KernelVout, parent.Timestamp)
+	hash := sha256.Sum256(append(append([]byte{}, extra.StakeModifier...), kernel...))
+	return hash[:], nil
+}
+
+//同一个质押者在同一高度签名了两个不同的区块 说明它在多个分支上同时出块
+type DoubleSignEvidence struct {
+	First  []byte //序列化的区块头
+	Second []byte
+}
+
+func (ev DoubleSignEvidence) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(ev)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+//检查证据 两个区块头必须高度相同 质押者相同 内容不同并且签名都有效
+//其中至少一个必须是链上保存的区块 它的coinstake才能被没收
+func (ev DoubleSignEvidence) verify(bc *BlockChain, height int) error {
+	first, err1 := DeserializeBlockHeader(ev.First)
+	second, err2 := DeserializeBlockHeader(ev.Second)
+	if err1 != nil || err2 != nil {
+		return ruleError(ErrBadEvidence, "evidence contains a malformed header")
+	}
+	e1, err1 := decodePosExtra(&first)
+	e2, err2 := decodePosExtra(&second)
+	if err1 != nil || err2 != nil {
+		return ruleError(ErrBadEvidence, "evidence contains a header without PoS data")
+	}
+	if e1.Height != e2.Height || e1.Height >= height || e1.Height == 0 {
+		return ruleError(ErrBadEvidence, fmt.Sprintf("evidence headers at heights %d and %d are not comparable", e1.Height, e2.Height))
+	}
+	if !bytes.Equal(e1.PubKey, e2.PubKey) || bytes.Equal(first.BlockHash(), second.BlockHash()) {
+		return ruleError(ErrBadEvidence, "evidence headers are not two different blocks of one staker")
+	}
+	if !verifyHashSignature(e1.PubKey, e1.Signature, posSealHash(&first, e1)) ||
+		!verifyHashSignature(e2.PubKey, e2.Signature, posSealHash(&second, e2)) {
+		return ruleError(ErrBadEvidence, "evidence header has an invalid signature")
+	}
+	if ids, _ := ev.offendingCoinstakes(bc.findBlock); len(ids) == 0 {
+		return ruleError(ErrBadEvidence, "evidence does not name the coinstake of a block on the chain")
+	}
+	return nil
+}
+
+//作恶区块中的coinstake交易和质押者的公钥哈希 coinstake中仍然付款给质押者的未花费输出会被没收
+//只有链上保存的区块中 与区块头记录一致并且只付款给质押者的coinstake才会被返回
+//否则任何人都可以签两个区块头 在其中写上别人的交易ID
+func (ev DoubleSignEvidence) offendingCoinstakes(getBlock func(hash []byte) *Block) ([][]byte, []byte) {
+	var ids [][]byte
+	var stakerHash []byte
+	for _, data := range [][]byte{ev.First, ev.Second} {
+		header, err := DeserializeBlockHeader(data)
+		if err != nil {
+			continue
+		}
+		extra, err := decodePosExtra(&header)
+		if err != nil {
+			continue
+		}
+		block := getBlock(header.BlockHash())
+		if block == nil || len(block.Transactions) < 2 {
+			continue
+		}
+		coinstake := block.Transactions[1]
+		if !coinstake.IsCoinstake() || !bytes.Equal(coinstake.ID, extra.CoinstakeID) {
+			continue
+		}
+		owned := true
+		for _, out := range coinstake.Vout[1:] {
+			owned = owned && out.IsLockedWithKey(HashPubKey(extra.PubKey))
+		}
+		if owned {
+			ids = append(ids, coinstake.ID)
+			stakerHash = HashPubKey(extra.PubKey)
+		}
+	}
+	return ids, stakerHash
+}
+
+//权益证明共识 持有未花费输出的质押者按金额和币龄抽签出块
+//出块奖励由coinstake交易领取 在多个分支上同时出块的质押者会被没收奖励和本金
+type PosEngine struct {
+	mtx      sync.Mutex
+	key      *ecdsa.PrivateKey         //质押使用的私钥
+	pubKey   []byte                    //质押使用的公钥
+	seen     map[int]map[string][]byte //高度->质押者->见过的区块头
+	evidence []DoubleSignEvidence      //发现的尚未打包的作恶证据
+}
+
+func (e *PosEngine) Name() string {
+	return "pos"
+}
+
+//设置质押使用的私钥 只能质押这个私钥对应的输出
+func (e *PosEngine) Authorize(key ecdsa.PrivateKey) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.key = &key
+	e.pubKey = append(key.PublicKey.X.Bytes(), key.PublicKey.Y.Bytes()...)
+}
+
+//填写难度和修改器 内核在finalizeBlock中寻找
+func (e *PosEngine) Prepare(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	header.Nonce = 0
+	bits, err := calcNextRequiredBits(chain, header.PrevHash, height, netParams.PosLimit)
+	if err != nil {
+		return err
+	}
+	header.Bits = bits
+
+	extra := posExtra{Height: height, StakeModifier: make([]byte, sha256.Size)}
+	if height > 0 {
+		parent, err := chain.GetHeader(header.PrevHash)
+		if err != nil {
+			return err
+		}
+		extra.StakeModifier, err = nextStakeModifier(parent)
+		if err != nil {
+			return err
+		}
+		e.mtx.Lock()
+		extra.PubKey = e.pubKey
+		e.mtx.Unlock()
+	}
+	header.Extra = extra.Serialize()
+	return nil
+}
+
+//用质押者的私钥签名区块头
+func (e *PosEngine) Seal(ctx context.Context, chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块不需要签名
+	if height == 0 {
+		return nil
+	}
+	e.mtx.Lock()
+	key := e.key
+	e.mtx.Unlock()
+	if key == nil {
+		return errPosNoKey
+	}
+	extra, err := decodePosExtra(header)
+	if err != nil {
+		return err
+	}
+	signature, err := signHash(*key, posSealHash(header, extra))
+	if err != nil {
+		return err
+	}
+	extra.Signature = signature
+	header.Extra = extra.Serialize()
+	return nil
+}
+
+//检查高度 时间槽 难度和修改器
+func (e *PosEngine) VerifyHeader(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	extra, err := decodePosExtra(header)
+	if err != nil {
+		return err
+	}
+	if extra.Height != height {
+		return ruleError(ErrBadHeight, fmt.Sprintf("block %x commits to height %d, expected %d", header.BlockHash(), extra.Height, height))
+	}
+	if header.Timestamp%netParams.PosSlotTime != 0 {
+		return ruleError(ErrBadStake, fmt.Sprintf("block %x timestamp %d is not at the start of a slot", header.BlockHash(), header.Timestamp))
+	}
+
+	expected, err := calcNextRequiredBits(chain, header.PrevHash, height, netParams.PosLimit)
+	if err != nil {
+		return err
+	}
+	if header.Bits != expected {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has bits %08x, expected %08x", header.BlockHash(), header.Bits, expected))
+	}
+
+	parent, err := chain.GetHeader(header.PrevHash)
+	if err != nil {
+		return err
+	}
+	modifier, err := nextStakeModifier(parent)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(modifier, extra.StakeModifier) {
+		return ruleError(ErrBadStake, fmt.Sprintf("block %x has a wrong stake modifier", header.BlockHash()))
+	}
+	return nil
+}
+
+//检查签名和质押内核 通过检查的区块头会被记录下来用于发现重复签名
+func (e *PosEngine) VerifySeal(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块没有签名
+	if height == 0 {
+		return nil
+	}
+	extra, err := decodePosExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, posSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+
+	bc, ok := chain.(*BlockChain)
+	if !ok {
+		return errors.New("PoS needs the block chain to look up stakes")
+	}
+	out, outTime, err := bc.findStakeOutput(header.PrevHash, extra.KernelTxid, extra.KernelVout)
+	if err != nil {
+		return ruleError(ErrBadStake, fmt.Sprintf("block %x stakes unknown output %s", header.BlockHash(), outpointKey(extra.KernelTxid, extra.KernelVout)))
+	}
+	if !out.IsLockedWithKey(HashPubKey(extra.PubKey)) {
+		return ruleError(ErrBadStake, fmt.Sprintf("block %x stakes an output its signer does not own", header.BlockHash()))
+	}
+	kernel := stakeKernelHash(extra.StakeModifier, extra.KernelTxid, extra.KernelVout, header.Timestamp)
+	if !checkStakeKernel(kernel, header.Bits, out.Value, header.Timestamp-outTime) {
+		return ruleError(ErrBadStake, fmt.Sprintf("block %x does not satisfy its stake target", header.BlockHash()))
+	}
+
+	e.observe(header, extra)
+	return nil
+}
+
+//孤块的父块未知 只能检查区块头中的签名
+func (e *PosEngine) verifyOrphanSeal(header *BlockHeader) error {
+	extra, err := decodePosExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, posSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	return nil
+}
+
+//持有越多越久的输出越难伪造
+func (e *PosEngine) CalcWork(chain consensus.ChainReader, header *BlockHeader, height int) *big.Int {
+	return CalcWork(header.Bits)
+}
+
+//记录签名有效的区块头 同一质押者在同一高度签了两个区块时保存证据
+func (e *PosEngine) observe(header *BlockHeader, extra *posExtra) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.seen == nil {
+		e.seen = make(map[int]map[string][]byte)
+	}
+	for height := range e.seen {
+		if height < extra.Height-posEvidenceWindow {
+			delete(e.seen, height)
+		}
+	}
+	if e.seen[extra.Height] == nil {
+		e.seen[extra.Height] = make(map[string][]byte)
+	}
+
+	staker := hex.EncodeToString(extra.PubKey)
+	data, err := header.Serialize()
+	if err != nil {
+		return
+	}
+	prev, ok := e.seen[extra.Height][staker]
+	if !ok {
+		e.seen[extra.Height][staker] = data
+		return
+	}
+	if !bytes.Equal(prev, data) {
+		fmt.Printf("Staker %x signed two blocks at height %d\n", HashPubKey(extra.PubKey), extra.Height)
+		e.evidence = append(e.evidence, DoubleSignEvidence{prev, data})
+	}
+}
+
+//还能没收到输出的证据 已经没有可以没收的输出的证据被丢弃
+func (e *PosEngine) pendingEvidence(bc *BlockChain, height int) []DoubleSignEvidence {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var pending []DoubleSignEvidence
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		getBlock := func(hash []byte) *Block {
+			return blockFromTx(tx, hash)
+		}
+		for _, ev := range e.evidence {
+			ids, _ := ev.offendingCoinstakes(getBlock)
+			for _, id := range ids {
+				if b.Get(id) != nil {
+					pending = append(pending, ev)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	e.evidence = pending
+
+	var valid []DoubleSignEvidence
+	for _, ev := range pending {
+		if ev.verify(bc, height) == nil {
+			valid = append(valid, ev)
+		}
+	}
+	return valid
+}
+
+//等待到某个时间槽自己的输出中签 然后加入coinstake交易和作恶证据
+//区块奖励从coinbase转移到coinstake中领取
+func (e *PosEngine) finalizeBlock(ctx context.Context, bc *BlockChain, block *Block) error {
+	if block.Height == 0 {
+		splitGenesisReward(block.Transactions[0])
+		return nil
+	}
+	e.mtx.Lock()
+	key := e.key
+	e.mtx.Unlock()
+	if key == nil {
+		return errPosNoKey
+	}
+	extra, err := decodePosExtra(&block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	pubKeyHash := HashPubKey(extra.PubKey)
+
+	//区块中其他交易花费的输出和将被没收的输出不能再用来质押
+	evidence := e.pendingEvidence(bc, block.Height)
+	spent := make(map[string]bool)
+	slashed := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		for _, vin := range tx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+	for _, ev := range evidence {
+		ids, _ := ev.offendingCoinstakes(bc.findBlock)
+		for _, id := range ids {
+			slashed[hex.EncodeToString(id)] = true
+		}
+	}
+	var candidates []stakeCandidate
+	for _, c := range bc.findStakeCandidates(pubKeyHash) {
+		if !spent[outpointKey(c.txid, c.vout)] && !slashed[hex.EncodeToString(c.txid)] {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return errPosNoStake
+	}
+
+	slot := netParams.PosSlotTime
+	timestamp := (block.Timestamp + slot - 1) / slot * slot
+	var kernel *stakeCandidate
+	for kernel == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(time.Unix(timestamp, 0))):
+		}
+		for i := range candidates {
+			c := &candidates[i]
+			hash := stakeKernelHash(extra.StakeModifier, c.txid, c.vout, timestamp)
+			if checkStakeKernel(hash, block.Bits, c.out.Value, timestamp-c.time) {
+				kernel = c
+				break
+			}
+		}
+		if kernel == nil {
+			timestamp += slot
+		}
+	}
+	block.Timestamp = timestamp
+
+	coinbase := block.Transactions[0]
+	reward := coinbase.OutputValue()
+	for i := range coinbase.Vout {
+		coinbase.Vout[i].Value = 0
+	}
+	coinbase.ID = nil
+	coinbase.SetID()
+
+	//第一个输出为空 作为coinstake的标记
+	inputs := []TXInput{{kernel.txid, kernel.vout, nil, 0}}
+	outputs := []TXOutput{{0, nil}, {kernel.out.Value + reward, payToPubKeyHashScript(pubKeyHash)}}
+	coinstake := Transaction{nil, inputs, outputs, 0}
+	coinstake.SetID()
+	prevTX, err := bc.FindTransaction(kernel.txid)
+	if err != nil {
+		return err
+	}
+	coinstake.Sign(*key, map[string]Transaction{hex.EncodeToString(prevTX.ID): prevTX})
+
+	block.Transactions = append([]*Transaction{coinbase, &coinstake}, block.Transactions[1:]...)
+	block.Evidence = evidence
+
+	extra.KernelTxid = kernel.txid
+	extra.KernelVout = kernel.vout
+	extra.CoinstakeID = coinstake.ID
+	block.Extra = extra.Serialize()
+	return nil
+}
+
+//质押过的输出要等到成熟后才能转账 只有一个输出时创建者会一直重复质押它
+//所以把创世块的奖励拆分成多个输出
+func splitGenesisReward(coinbase *Transaction) {
+	out := coinbase.Vout[0]
+	if out.Value < posGenesisOutputs {
+		return
+	}
+	var outputs []TXOutput
+	for i := 0; i < posGenesisOutputs; i++ {
+		value := out.Value / posGenesisOutputs
+		if i == posGenesisOutputs-1 {
+			value = out.Value - value*(posGenesisOutputs-1)
+		}
+		outputs = append(outputs, TXOutput{value, out.ScriptPubKey})
+	}
+	coinbase.Vout = outputs
+	coinbase.ID = nil
+	coinbase.SetID()
+}
+
+//检查coinstake交易和作恶证据
+func (e *PosEngine) verifyBody(bc *BlockChain, block *Block) error {
+	if block.Height == 0 {
+		return nil
+	}
+	extra, err := decodePosExtra(&block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	if len(block.Transactions) < 2 || !block.Transactions[1].IsCoinstake() {
+		return ruleError(ErrBadCoinstake, fmt.Sprintf("block %x does not have a coinstake as its second transaction", block.Hash))
+	}
+	coinstake := block.Transactions[1]
+	if !bytes.Equal(coinstake.ID, extra.CoinstakeID) {
+		return ruleError(ErrBadCoinstake, fmt.Sprintf("coinstake %x does not match the header of block %x", coinstake.ID, block.Hash))
+	}
+	if !bytes.Equal(coinstake.Vin[0].Txid, extra.KernelTxid) || coinstake.Vin[0].Vout != extra.KernelVout {
+		return ruleError(ErrBadCoinstake, fmt.Sprintf("coinstake %x does not spend the stake of block %x", coinstake.ID, block.Hash))
+	}
+	stakerHash := HashPubKey(extra.PubKey)
+	for _, out := range coinstake.Vout[1:] {
+		if !out.IsLockedWithKey(stakerHash) {
+			return ruleError(ErrBadCoinstake, fmt.Sprintf("coinstake %x pays someone other than the staker", coinstake.ID))
+		}
+	}
+
+	for _, ev := range block.Evidence {
+		if err := ev.verify(bc, block.Height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//一个可以质押的输出
+type stakeCandidate struct {
+	txid []byte
+	vout int
+	out  TXOutput
+	time int64 //输出所在区块的时间戳
+}
+
+//找到属于pubKeyHash的所有未花费输出以及它们所在区块的时间戳
+func (bc *BlockChain) findStakeCandidates(pubKeyHash []byte) []stakeCandidate {
+	var candidates []stakeCandidate
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		return b.ForEach(func(k, v []byte) error {
+			outs := DeserializeOutputs(v)
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					candidates = append(candidates, stakeCandidate{append([]byte{}, k...), outIdx, out, 0})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	//从链尾向前找到每个输出所在的区块
+	remaining := len(candidates)
+	bci := bc.Iterator()
+	for remaining > 0 {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			for i := range candidates {
+				if candidates[i].time == 0 && bytes.Equal(candidates[i].txid, tx.ID) {
+					candidates[i].time = block.Timestamp
+					remaining--
+				}
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return candidates
+}
+
+//从hash所在的区块向前查找交易txid的第vout个输出 同时返回交易所在区块的时间戳
+//只在这条分支上查找 输出是否已经花费在连接coinstake交易时检查
+func (bc *BlockChain) findStakeOutput(hash, txid []byte, vout int) (TXOutput, int64, error) {
+	for {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return TXOutput{}, 0, err
+		}
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txid) {
+				if vout < 0 || vout >= len(tx.Vout) {
+					return TXOutput{}, 0, errors.New("Output is not found")
+				}
+				return tx.Vout[vout], block.Timestamp, nil
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			return TXOutput{}, 0, errors.New("Transaction is not found")
+		}
+		hash = block.PrevHash
+	}
+}
+
+//PoS区块中的第二笔交易是coinstake 它可以领取出块奖励
+func (bc *BlockChain) isCoinstake(block *Block, index int) bool {
+	_, pos := bc.engine.(*PosEngine)
+	return pos && index == 1 && block.Transactions[index].IsCoinstake()
+}
@@ -0,0 +1,48 @@
+package Block
+
+import (
+	"testing"
+)
+
+//签名一个声称位于height并且coinstake为coinstakeID的区块头
+func signedPosHeader(t *testing.T, w *Wallet, height int, coinstakeID []byte, timestamp int64) []byte {
+	header := BlockHeader{
+		Version:    1,
+		PrevHash:   make([]byte, 32),
+		MerkleRoot: make([]byte, 32),
+		Timestamp:  timestamp,
+	}
+	extra := &posExtra{Height: height, CoinstakeID: coinstakeID, PubKey: w.PublickKey}
+	header.Extra = extra.Serialize()
+	signature, err := signHash(w.PrivateKey, posSealHash(&header, extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra.Signature = signature
+	header.Extra = extra.Serialize()
+	data, err := header.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEvidenceAgainstThirdPartyIsRejected(t *testing.T) {
+	bc, _, cleanup := newTestChain(t, &PowEngine{})
+	defer cleanup()
+	genesis := bc.Iterator().Next()
+	txid := genesis.Transactions[0].ID
+
+	//攻击者用自己的私钥签两个区块头 把受害者的交易写成coinstake
+	attacker := newTestWallet()
+	ev := DoubleSignEvidence{
+		First:  signedPosHeader(t, attacker, 1, txid, 1),
+		Second: signedPosHeader(t, attacker, 1, txid, 2),
+	}
+	if err := ev.verify(bc, 2); !IsErrorCode(err, ErrBadEvidence) {
+		t.Fatalf("evidence against a third party returned %v, want ErrBadEvidence", err)
+	}
+	if ids, _ := ev.offendingCoinstakes(bc.findBlock); len(ids) != 0 {
+		t.Fatalf("evidence against a third party would slash %x", ids)
+	}
+}
@@ -1,57 +1,121 @@
 package Block
 
 import (
+	"blockchainlearning/consensus"
+	"blockchainlearning/powhash"
+	"context"
+	"sync"
 	"math/big"
-	"bytes"
 	"fmt"
+	"log"
 	"math"
-	"crypto/sha256"
 	"encoding/binary"
 )
 
-const targetBits = 1
+//早期创建的区块链没有记录哈希函数 使用单次SHA-256
+const legacyPowHash = "sha256"
 
-//定义POW 由当前区块和需要计算的值
+//内存困难的哈希函数 挖矿时更频繁地检查是否取消
+var memoryHardPowHashes = map[string]bool{"scrypt": true, "argon2": true}
+
+//定义POW 由当前区块头和需要计算的值
 type ProofOfWork struct {
-	block  *Block
-	target *big.Int
+	header  *BlockHeader
+	target  *big.Int
+	limit   *big.Int     //允许的最大目标值
+	powHash powhash.Func //区块头的工作量证明哈希
+	batch   uint64       //每计算多少次哈希检查一次是否取消
 }
 
-//创建一个POW
-func NewproofOfWork(b *Block) (pow *ProofOfWork) {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
-	pow = &ProofOfWork{b, target}
+//创建一个POW 目标值取自区块头中记录的难度 哈希函数和最大目标值由区块链决定
+func NewproofOfWork(h *BlockHeader, powHash powhash.Func, limit *big.Int) (pow *ProofOfWork) {
+	target := CompactToBig(h.Bits)
+	pow = &ProofOfWork{h, target, limit, powHash, hashBatchSize}
 	return
 }
 
 //执行计算（挖矿）
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
-	//打印当前块的数据
-	// fmt.Printf("Mining the block containing \"%s\"\n", pow.block.HashTransactions())
-	//设置边界 计算以防越界
-	for nonce < math.MaxInt64 {
-		//计算出需要求hash的数据
-		data := pow.prepareData(nonce)
-		//求哈希值
-		hash = sha256.Sum256(data)
-		hashInt.SetBytes(hash[:])
-		//如果算出来的hash比约定的小就返回hash值和工作量
-		if hashInt.Cmp(pow.target) == -1 {
-			fmt.Printf("\r%x", hash)
-			break
-		} else {
-			nonce ++
-		}
+//nonce空间平均分给workers个协程同时搜索 任意一个找到结果或者ctx被取消时全部停止
+func (pow *ProofOfWork) Run(ctx context.Context, workers int) (int, []byte, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+	found := make(chan result, workers)
+	span := math.MaxInt64 / workers
+	headerData, err := pow.header.Serialize()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stats.begin(workers)
+	defer stats.end()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			var hashInt big.Int
+			var done uint64
+			//每个协程使用自己的区块头副本 只改写其中的nonce
+			data := append([]byte{}, headerData...)
+			//退出时把不足一批的哈希次数也计入统计
+			defer func() { stats.addHashes(done % pow.batch) }()
+			//设置边界 计算以防越界
+			for nonce := start; nonce < end; nonce++ {
+				//每隔一段检查一次是否需要停止 并更新哈希速率统计
+				done++
+				if done%pow.batch == 0 {
+					stats.addHashes(pow.batch)
+					select {
+					case <-ctx.Done():
+						return
+					default:
+					}
+				}
+				//计算出需要求hash的数据并求哈希值
+				binary.BigEndian.PutUint64(data[consensus.NonceOffset:], uint64(nonce))
+				hash := pow.powHash(data)
+				hashInt.SetBytes(hash)
+				//如果算出来的hash比约定的小就返回hash值和工作量
+				if hashInt.Cmp(pow.target) == -1 {
+					found <- result{nonce, hash}
+					cancel()
+					return
+				}
+			}
+		}(i*span, (i+1)*span)
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	res, ok := <-found
+	if !ok {
+		if err := parent.Err(); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, consensus.ErrNonceExhausted
 	}
+	fmt.Printf("\r%x", res.hash)
 	fmt.Print("\n\n")
 
-	return nonce, hash[:]
+	return res.nonce, res.hash, nil
 }
+
 func Int64ToBytes(i int64) []byte {
 	var buf = make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, uint64(i))
@@ -59,22 +123,124 @@ func Int64ToBytes(i int64) []byte {
 }
 
 //检验区块是否合法 如果当前块的hash小于约定值 说明合法
+//目标值本身也必须在(0, limit]范围内
 func (pow *ProofOfWork) IsVaild() bool {
+	if pow.target.Sign() <= 0 || pow.target.Cmp(pow.limit) > 0 {
+		return false
+	}
+	hash, err := pow.hash(pow.header.Nonce)
+	if err != nil {
+		return false
+	}
 	var hashInt big.Int
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	hashInt.SetBytes(hash)
 	return hashInt.Cmp(pow.target) == -1
 }
 
-//将工作量和区块数据打包
-func (pow *ProofOfWork) prepareData(nonce int) (data []byte) {
-	data = bytes.Join([][]byte{
-		pow.block.PrevHash,
-		pow.block.HashTransactions(),
-		Int64ToBytes(pow.block.Timestamp),
-		Int64ToBytes(int64(targetBits)),
-		Int64ToBytes(int64(nonce)),
-	}, []byte{})
-	return
+//用给定的nonce计算区块的工作量证明哈希
+func (pow *ProofOfWork) hash(nonce int) ([]byte, error) {
+	header := *pow.header
+	header.Nonce = nonce
+	data, err := header.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return pow.powHash(data), nil
+}
+
+//工作量证明共识 哈希函数在创建区块链时选定
+type PowEngine struct {
+	hashName string //工作量证明使用的哈希函数 为空时使用netParams.PowHash
+}
+
+func (e *PowEngine) Name() string {
+	return "pow"
+}
+
+//设置工作量证明使用的哈希函数 只在创建或打开区块链时使用
+func (e *PowEngine) SetPowHash(name string) error {
+	if _, err := powhash.Lookup(name); err != nil {
+		return err
+	}
+	e.hashName = name
+	return nil
+}
+
+//工作量证明使用的哈希函数的名称
+func (e *PowEngine) PowHash() string {
+	if e.hashName == "" {
+		return netParams.PowHash
+	}
+	return e.hashName
+}
+
+//按选定的哈希函数创建POW
+func (e *PowEngine) newProofOfWork(header *BlockHeader) *ProofOfWork {
+	name := e.PowHash()
+	powHash, err := powhash.Lookup(name)
+	if err != nil {
+		log.Panic(err)
+	}
+	pow := NewproofOfWork(header, powHash, e.powLimit())
+	if memoryHardPowHashes[name] {
+		pow.batch = slowHashBatchSize
+	}
+	return pow
+}
+
+//哈希函数允许的最大目标值 慢的哈希函数使用更低的最低难度
+func (e *PowEngine) powLimit() *big.Int {
+	if limit, ok := netParams.PowHashLimits[e.PowHash()]; ok {
+		return limit
+	}
+	return netParams.PowLimit
+}
+
+//按父块计算下一块的难度
+func (e *PowEngine) Prepare(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	bits, err := calcNextRequiredBits(chain, header.PrevHash, height, e.powLimit())
+	if err != nil {
+		return err
+	}
+	header.Bits = bits
+	return nil
+}
+
+//多个协程同时寻找满足难度的nonce
+func (e *PowEngine) Seal(ctx context.Context, chain consensus.ChainReader, header *BlockHeader, height int) error {
+	nonce, _, err := e.newProofOfWork(header).Run(ctx, miningWorkers)
+	if err != nil {
+		return err
+	}
+	header.Nonce = nonce
+	return nil
+}
+
+//难度必须与按父块计算出的一致
+func (e *PowEngine) VerifyHeader(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	expected, err := calcNextRequiredBits(chain, header.PrevHash, height, e.powLimit())
+	if err != nil {
+		return err
+	}
+	if header.Bits != expected {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has bits %08x, expected %08x", header.BlockHash(), header.Bits, expected))
+	}
+	return nil
+}
+
+func (e *PowEngine) VerifySeal(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	if !e.newProofOfWork(header).IsVaild() {
+		return ruleError(ErrHighHash, fmt.Sprintf("block %x does not satisfy its proof of work", header.BlockHash()))
+	}
+	return nil
+}
+
+//工作量证明不依赖父块 孤块也要满足区块头中的难度 并且难度不能低于最低难度
+func (e *PowEngine) verifyOrphanSeal(header *BlockHeader) error {
+	return e.VerifySeal(nil, header, 0)
+}
+
+//工作量越大的分支越难伪造
+func (e *PowEngine) CalcWork(chain consensus.ChainReader, header *BlockHeader, height int) *big.Int {
+	return CalcWork(header.Bits)
 }
@@ -0,0 +1,260 @@
+package Block
+
+import (
+	"blockchainlearning/consensus"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+)
+
+var errRaftNoKey = errors.New("No orderer key, cannot sign Raft blocks")
+
+//排序节点 Raft成员的网络地址和签名区块使用的公钥哈希
+type RaftMember struct {
+	Address    string
+	PubKeyHash []byte
+}
+
+//Raft区块头Extra中保存的数据
+type raftExtra struct {
+	Members   []RaftMember //创世块和成员变更区块中记录的变更后的全部排序节点 其他区块为空
+	Term      uint64       //领导者提议区块时的任期
+	PubKey    []byte       //领导者的公钥
+	Signature []byte       //领导者对区块头(不含签名)的签名
+}
+
+func (e *raftExtra) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+func decodeRaftExtra(header *BlockHeader) (*raftExtra, error) {
+	var extra raftExtra
+	decoder := gob.NewDecoder(bytes.NewReader(header.Extra))
+	if err := decoder.Decode(&extra); err != nil {
+		return nil, ruleError(ErrBadSeal, fmt.Sprintf("block %x has malformed Raft extra data", header.BlockHash()))
+	}
+	return &extra, nil
+}
+
+//签名的内容 即去掉签名之后的区块头
+func raftSealHash(header *BlockHeader, extra *raftExtra) []byte {
+	unsigned := *extra
+	unsigned.Signature = nil
+	h := *header
+	h.Extra = unsigned.Serialize()
+	return h.BlockHash()
+}
+
+//Raft排序服务 排序节点通过Raft选出领导者 领导者把交易池中的交易打包成区块写入Raft日志
+//日志提交后所有排序节点按相同的顺序把区块加入主链 只容忍崩溃故障 适用于互相信任的联盟链
+//区块由领导者签名 其他节点据此检查区块来自当前的排序节点
+type RaftEngine struct {
+	genesisSigners   [][]byte //创世块中记录的排序节点公钥哈希
+	genesisAddresses []string //与genesisSigners一一对应的网络地址
+
+	mtx          sync.Mutex
+	key          *ecdsa.PrivateKey //签名使用的私钥
+	pubKey       []byte            //签名使用的公钥
+	term         uint64            //提议区块时的任期
+	nextMembers  []RaftMember      //下一个提议的区块中记录的成员变更
+	cacheHash    []byte            //最近一次查询成员的区块
+	cacheMembers []RaftMember      //该区块之后的排序节点
+}
+
+func (e *RaftEngine) Name() string {
+	return "raft"
+}
+
+//设置创世块中的排序节点(公钥哈希) 只在创建区块链时使用
+func (e *RaftEngine) SetGenesisSigners(signers [][]byte) {
+	e.genesisSigners = signers
+}
+
+//设置创世块中排序节点的网络地址 只在创建区块链时使用
+func (e *RaftEngine) SetGenesisAddresses(addresses []string) {
+	e.genesisAddresses = addresses
+}
+
+//设置签名使用的私钥 公钥哈希必须是某个排序节点的才能出块
+func (e *RaftEngine) Authorize(key ecdsa.PrivateKey) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.key = &key
+	e.pubKey = append(key.PublicKey.X.Bytes(), key.PublicKey.Y.Bytes()...)
+}
+
+//设置下一个提议的区块的任期和成员变更 members为空时不变更成员
+func (e *RaftEngine) setProposal(term uint64, members []RaftMember) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.term = term
+	e.nextMembers = members
+}
+
+//hash对应的区块加入主链之后的排序节点 即它及之前最近一个记录了成员的区块中的成员
+func (e *RaftEngine) memberList(chain consensus.ChainReader, hash []byte) ([]RaftMember, error) {
+	e.mtx.Lock()
+	cacheHash, cacheMembers := e.cacheHash, e.cacheMembers
+	e.mtx.Unlock()
+
+	var members []RaftMember
+	for current := hash; ; {
+		if bytes.Equal(current, cacheHash) {
+			members = cacheMembers
+			break
+		}
+		header, err := chain.GetHeader(current)
+		if err != nil {
+			return nil, err
+		}
+		extra, err := decodeRaftExtra(header)
+		if err != nil {
+			return nil, err
+		}
+		if len(extra.Members) > 0 || len(header.PrevHash) == 0 {
+			members = extra.Members
+			break
+		}
+		current = header.PrevHash
+	}
+
+	e.mtx.Lock()
+	e.cacheHash, e.cacheMembers = hash, members
+	e.mtx.Unlock()
+	return members, nil
+}
+
+func raftAddresses(members []RaftMember) []string {
+	var addresses []string
+	for _, member := range members {
+		addresses = append(addresses, member.Address)
+	}
+	return addresses
+}
+
+//所有区块的难度都是1 创世块记录初始的排序节点
+func (e *RaftEngine) Prepare(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	header.Nonce = 0
+	header.Bits = 1
+	if height == 0 {
+		if len(e.genesisSigners) != len(e.genesisAddresses) {
+			return errors.New("Every Raft orderer needs both an address and a signer")
+		}
+		var members []RaftMember
+		for i, signer := range e.genesisSigners {
+			members = append(members, RaftMember{e.genesisAddresses[i], signer})
+		}
+		header.Extra = (&raftExtra{Members: members}).Serialize()
+		return nil
+	}
+	e.mtx.Lock()
+	header.Extra = (&raftExtra{Members: e.nextMembers, Term: e.term, PubKey: e.pubKey}).Serialize()
+	e.mtx.Unlock()
+	return nil
+}
+
+//领导者用私钥签名区块
+func (e *RaftEngine) Seal(ctx context.Context, chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块不需要签名
+	if height == 0 {
+		return nil
+	}
+	e.mtx.Lock()
+	key := e.key
+	e.mtx.Unlock()
+	if key == nil {
+		return errRaftNoKey
+	}
+	extra, err := decodeRaftExtra(header)
+	if err != nil {
+		return err
+	}
+	signature, err := signHash(*key, raftSealHash(header, extra))
+	if err != nil {
+		return err
+	}
+	extra.Signature = signature
+	header.Extra = extra.Serialize()
+	return nil
+}
+
+//检查难度和区块中记录的排序节点
+func (e *RaftEngine) VerifyHeader(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	extra, err := decodeRaftExtra(header)
+	if err != nil {
+		return err
+	}
+	if header.Bits != 1 {
+		return ruleError(ErrBadBits, fmt.Sprintf("block %x has Raft difficulty %d", header.BlockHash(), header.Bits))
+	}
+	if height == 0 && len(extra.Members) == 0 {
+		return ruleError(ErrBadVote, fmt.Sprintf("genesis block %x has no Raft orderers", header.BlockHash()))
+	}
+	addresses := make(map[string]bool)
+	for _, member := range extra.Members {
+		if addresses[member.Address] || len(member.PubKeyHash) != 20 {
+			return ruleError(ErrBadVote, fmt.Sprintf("block %x has an invalid Raft orderer list", header.BlockHash()))
+		}
+		addresses[member.Address] = true
+	}
+	return nil
+}
+
+//检查区块是否由父块之后的排序节点签名
+func (e *RaftEngine) VerifySeal(chain consensus.ChainReader, header *BlockHeader, height int) error {
+	//创世块没有签名
+	if height == 0 {
+		return nil
+	}
+	extra, err := decodeRaftExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, raftSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	members, err := e.memberList(chain, header.PrevHash)
+	if err != nil {
+		return err
+	}
+	signer := HashPubKey(extra.PubKey)
+	for _, member := range members {
+		if bytes.Equal(member.PubKeyHash, signer) {
+			return nil
+		}
+	}
+	return ruleError(ErrUnauthorizedSigner, fmt.Sprintf("block %x is signed by %x, which is not a Raft orderer", header.BlockHash(), signer))
+}
+
+//孤块的父块未知 只能检查区块头中的签名
+func (e *RaftEngine) verifyOrphanSeal(header *BlockHeader) error {
+	extra, err := decodeRaftExtra(header)
+	if err != nil {
+		return err
+	}
+	if !verifyHashSignature(extra.PubKey, extra.Signature, raftSealHash(header, extra)) {
+		return ruleError(ErrBadSeal, fmt.Sprintf("block %x has an invalid signature", header.BlockHash()))
+	}
+	return nil
+}
+
+func (e *RaftEngine) CalcWork(chain consensus.ChainReader, header *BlockHeader, height int) *big.Int {
+	return big.NewInt(1)
+}
+
+//区块在多数排序节点写入日志之后才会加入主链 所以都是最终确定的
+func (e *RaftEngine) isFinal(block *Block) bool {
+	return true
+}
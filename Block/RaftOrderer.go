@@ -0,0 +1,265 @@
+package Block
+
+import (
+	"blockchainlearning/raft"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//Raft的心跳间隔和选举超时 以逻辑时钟的间隔为单位
+const (
+	raftHeartbeatTicks = 2
+	raftElectionTicks  = 10
+)
+
+var errRaftBusy = errors.New("Another block is being ordered, try again later")
+
+//Raft快照的内容 即主链上从创世块开始的全部区块
+type raftSnapshot struct {
+	Blocks [][]byte
+}
+
+//Raft排序节点 领导者把交易池中的交易打包成区块写入Raft日志 日志提交后加入主链
+//同一时间只有一个区块在排序 它加入主链之后才打包下一个区块
+type raftOrderer struct {
+	mtx      sync.Mutex
+	bc       *BlockChain
+	engine   *RaftEngine
+	node     *raft.Node
+	proposed []byte //正在排序的区块hash
+	parent   []byte //正在排序的区块的父块
+	term     uint64 //提议正在排序的区块时的任期
+	applied  func(block *Block)
+}
+
+//创建排序节点并开始运行Raft 状态和区块链保存在同一个数据库中
+//日志和快照中没有成员变更时 使用链上记录的排序节点作为初始成员
+func newRaftOrderer(bc *BlockChain, engine *RaftEngine, id string, transport raft.Transport, applied func(block *Block)) (*raftOrderer, error) {
+	storage, err := raft.NewStorage(bc.DB)
+	if err != nil {
+		return nil, err
+	}
+	members, err := engine.memberList(bc, bc.TipHash())
+	if err != nil {
+		return nil, err
+	}
+	o := &raftOrderer{bc: bc, engine: engine, applied: applied}
+	o.node, err = raft.NewNode(raft.Config{
+		ID:              id,
+		Peers:           raftAddresses(members),
+		HeartbeatTicks:  raftHeartbeatTicks,
+		ElectionTicks:   raftElectionTicks,
+		SnapshotEntries: uint64(netParams.RaftSnapshotBlocks),
+		Apply:           o.apply,
+		Snapshot:        o.snapshot,
+		Restore:         o.restore,
+	}, storage, transport)
+	if err != nil {
+		return nil, err
+	}
+	go o.run()
+	return o, nil
+}
+
+//推进Raft的逻辑时钟 领导者每个间隔把交易池中的交易打包一次
+func (o *raftOrderer) run() {
+	ticker := time.NewTicker(time.Duration(netParams.RaftTickInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		o.node.Tick()
+		o.tryPropose()
+	}
+}
+
+//交易池中有新的交易 领导者立即打包
+func (o *raftOrderer) requestReceived() {
+	o.tryPropose()
+}
+
+func (o *raftOrderer) step(msg raft.Message) {
+	o.node.Step(msg)
+}
+
+//在链尾上打包交易池中的交易 members不为空时区块同时记录成员变更
+func (o *raftOrderer) newBlock(members []RaftMember) (*Block, error) {
+	tip, err := o.bc.GetBlock(o.bc.TipHash())
+	if err != nil {
+		return nil, err
+	}
+	txs, fees := selectMempoolTransactions(o.bc)
+	cbTx := NewCoinbaseTX(miningAddress, "", tip.Height+1, fees)
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	timestamp := AdjustedTime()
+	if medianTime := o.bc.CalcPastMedianTime(&tip); timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+	o.term = o.node.Term()
+	o.engine.setProposal(o.term, members)
+	block, err := o.bc.MineNewBlock(context.Background(), txs, tip.Hash, tip.Height+1, timestamp)
+	o.engine.setProposal(o.term, nil)
+	return block, err
+}
+
+//没有区块在排序时可以提议新的区块 领导者换届后之前提议的区块可能丢失
+func (o *raftOrderer) idle() bool {
+	return o.proposed == nil || o.term != o.node.Term() || !bytes.Equal(o.parent, o.bc.TipHash())
+}
+
+//领导者把交易池中的交易打包成区块写入Raft日志
+func (o *raftOrderer) tryPropose() {
+	o.mtx.Lock()
+	if !o.node.IsLeader() || mempoolSize() == 0 || !o.idle() {
+		o.mtx.Unlock()
+		return
+	}
+	block, err := o.newBlock(nil)
+	if err != nil {
+		o.mtx.Unlock()
+		fmt.Printf("Raft proposal failed: %s\n", err)
+		return
+	}
+	o.proposed, o.parent = block.Hash, block.PrevHash
+	term := o.term
+	o.mtx.Unlock()
+
+	//提交的区块可能在Propose中就被应用 所以在锁外调用
+	fmt.Printf("Proposing block %x at height %d in term %d\n", block.Hash, block.Height, term)
+	if err := o.node.Propose(block.Serialize()); err != nil {
+		fmt.Printf("Raft proposal failed: %s\n", err)
+	}
+}
+
+//address是否是当前的排序节点
+func (o *raftOrderer) isMember(address string) bool {
+	for _, peer := range o.node.Peers() {
+		if peer == address {
+			return true
+		}
+	}
+	return false
+}
+
+//领导者增加(add为true)或者删除一个排序节点 变更记录在一个区块中和它一起排序
+//其他节点返回raft.ErrNotLeader 由调用者转发给领导者
+func (o *raftOrderer) changeMembers(add bool, address string, pubKeyHash []byte) error {
+	o.mtx.Lock()
+	if !o.node.IsLeader() {
+		o.mtx.Unlock()
+		return raft.ErrNotLeader
+	}
+	if !o.idle() {
+		o.mtx.Unlock()
+		return errRaftBusy
+	}
+	members, err := o.engine.memberList(o.bc, o.bc.TipHash())
+	if err != nil {
+		o.mtx.Unlock()
+		return err
+	}
+	var changed []RaftMember
+	for _, member := range members {
+		if member.Address != address {
+			changed = append(changed, member)
+		}
+	}
+	if add {
+		changed = append(changed, RaftMember{address, pubKeyHash})
+	}
+	if len(changed) == 0 {
+		o.mtx.Unlock()
+		return errors.New("Cannot remove the last Raft orderer")
+	}
+	block, err := o.newBlock(changed)
+	if err != nil {
+		o.mtx.Unlock()
+		return err
+	}
+	o.proposed, o.parent = block.Hash, block.PrevHash
+	o.mtx.Unlock()
+
+	if err := o.node.ProposeConfig(raftAddresses(changed), block.Serialize()); err != nil {
+		o.mtx.Lock()
+		o.proposed = nil
+		o.mtx.Unlock()
+		return err
+	}
+	fmt.Printf("Proposing orderers %v in block %x\n", raftAddresses(changed), block.Hash)
+	return nil
+}
+
+//应用提交的区块 所有排序节点按相同的顺序应用 只有延长链尾的区块才会加入主链
+//已经通过区块同步加入的区块直接跳过 领导者在过期的链尾上提议的区块被所有节点丢弃
+func (o *raftOrderer) apply(entry raft.Entry) {
+	block := DeserializeBlock(entry.Data)
+	if o.bc.HasBlock(block.Hash) {
+		return
+	}
+	var err error
+	if !bytes.Equal(block.PrevHash, o.bc.TipHash()) {
+		err = errors.New("it does not extend the chain tip")
+	} else {
+		err = o.bc.AddBlock(block)
+	}
+
+	o.mtx.Lock()
+	if bytes.Equal(o.proposed, block.Hash) {
+		o.proposed = nil
+	}
+	o.mtx.Unlock()
+
+	if err != nil {
+		fmt.Printf("Discarded ordered block %x: %s\n", block.Hash, err)
+		return
+	}
+	fmt.Printf("Added ordered block %x\n", block.Hash)
+	processOrphans(o.bc, block.Hash)
+	o.applied(block)
+}
+
+//用主链上的全部区块生成快照
+func (o *raftOrderer) snapshot() ([]byte, error) {
+	var snapshot raftSnapshot
+	bci := o.bc.Iterator()
+	for {
+		block := bci.Next()
+		snapshot.Blocks = append([][]byte{block.Serialize()}, snapshot.Blocks...)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	if err := encoder.Encode(snapshot); err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes(), nil
+}
+
+//落后太多的排序节点用领导者的快照补齐缺少的区块
+func (o *raftOrderer) restore(s raft.Snapshot) {
+	var snapshot raftSnapshot
+	decoder := gob.NewDecoder(bytes.NewReader(s.Data))
+	if err := decoder.Decode(&snapshot); err != nil {
+		fmt.Printf("Rejected malformed Raft snapshot: %s\n", err)
+		return
+	}
+	for _, data := range snapshot.Blocks {
+		block := DeserializeBlock(data)
+		if o.bc.HasBlock(block.Hash) {
+			continue
+		}
+		if err := o.bc.AddBlock(block); err != nil {
+			fmt.Printf("Rejected snapshot block %x: %s\n", block.Hash, err)
+			return
+		}
+		o.applied(block)
+	}
+	fmt.Printf("Restored Raft snapshot at index %d\n", s.Index)
+}
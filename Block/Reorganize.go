@@ -0,0 +1,123 @@
+package Block
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+//连接到主链时失败的区块 以及它们在分支上的后代 这些块不会再被选为主链
+//键：区块hash   值：1
+const invalidBucket = "invalid"
+
+//在数据库事务中判断区块是否被标记为无效
+func isInvalidBlock(tx *bolt.Tx, hash []byte) bool {
+	b := tx.Bucket([]byte(invalidBucket))
+	return b != nil && b.Get(hash) != nil
+}
+
+//把区块标记为无效 连接失败时区块所在的数据库事务已经回滚 所以在新的事务中记录
+func (bc *BlockChain) markInvalidBlocks(hashes [][]byte) {
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(invalidBucket))
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := b.Put(hash, []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//区块hash的列表
+func blockHashes(blocks []*Block) [][]byte {
+	var hashes [][]byte
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes
+}
+
+//在数据库事务中读取区块 不存在时返回nil
+func blockFromTx(tx *bolt.Tx, hash []byte) *Block {
+	if len(hash) == 0 {
+		return nil
+	}
+	blockData := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if blockData == nil {
+		return nil
+	}
+	return DeserializeBlock(blockData)
+}
+
+//将主链从oldTip切换到以newTip结尾的分支
+//先从旧链尾一直断开到分叉点 再依次连接新分支上的区块
+//任何一步失败都会返回错误 整个数据库事务随之回滚
+//新分支上的区块无效或者连接失败时 invalid返回这个区块和它在新分支上的后代
+func (bc *BlockChain) reorganize(tx *bolt.Tx, oldTip []byte, newTip *Block) (connected, disconnected []*Block, invalid [][]byte, err error) {
+	oldBlock := blockFromTx(tx, oldTip)
+	newBlock := newTip
+
+	//新分支上需要连接的块 从新到旧
+	var attach []*Block
+	for newBlock.Height > oldBlock.Height {
+		attach = append(attach, newBlock)
+		if newBlock = blockFromTx(tx, newBlock.PrevHash); newBlock == nil {
+			return nil, nil, nil, fmt.Errorf("side chain of %x is not linked to genesis", newTip.Hash)
+		}
+	}
+	for oldBlock.Height > newBlock.Height {
+		disconnected = append(disconnected, oldBlock)
+		oldBlock = blockFromTx(tx, oldBlock.PrevHash)
+	}
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		disconnected = append(disconnected, oldBlock)
+		attach = append(attach, newBlock)
+		oldBlock = blockFromTx(tx, oldBlock.PrevHash)
+		if newBlock = blockFromTx(tx, newBlock.PrevHash); newBlock == nil || oldBlock == nil {
+			return nil, nil, nil, fmt.Errorf("no fork point between %x and %x", oldTip, newTip.Hash)
+		}
+	}
+
+	//最终确定的区块不能被断开
+	if final := finalBlockFromTx(tx); final != nil && oldBlock.Height < final.Height {
+		return nil, nil, nil, ruleError(ErrFinalityConflict, fmt.Sprintf("reorganization to %x would revert the final block %x at height %d",
+			newTip.Hash, final.Hash, final.Height))
+	}
+
+	//新分支上已经被标记为无效的区块 它的后代同样无效
+	for i := len(attach) - 1; i >= 0; i-- {
+		if isInvalidBlock(tx, attach[i].Hash) {
+			return nil, nil, blockHashes(attach[:i+1]), ruleError(ErrInvalidAncestor, fmt.Sprintf("block %x on the branch of %x is invalid",
+				attach[i].Hash, newTip.Hash))
+		}
+	}
+
+	fmt.Printf("Reorganizing at fork %x: disconnecting %d blocks, connecting %d blocks\n",
+		oldBlock.Hash, len(disconnected), len(attach))
+
+	utxoSet := UTXOSet{bc}
+	for _, block := range disconnected {
+		if err = utxoSet.disconnectBlock(tx, block); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		if err = utxoSet.connectBlock(tx, attach[i]); err != nil {
+			if _, ok := err.(RuleError); ok {
+				invalid = blockHashes(attach[:i+1])
+			}
+			return nil, nil, invalid, err
+		}
+		connected = append(connected, attach[i])
+	}
+	return connected, disconnected, nil, nil
+}
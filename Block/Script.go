@@ -0,0 +1,397 @@
+package Block
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//脚本操作码 编码与比特币相同 只实现了其中的一部分
+const (
+	Op0         = 0x00 //压入空字节串 即false
+	OpPushData1 = 0x4c //之后1字节是数据长度
+	OpPushData2 = 0x4d //之后2字节(小端)是数据长度
+	Op1Negate   = 0x4f
+	OpReserved  = 0x50 //保留的操作码 执行时失败
+	Op1         = 0x51 //Op1到Op16压入数字1到16
+	Op16        = 0x60
+	OpNop       = 0x61
+	OpIf        = 0x63
+	OpNotIf     = 0x64
+	OpElse      = 0x67
+	OpEndIf     = 0x68
+	OpVerify    = 0x69
+	OpReturn    = 0x6a
+
+	OpDrop = 0x75
+	OpDup  = 0x76
+	OpOver = 0x78
+	OpSwap = 0x7c
+	OpSize = 0x82
+
+	OpEqual       = 0x87
+	OpEqualVerify = 0x88
+
+	Op1Add               = 0x8b
+	Op1Sub               = 0x8c
+	OpNot                = 0x91
+	Op0NotEqual          = 0x92
+	OpAdd                = 0x93
+	OpSub                = 0x94
+	OpBoolAnd            = 0x9a
+	OpBoolOr             = 0x9b
+	OpNumEqual           = 0x9c
+	OpNumEqualVerify     = 0x9d
+	OpLessThan           = 0x9f
+	OpGreaterThan        = 0xa0
+	OpLessThanOrEqual    = 0xa1
+	OpGreaterThanOrEqual = 0xa2
+	OpMin                = 0xa3
+	OpMax                = 0xa4
+	OpWithin             = 0xa5
+
+	OpRipemd160      = 0xa6
+	OpSha256         = 0xa8
+	OpHash160        = 0xa9 //与HashPubKey相同 先SHA-256再RIPEMD-160
+	OpHash256        = 0xaa
+	OpCheckSig       = 0xac
+	OpCheckSigVerify = 0xad
+
+	OpCheckMultiSig       = 0xae
+	OpCheckMultiSigVerify = 0xaf
+
+	OpCheckLockTimeVerify = 0xb1 //交易的锁定时间不早于栈顶的值
+	OpCheckSequenceVerify = 0xb2 //输入的相对锁定不短于栈顶的值
+)
+
+var opcodeNames = map[byte]string{
+	Op0:         "OP_0",
+	OpPushData1: "OP_PUSHDATA1",
+	OpPushData2: "OP_PUSHDATA2",
+	Op1Negate:   "OP_1NEGATE",
+	OpReserved:  "OP_RESERVED",
+	OpNop:       "OP_NOP",
+	OpIf:        "OP_IF",
+	OpNotIf:     "OP_NOTIF",
+	OpElse:      "OP_ELSE",
+	OpEndIf:     "OP_ENDIF",
+	OpVerify:    "OP_VERIFY",
+	OpReturn:    "OP_RETURN",
+
+	OpDrop: "OP_DROP",
+	OpDup:  "OP_DUP",
+	OpOver: "OP_OVER",
+	OpSwap: "OP_SWAP",
+	OpSize: "OP_SIZE",
+
+	OpEqual:       "OP_EQUAL",
+	OpEqualVerify: "OP_EQUALVERIFY",
+
+	Op1Add:               "OP_1ADD",
+	Op1Sub:               "OP_1SUB",
+	OpNot:                "OP_NOT",
+	Op0NotEqual:          "OP_0NOTEQUAL",
+	OpAdd:                "OP_ADD",
+	OpSub:                "OP_SUB",
+	OpBoolAnd:            "OP_BOOLAND",
+	OpBoolOr:             "OP_BOOLOR",
+	OpNumEqual:           "OP_NUMEQUAL",
+	OpNumEqualVerify:     "OP_NUMEQUALVERIFY",
+	OpLessThan:           "OP_LESSTHAN",
+	OpGreaterThan:        "OP_GREATERTHAN",
+	OpLessThanOrEqual:    "OP_LESSTHANOREQUAL",
+	OpGreaterThanOrEqual: "OP_GREATERTHANOREQUAL",
+	OpMin:                "OP_MIN",
+	OpMax:                "OP_MAX",
+	OpWithin:             "OP_WITHIN",
+
+	OpRipemd160:      "OP_RIPEMD160",
+	OpSha256:         "OP_SHA256",
+	OpHash160:        "OP_HASH160",
+	OpHash256:        "OP_HASH256",
+	OpCheckSig:       "OP_CHECKSIG",
+	OpCheckSigVerify: "OP_CHECKSIGVERIFY",
+
+	OpCheckMultiSig:       "OP_CHECKMULTISIG",
+	OpCheckMultiSigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+	OpCheckSequenceVerify: "OP_CHECKSEQUENCEVERIFY",
+}
+
+//解析后的一条指令 压入数据的指令带有数据
+type parsedOpcode struct {
+	opcode byte
+	data   []byte
+}
+
+//是否为压入数据或者数字的指令
+func (pop *parsedOpcode) isPush() bool {
+	op := pop.opcode
+	return op <= OpPushData2 || op == Op1Negate || (op >= Op1 && op <= Op16)
+}
+
+//把脚本解析成指令序列 数据长度超出脚本末尾时返回错误
+func parseScript(script []byte) ([]parsedOpcode, error) {
+	var pops []parsedOpcode
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+		length := 0
+		switch {
+		case op > Op0 && op < OpPushData1:
+			length = int(op)
+		case op == OpPushData1:
+			if i+1 > len(script) {
+				return nil, errors.New("OP_PUSHDATA1 is missing its length")
+			}
+			length = int(script[i])
+			i++
+		case op == OpPushData2:
+			if i+2 > len(script) {
+				return nil, errors.New("OP_PUSHDATA2 is missing its length")
+			}
+			length = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+length > len(script) {
+			return nil, fmt.Errorf("push of %d bytes exceeds the end of the script", length)
+		}
+		pop := parsedOpcode{opcode: op}
+		if op < Op1Negate {
+			pop.data = script[i : i+length]
+		}
+		pops = append(pops, pop)
+		i += length
+	}
+	return pops, nil
+}
+
+//脚本是否只包含压入数据的指令 解锁脚本只能压入数据
+func isPushOnly(pops []parsedOpcode) bool {
+	for i := range pops {
+		if !pops[i].isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+//把脚本转换成可读的形式 数据以十六进制显示
+func DisasmScript(script []byte) (string, error) {
+	pops, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, pop := range pops {
+		switch {
+		case pop.opcode > Op0 && pop.opcode <= OpPushData2:
+			parts = append(parts, hex.EncodeToString(pop.data))
+		case pop.opcode >= Op1 && pop.opcode <= Op16:
+			parts = append(parts, fmt.Sprintf("OP_%d", pop.opcode-Op1+1))
+		case opcodeNames[pop.opcode] != "":
+			parts = append(parts, opcodeNames[pop.opcode])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN%d", pop.opcode))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+//按顺序拼接指令生成脚本
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+//用最短的指令压入数据
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch length := len(data); {
+	case length < OpPushData1:
+		b.script = append(b.script, byte(length))
+	case length <= 0xff:
+		b.script = append(b.script, OpPushData1, byte(length))
+	default:
+		b.script = append(b.script, OpPushData2, byte(length), byte(length>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+//压入数字 -1和0到16使用单字节的操作码
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(Op0)
+	case n == -1:
+		return b.AddOp(Op1Negate)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(Op1 - 1 + n))
+	}
+	return b.AddData(scriptNum(n).Bytes())
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+//脚本中的数字 按小端存储 最高字节的最高位是符号位
+type scriptNum int64
+
+func (n scriptNum) Bytes() []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	//最高位已被占用时增加一个字节存放符号
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+//解析栈上的数字 长度不能超过maxLen字节
+func makeScriptNum(v []byte, maxLen int) (scriptNum, error) {
+	if len(v) > maxLen {
+		return 0, fmt.Errorf("numeric value of %d bytes exceeds the limit of %d", len(v), maxLen)
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	var result int64
+	for i, b := range v {
+		result |= int64(b) << uint(8*i)
+	}
+	if v[len(v)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(v)-1)))
+		return scriptNum(-result), nil
+	}
+	return scriptNum(result), nil
+}
+
+//付款给公钥哈希的标准脚本
+//OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func payToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpDup).AddOp(OpHash160).AddData(pubKeyHash).
+		AddOp(OpEqualVerify).AddOp(OpCheckSig).Script()
+}
+
+//付款给脚本哈希的标准脚本 花费时在解锁脚本的最后压入哈希对应的赎回脚本
+//OP_HASH160 <scriptHash> OP_EQUAL
+func payToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpHash160).AddData(scriptHash).AddOp(OpEqual).Script()
+}
+
+//如果是付款给脚本哈希的标准脚本 返回其中的脚本哈希 否则返回nil
+func extractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OpHash160 && script[1] == 20 && script[22] == OpEqual {
+		return script[2:22]
+	}
+	return nil
+}
+
+//花费公钥哈希输出的解锁脚本 <signature> <pubKey>
+func payToPubKeyHashSigScript(signature, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+//如果是付款给公钥哈希的标准脚本 返回其中的公钥哈希 否则返回nil
+func extractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OpDup && script[1] == OpHash160 && script[2] == 20 &&
+		script[23] == OpEqualVerify && script[24] == OpCheckSig {
+		return script[3:23]
+	}
+	return nil
+}
+
+//解锁脚本压入的数据 脚本不是只压入数据时返回nil
+func pushedData(script []byte) [][]byte {
+	pops, err := parseScript(script)
+	if err != nil || !isPushOnly(pops) {
+		return nil
+	}
+	var data [][]byte
+	for _, pop := range pops {
+		data = append(data, pop.data)
+	}
+	return data
+}
+
+//M-of-N多重签名的锁定脚本 需要pubKeys中required个公钥的签名才能花费
+//<M> <pubKey1> ... <pubKeyN> <N> OP_CHECKMULTISIG
+//标准脚本用OP_1到OP_16表示M和N 所以最多16个公钥
+func multiSigScript(required int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > 16 {
+		return nil, fmt.Errorf("multisig needs 1 to 16 public keys, got %d", len(pubKeys))
+	}
+	if required < 1 || required > len(pubKeys) {
+		return nil, fmt.Errorf("multisig cannot require %d of %d signatures", required, len(pubKeys))
+	}
+	builder := NewScriptBuilder().AddInt64(int64(required))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	return builder.AddInt64(int64(len(pubKeys))).AddOp(OpCheckMultiSig).Script(), nil
+}
+
+//依次压入data中每一项的脚本
+//花费多重签名输出的解锁脚本就是按公钥的顺序压入签名 <signature1> ... <signatureM>
+func pushDataScript(data [][]byte) []byte {
+	builder := NewScriptBuilder()
+	for _, item := range data {
+		builder.AddData(item)
+	}
+	return builder.Script()
+}
+
+//如果是多重签名的标准脚本 返回需要的签名数和全部公钥 否则返回0和nil
+func extractMultiSig(script []byte) (int, [][]byte) {
+	pops, err := parseScript(script)
+	if err != nil || len(pops) < 4 || pops[len(pops)-1].opcode != OpCheckMultiSig {
+		return 0, nil
+	}
+	smallInt := func(pop parsedOpcode) int {
+		if pop.opcode < Op1 || pop.opcode > Op16 {
+			return 0
+		}
+		return int(pop.opcode - Op1 + 1)
+	}
+	required := smallInt(pops[0])
+	keys := pops[1 : len(pops)-2]
+	if required == 0 || smallInt(pops[len(pops)-2]) != len(keys) || required > len(keys) {
+		return 0, nil
+	}
+	var pubKeys [][]byte
+	for _, pop := range keys {
+		if pop.opcode == Op0 || pop.opcode > OpPushData2 {
+			return 0, nil
+		}
+		pubKeys = append(pubKeys, pop.data)
+	}
+	return required, pubKeys
+}
@@ -0,0 +1,98 @@
+package Block
+
+import (
+	"testing"
+)
+
+func TestMultiSig(t *testing.T) {
+	wallets := []*Wallet{newTestWallet(), newTestWallet(), newTestWallet()}
+	var pubKeys [][]byte
+	for _, w := range wallets {
+		pubKeys = append(pubKeys, w.PublickKey)
+	}
+	lock, err := multiSigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := testSpendTx(0, maxTxInSequenceNum)
+	var sigs [][]byte
+	for _, w := range wallets {
+		sigs = append(sigs, testSign(t, w, tx, lock))
+	}
+	outsider := testSign(t, newTestWallet(), tx, lock)
+
+	tests := []struct {
+		name      string
+		sigs      [][]byte
+		errSubstr string
+	}{
+		{"keys 1 and 2", [][]byte{sigs[0], sigs[1]}, ""},
+		{"keys 1 and 3", [][]byte{sigs[0], sigs[2]}, ""},
+		{"keys 2 and 3", [][]byte{sigs[1], sigs[2]}, ""},
+		{"extra signature below the required ones", [][]byte{sigs[2], sigs[0], sigs[1]}, ""},
+		{"out of order", [][]byte{sigs[1], sigs[0]}, "evaluated to false"},
+		{"out of order 3 and 1", [][]byte{sigs[2], sigs[0]}, "evaluated to false"},
+		{"duplicated signature", [][]byte{sigs[0], sigs[0]}, "evaluated to false"},
+		{"signature of another key", [][]byte{sigs[0], outsider}, "evaluated to false"},
+		{"too few signatures", [][]byte{sigs[0]}, "requires 2 signatures but only 1 are provided"},
+		{"no signatures", nil, "requires 2 signatures but only 0 are provided"},
+	}
+	for _, test := range tests {
+		tx.Vin[0].ScriptSig = pushDataScript(test.sigs)
+		checkScript(t, test.name, tx, lock, test.errSubstr)
+	}
+}
+
+func TestMultiSigScriptBounds(t *testing.T) {
+	pubKeys := [][]byte{newTestWallet().PublickKey, newTestWallet().PublickKey}
+	tests := []struct {
+		required int
+		pubKeys  [][]byte
+		valid    bool
+	}{
+		{1, pubKeys, true},
+		{2, pubKeys, true},
+		{0, pubKeys, false},
+		{3, pubKeys, false},
+		{1, nil, false},
+		{1, make([][]byte, 17), false},
+	}
+	for _, test := range tests {
+		_, err := multiSigScript(test.required, test.pubKeys)
+		if (err == nil) != test.valid {
+			t.Errorf("multiSigScript(%d, %d keys) returned %v", test.required, len(test.pubKeys), err)
+		}
+	}
+}
+
+func TestPayToScriptHash(t *testing.T) {
+	first, second := newTestWallet(), newTestWallet()
+	redeem, err := multiSigScript(2, [][]byte{first.PublickKey, second.PublickKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := multiSigScript(1, [][]byte{first.PublickKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := payToScriptHashScript(HashPubKey(redeem))
+	tx := testSpendTx(0, maxTxInSequenceNum)
+	sig1, sig2 := testSign(t, first, tx, redeem), testSign(t, second, tx, redeem)
+
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		errSubstr string
+	}{
+		{"matching redeem script", pushDataScript([][]byte{sig1, sig2, redeem}), ""},
+		{"redeem script with another hash", pushDataScript([][]byte{testSign(t, first, tx, other), other}), "input 0: script evaluated to false"},
+		{"missing redeem script", pushDataScript([][]byte{sig1, sig2}), "input 0: script evaluated to false"},
+		{"redeem script not satisfied", pushDataScript([][]byte{sig2, sig1, redeem}), "redeem script evaluated to false"},
+		{"signatures over the locking script", pushDataScript([][]byte{testSign(t, first, tx, lock), testSign(t, second, tx, lock), redeem}), "redeem script evaluated to false"},
+		{"redeem script run directly in scriptSig", append(pushDataScript([][]byte{sig1, sig2}), redeem...), "not push only"},
+	}
+	for _, test := range tests {
+		tx.Vin[0].ScriptSig = test.scriptSig
+		checkScript(t, test.name, tx, lock, test.errSubstr)
+	}
+}
@@ -1,6 +1,8 @@
 package Block
 
 import (
+	"blockchainlearning/consensus"
+	"blockchainlearning/raft"
 	"io"
 	"fmt"
 	"net"
@@ -9,12 +11,17 @@ import (
 	"bytes"
 	"io/ioutil"
 	"encoding/hex"
+	"context"
+	"errors"
+	"sync"
+	"time"
 )
 
 type Version struct {
 	Version    int
 	BestHeight int
 	AddFrom    string
+	Timestamp  int64 //发送方的本地时间 用于计算网络调整时间
 }
 
 
@@ -45,10 +52,36 @@ type getblocks struct {
 	AddrFrom string
 }
 
+type getheaders struct {
+	AddrFrom string
+}
+
+type headers struct {
+	AddrFrom string
+	Headers  [][]byte //主链上从创世块开始的区块头
+}
+
 type addr struct {
 	AddrList []string
 }
 
+type pbft struct {
+	AddrFrom string
+	Message  []byte
+}
+
+type raftmsg struct {
+	AddrFrom string
+	Message  []byte
+}
+
+type raftconf struct {
+	AddrFrom   string
+	Add        bool
+	Address    string
+	PubKeyHash []byte
+}
+
 
 const protocol = "tcp"
 const nodeVersion = 1
@@ -58,10 +91,28 @@ var nodeAddress string
 var miningAddress string
 var knownNodes = []string{"localhost:3000"}
 var blocksInTransit = [][]byte{}
-var mempool = make(map[string]Transaction)
+
+//PBFT验证者节点的副本 其他节点为nil
+var replica *pbftReplica
+
+//Raft排序节点 其他节点为nil
+var orderer *raftOrderer
+
+//最多记录多少条收到过的PBFT消息
+const maxSeenPbft = 10000
+
+//已经收到过的PBFT消息 每条消息只转发一次
+var seenPbft = make(map[string]bool)
+var seenPbftMtx sync.Mutex
+
+//挖矿状态 miningCancel用于取消正在进行的挖矿
+var miningMtx sync.Mutex
+var miningActive bool
+var miningCancel context.CancelFunc
 
 //通过节点ID和主地址启动服务
-func StartServer(nodeID, minerAddress string) {
+//proposals是PoA中本节点出块时投票加入(true)或者移除(false)的签名者地址
+func StartServer(nodeID, minerAddress string, proposals map[string]bool) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	miningAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
@@ -71,6 +122,39 @@ func StartServer(nodeID, minerAddress string) {
 	defer ln.Close()
 
 	bc := NewBlockchain(nodeID)
+	//需要签名出块的共识使用挖矿地址对应的钱包
+	if signer, ok := bc.engine.(consensus.Signer); ok && len(minerAddress) > 0 {
+		wallets, err := NewWallets(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		wallet, ok := wallets.Wallets[minerAddress]
+		if !ok {
+			log.Panic("ERROR: Miner address is not in the wallet file")
+		}
+		signer.Authorize(wallet.PrivateKey)
+	}
+	if poa, ok := bc.engine.(*PoaEngine); ok {
+		for address, authorize := range proposals {
+			pubKeyHash := Base58Decode([]byte(address))
+			poa.Propose(pubKeyHash[1:len(pubKeyHash)-4], authorize)
+		}
+	}
+	//PBFT的验证者通过三阶段提交产生区块 而不是各自挖矿
+	if engine, ok := bc.engine.(*PbftEngine); ok && len(minerAddress) > 0 {
+		replica = newPbftReplica(bc, engine, broadcastPbft, func(block *Block) {
+			announceBlock(block.Hash)
+		})
+	}
+	//Raft的排序节点由领导者打包区块 其他排序节点复制日志
+	if engine, ok := bc.engine.(*RaftEngine); ok && len(minerAddress) > 0 {
+		orderer, err = newRaftOrderer(bc, engine, nodeAddress, raftTransport{}, func(block *Block) {
+			announceBlock(block.Hash)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
 	if nodeAddress != knownNodes[0] {
 		sendVersion(knownNodes[0], bc)
 	}
@@ -87,7 +171,7 @@ func StartServer(nodeID, minerAddress string) {
 //发送版本
 func sendVersion(addr string, bc *BlockChain) {
 	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(Version{nodeVersion, bestHeight, nodeAddress})
+	payload := gobEncode(Version{nodeVersion, bestHeight, nodeAddress, time.Now().Unix()})
 	request := append(commandToBytes("version"), payload...)
 	sendData(addr, request)
 }
@@ -109,12 +193,22 @@ func handleConnection(conn net.Conn, bc *BlockChain) {
 		handleInv(request, bc)
 	case "getblocks":
 		handleGetBlocks(request, bc)
+	case "getheaders":
+		handleGetHeaders(request, bc)
+	case "headers":
+		handleHeaders(request, bc)
 	case "getdata":
 		handleGetData(request, bc)
 	case "tx":
 		handleTx(request, bc)
 	case "version":
-		handleVersion(request, bc)
+		handleVersion(request, bc, conn.RemoteAddr())
+	case pbftPrePrepare, pbftPrepare, pbftCommit, pbftViewChange, pbftNewView:
+		handlePbft(request, bc)
+	case "raft":
+		handleRaft(request)
+	case "raftconf":
+		handleRaftConf(request, conn.RemoteAddr())
 	default:
 		fmt.Println("Unknown command!")
 	}
@@ -200,7 +294,7 @@ func sendData(addr string, data []byte) {
 //处理当前版本
 //如果当前区块链的最高高度是比接收到的高度高那么就将当前版本发送给节点
 //如果当前区块不比接收到的高，则向接收地址请求区块
-func handleVersion(request []byte, bc *BlockChain) {
+func handleVersion(request []byte, bc *BlockChain, source net.Addr) {
 	
 	var buff bytes.Buffer
 	var payload Version
@@ -211,11 +305,17 @@ func handleVersion(request []byte, bc *BlockChain) {
 		log.Panic(err)
 	}
 
+	AddTimeSample(source, payload.AddFrom, payload.Timestamp)
+
 	myBestHeight := bc.GetBestHeight()
 	foreignerBestHeight := payload.BestHeight
 	if myBestHeight < foreignerBestHeight {
-		
-		sendGetBlocks(payload.AddFrom)
+		//需要假定有效区块的祖先时先同步区块头 再同步区块
+		if bc.needAssumeValidHeaders() {
+			sendGetHeaders(payload.AddFrom)
+		} else {
+			sendGetBlocks(payload.AddFrom)
+		}
 	} else if myBestHeight > foreignerBestHeight {
 		
 		sendVersion(payload.AddFrom, bc)
@@ -253,10 +353,70 @@ func handleGetBlocks(request []byte, bc *BlockChain) {
 	if err != nil {
 		log.Panic(err)
 	}
+	//按从旧到新的顺序发送 对方可以依次连接而不产生孤块
 	blocks := bc.GetBlockHashes()
+	ReverseHashes(blocks)
 	sendInv(payload.AddrFrom, "block", blocks)
 }
 
+//请求对方主链上的全部区块头
+func sendGetHeaders(address string) {
+	payload := gobEncode(getheaders{nodeAddress})
+	request := append(commandToBytes("getheaders"), payload...)
+
+	sendData(address, request)
+}
+
+func handleGetHeaders(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload getheaders
+	buff.Write(request[commandLength:])
+	decode := gob.NewDecoder(&buff)
+	err := decode.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	hashes := bc.GetBlockHashes()
+	ReverseHashes(hashes)
+	var data [][]byte
+	for _, hash := range hashes {
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		headerData, err := header.Serialize()
+		if err != nil {
+			log.Panic(err)
+		}
+		data = append(data, headerData)
+	}
+	payloadData := gobEncode(headers{nodeAddress, data})
+	sendData(payload.AddrFrom, append(commandToBytes("headers"), payloadData...))
+}
+
+//从区块头中找出假定有效区块的祖先 然后同步区块
+func handleHeaders(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload headers
+	buff.Write(request[commandLength:])
+	decode := gob.NewDecoder(&buff)
+	err := decode.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	var chain []*BlockHeader
+	for _, data := range payload.Headers {
+		header, err := DeserializeBlockHeader(data)
+		if err != nil {
+			fmt.Printf("Rejected malformed headers: %s\n", err)
+			return
+		}
+		chain = append(chain, &header)
+	}
+	learnAssumeValid(chain)
+	sendGetBlocks(payload.AddrFrom)
+}
+
 func sendInv(address, kind string, items [][]byte) {
 	inventory := inv{nodeAddress, kind, items}
 	payload := gobEncode(inventory)
@@ -293,7 +453,10 @@ func handleInv(request []byte, bc *BlockChain) {
 
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
-		if mempool[hex.EncodeToString(txID)].ID == nil {
+		mempoolMtx.Lock()
+		known := mempool[hex.EncodeToString(txID)].ID != nil
+		mempoolMtx.Unlock()
+		if !known {
 			sendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
@@ -317,17 +480,25 @@ func handleGetData(request []byte, bc *BlockChain) {
 		log.Panic(err)
 	}
 
+	//对方可能请求本节点没有的区块或交易 例如孤块的父块
 	if payload.Type == "block" {
 		block, err := bc.GetBlock(payload.ID)
 		if err != nil {
-			log.Panic(err)
+			fmt.Printf("%s requested unknown block %x\n", payload.AddFrom, payload.ID)
+			return
 		}
 		sendBlock(payload.AddFrom, &block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		mempoolMtx.Lock()
+		tx, ok := mempool[txID]
+		mempoolMtx.Unlock()
+		if !ok {
+			fmt.Printf("%s requested unknown transaction %s\n", payload.AddFrom, txID)
+			return
+		}
 		sendTx(payload.AddFrom, &tx)
 	}
 }
@@ -362,18 +533,36 @@ func handleBlock(request []byte,bc *BlockChain){
 	block := DeserializeBlock(blockData)
 
 	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
-
-	fmt.Printf("Added block %x\n",block.Hash)
+	oldTip := bc.TipHash()
+	err = bc.AddBlock(block)
+	switch {
+	case err == nil:
+		fmt.Printf("Added block %x\n",block.Hash)
+		processOrphans(bc, block.Hash)
+		if !bytes.Equal(oldTip, bc.TipHash()) {
+			cancelMining()
+			if replica != nil {
+				replica.requestReceived()
+			}
+		}
+	case IsErrorCode(err, ErrDuplicateBlock) || orphans.has(block.Hash):
+		fmt.Printf("Already have block %x\n", block.Hash)
+	case IsErrorCode(err, ErrOrphanBlock) && len(block.PrevHash) != 0:
+		//父块还没有到达 先放入孤块池 并向发送方请求缺少的父块
+		orphans.add(block, payload.AddFrom)
+		root := orphans.root(block.Hash)
+		fmt.Printf("Received orphan block %x, requesting parent %x\n", block.Hash, root.PrevHash)
+		sendGetData(payload.AddFrom, "block", root.PrevHash)
+	default:
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		return
+	}
 
 	if len(blocksInTransit) >0 {
 		blockHash := blocksInTransit[0]
 		sendGetData(payload.AddFrom,"block",blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	}else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
 	}
 
 }
@@ -391,7 +580,10 @@ func handleTx(request []byte,bc *BlockChain){
 
 	txData := payload.Transaction
 	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	if err := acceptToMempool(bc, &tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return
+	}
 
 	if nodeAddress ==  knownNodes[0] {
 		for _,node := range knownNodes {
@@ -399,47 +591,286 @@ func handleTx(request []byte,bc *BlockChain){
 				sendInv(node,"tx",[][]byte{tx.ID})
 			}
 		}
-	}else {
-	if len(mempool) >= 2 && len(miningAddress) >0 {
-	MineTransactions:
-		var txs []*Transaction
-
-		for id := range mempool{
-			tx := mempool[id]
-			if bc.VerifyTransaction(&tx){
-				txs = append(txs,&tx)
-			}
+		//中心节点也可能是PBFT的验证者或者Raft的排序节点
+		if replica != nil {
+			replica.requestReceived()
 		}
-
-		if len(txs) == 0 {
-			fmt.Println("All transactions are invalid! Waiting for new ones...")
-			return 
+		if orderer != nil {
+			orderer.requestReceived()
 		}
+	}else if len(miningAddress) > 0 {
+		startMining(bc)
+	}
+}
 
-		cbTx := NewCoinbaseTX(miningAddress,"")
-		txs = append(txs,cbTx)
+//交易池中的交易足够时启动挖矿协程 已经在挖矿时什么也不做
+//PBFT的验证者和Raft的排序节点不挖矿 由副本或者领导者决定是否提议区块
+func startMining(bc *BlockChain) {
+	if replica != nil {
+		replica.requestReceived()
+		return
+	}
+	if orderer != nil {
+		orderer.requestReceived()
+		return
+	}
+	miningMtx.Lock()
+	defer miningMtx.Unlock()
+	if miningActive || mempoolSize() < 2 {
+		return
+	}
+	miningActive = true
+	go mineTransactions(bc)
+}
 
-		newBlock := bc.MineBlock(txs)
+//主链的链尾变化时取消正在进行的挖矿 挖矿协程会在新的链尾上重新开始
+func cancelMining() {
+	miningMtx.Lock()
+	defer miningMtx.Unlock()
+	if miningCancel != nil {
+		miningCancel()
+	}
+}
+
+//不断把交易池中的交易打包挖矿 直到交易池中的交易不够为止
+func mineTransactions(bc *BlockChain) {
+	for {
+		miningMtx.Lock()
+		if mempoolSize() < 2 {
+			miningActive = false
+			miningMtx.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		miningCancel = cancel
+		miningMtx.Unlock()
+
+		validTxs, fees := selectMempoolTransactions(bc)
+
+		var newBlock *Block
+		var err error
+		if len(validTxs) == 0 {
+			err = errors.New("all transactions are invalid")
+		} else {
+			//coinbase必须是区块中的第一笔交易
+			cbTx := NewCoinbaseTX(miningAddress,"", bc.GetBestHeight()+1, fees)
+			validTxs = append([]*Transaction{cbTx}, validTxs...)
+			newBlock, err = bc.MineBlock(ctx, validTxs)
+		}
 
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+		miningMtx.Lock()
+		miningCancel = nil
+		miningMtx.Unlock()
+		cancel()
+
+		if err == context.Canceled {
+			fmt.Println("Chain tip changed, restarting mining...")
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Mining failed: %s. Waiting for new transactions...\n", err)
+			miningMtx.Lock()
+			miningActive = false
+			miningMtx.Unlock()
+			return
+		}
 
 		fmt.Println("New block is minied!")
+		announceBlock(newBlock.Hash)
+	}
+}
 
-		for _,tx := range txs{
-			txID := hex.EncodeToString(tx.ID)
-			delete(mempool,txID)
+//从交易池中选出可以打包进下一个块的交易
+//只打包签名正确并且输入都在UTXO集中的交易 同时累计手续费
+//花费同一个输出的交易只选其中一笔 否则区块会因为双花被拒绝
+func selectMempoolTransactions(bc *BlockChain) ([]*Transaction, int) {
+	var txs []*Transaction
+
+	mempoolMtx.Lock()
+	for id := range mempool{
+		tx := mempool[id]
+		txs = append(txs,&tx)
+	}
+	mempoolMtx.Unlock()
+
+	var validTxs []*Transaction
+	fees := 0
+	utxoSet := UTXOSet{bc}
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		if spendsAny(tx, spent) {
+			continue
+		}
+		fee, err := utxoSet.CheckTransactionInputs(tx, bc.GetBestHeight()+1)
+		if err == nil && bc.VerifyTransaction(tx){
+			markSpent(tx, spent)
+			validTxs = append(validTxs,tx)
+			fees += fee
 		}
+	}
+	return validTxs, fees
+}
 
-		for _,node := range knownNodes {
-			if node != nodeAddress{
-				sendInv(node ,"block",[][]byte{newBlock.Hash})
-			}
+//把新加入主链的区块通知给其他节点
+func announceBlock(hash []byte) {
+	for _,node := range knownNodes {
+		if node != nodeAddress{
+			sendInv(node ,"block",[][]byte{hash})
 		}
-		
-		if len(mempool) > 0 {
-			goto MineTransactions
+	}
+}
+
+//PBFT消息以消息的阶段作为命令发送
+func sendPbft(address string, msg *PbftMessage) {
+	payload := gobEncode(pbft{nodeAddress, msg.Serialize()})
+	request := append(commandToBytes(msg.Phase), payload...)
+
+	sendData(address, request)
+}
+
+//第一次收到PBFT消息时返回true 之后返回false
+func markPbftSeen(msg *PbftMessage) bool {
+	seenPbftMtx.Lock()
+	defer seenPbftMtx.Unlock()
+	key := hex.EncodeToString(msg.Signature)
+	if seenPbft[key] {
+		return false
+	}
+	if len(seenPbft) >= maxSeenPbft {
+		seenPbft = make(map[string]bool)
+	}
+	seenPbft[key] = true
+	return true
+}
+
+//把本节点的PBFT消息发送给所有已知节点
+func broadcastPbft(msg *PbftMessage) {
+	markPbftSeen(msg)
+	for _, node := range knownNodes {
+		if node != nodeAddress {
+			sendPbft(node, msg)
+		}
+	}
+}
+
+//处理PBFT消息 第一次收到时转发给其他已知节点 验证者节点交给副本处理
+func handlePbft(request []byte, bc *BlockChain) {
+	var buff bytes.Buffer
+	var payload pbft
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	msg, err := DeserializePbftMessage(payload.Message)
+	if err != nil {
+		fmt.Printf("Rejected malformed PBFT message: %s\n", err)
+		return
+	}
+	if !markPbftSeen(msg) {
+		return
+	}
+	for _, node := range knownNodes {
+		if node != nodeAddress && node != payload.AddrFrom {
+			sendPbft(node, msg)
 		}
 	}
+
+	//落后的节点先同步区块
+	if msg.Height > bc.GetBestHeight()+1 {
+		sendGetBlocks(payload.AddrFrom)
+	}
+	if replica != nil {
+		replica.handle(msg)
 	}
-}
\ No newline at end of file
+}
+
+//通过服务端的连接发送Raft消息 每条消息使用一个连接
+type raftTransport struct{}
+
+func (raftTransport) Send(msg raft.Message) {
+	payload := gobEncode(raftmsg{nodeAddress, msg.Serialize()})
+	request := append(commandToBytes("raft"), payload...)
+
+	go sendRaftData(msg.To, request)
+}
+
+//Raft消息和成员变更直接发给排序节点 不可达时丢弃 由Raft自己重试
+//与sendData不同 发送失败时不修改knownNodes 可以在单独的goroutine中调用
+func sendRaftData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		fmt.Printf("Raft orderer %s is not available\n", addr)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.Copy(conn, bytes.NewReader(data)); err != nil {
+		fmt.Printf("Sending to Raft orderer %s failed: %s\n", addr, err)
+	}
+}
+
+//Raft消息只在排序节点之间直接传递 不转发
+func handleRaft(request []byte) {
+	var buff bytes.Buffer
+	var payload raftmsg
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	msg, err := raft.DeserializeMessage(payload.Message)
+	if err != nil {
+		fmt.Printf("Rejected malformed Raft message: %s\n", err)
+		return
+	}
+	if orderer != nil {
+		orderer.step(msg)
+	}
+}
+
+//请求address上的节点增加或者删除一个Raft排序节点
+func sendRaftConf(address string, conf raftconf) {
+	request := append(commandToBytes("raftconf"), gobEncode(conf)...)
+
+	sendRaftData(address, request)
+}
+
+//变更Raft排序节点 不是领导者时转发给领导者
+//请求必须来自现有的排序节点 即本节点的命令行或者转发请求的其他成员
+//AddrFrom的主机必须解析为连接的来源地址 不能冒充其他成员
+func handleRaftConf(request []byte, source net.Addr) {
+	var buff bytes.Buffer
+	var payload raftconf
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	if orderer == nil {
+		fmt.Println("Not a Raft orderer, ignoring membership change")
+		return
+	}
+	ip, ok := sourceIP(source)
+	if !ok || !hostHasIP(payload.AddrFrom, ip) || !orderer.isMember(payload.AddrFrom) {
+		fmt.Printf("Rejected Raft membership change from %s, not an orderer\n", payload.AddrFrom)
+		return
+	}
+	err = orderer.changeMembers(payload.Add, payload.Address, payload.PubKeyHash)
+	if err == raft.ErrNotLeader {
+		if leader := orderer.node.Leader(); leader != "" && leader != payload.AddrFrom {
+			fmt.Printf("Forwarding membership change to Raft leader %s\n", leader)
+			payload.AddrFrom = nodeAddress
+			sendRaftConf(leader, payload)
+			return
+		}
+	}
+	if err != nil {
+		fmt.Printf("Raft membership change failed: %s\n", err)
+	}
+}
@@ -0,0 +1,34 @@
+package Block
+
+//计算到height为止(包含height)一共发行的货币数量
+//每经过SubsidyHalvingInterval个块奖励减半 总量不超过MaxMoney
+func TotalSupply(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	total := 0
+	blocks := height + 1
+	reward := netParams.BaseSubsidy
+	for era := 0; blocks > 0 && reward > 0; era++ {
+		n := blocks
+		if netParams.SubsidyHalvingInterval > 0 && n > netParams.SubsidyHalvingInterval {
+			n = netParams.SubsidyHalvingInterval
+		}
+		total += n * reward
+		if total >= netParams.MaxMoney {
+			return netParams.MaxMoney
+		}
+		blocks -= n
+		if netParams.SubsidyHalvingInterval > 0 {
+			reward >>= 1
+		}
+	}
+	return total
+}
+
+//高度为height的区块允许的出块奖励
+//由发行总量的差值计算 这样到达MaxMoney之后奖励自然为0
+func CalcBlockSubsidy(height int) int {
+	return TotalSupply(height) - TotalSupply(height-1)
+}
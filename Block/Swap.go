@@ -0,0 +1,175 @@
+package Block
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+)
+
+//原子交换的秘密长度
+const swapSecretSize = 32
+
+//合约默认的超时秒数 发起方的超时是参与方的两倍 参与方拿到秘密后有足够的时间赎回
+const (
+	initiatorSwapTimeout   = 48 * 60 * 60
+	participantSwapTimeout = 24 * 60 * 60
+)
+
+//哈希时间锁合约 作为付款给脚本哈希输出的赎回脚本
+//锁定时间之前 接收方公开哈希为SecretHash的秘密才能花费 锁定时间之后退款方可以取回
+type swapContract struct {
+	RecipientHash []byte //接收方的公钥哈希
+	RefundHash    []byte //退款方的公钥哈希
+	SecretHash    []byte //秘密的SHA-256哈希
+	LockTime      int64  //unix时间 与过去中位时间比较
+}
+
+//合约的脚本
+//OP_IF
+//    OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <secretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipientHash>
+//OP_ELSE
+//    <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refundHash>
+//OP_ENDIF
+//OP_EQUALVERIFY OP_CHECKSIG
+func (c *swapContract) Script() []byte {
+	return NewScriptBuilder().
+		AddOp(OpIf).
+		AddOp(OpSize).AddInt64(swapSecretSize).AddOp(OpEqualVerify).
+		AddOp(OpSha256).AddData(c.SecretHash).AddOp(OpEqualVerify).
+		AddOp(OpDup).AddOp(OpHash160).AddData(c.RecipientHash).
+		AddOp(OpElse).
+		AddInt64(c.LockTime).AddOp(OpCheckLockTimeVerify).AddOp(OpDrop).
+		AddOp(OpDup).AddOp(OpHash160).AddData(c.RefundHash).
+		AddOp(OpEndIf).
+		AddOp(OpEqualVerify).AddOp(OpCheckSig).
+		Script()
+}
+
+//解析合约脚本 不是合约的标准脚本时返回错误
+func extractSwapContract(script []byte) (*swapContract, error) {
+	pops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	if len(pops) != 20 {
+		return nil, errors.New("script is not an atomic swap contract")
+	}
+	lockTime, err := makeScriptNum(pops[11].data, maxLockTimeNumLen)
+	if err != nil {
+		return nil, err
+	}
+	c := &swapContract{pops[9].data, pops[16].data, pops[5].data, int64(lockTime)}
+	if !bytes.Equal(c.Script(), script) || len(c.SecretHash) != sha256.Size || len(c.RecipientHash) != 20 || len(c.RefundHash) != 20 {
+		return nil, errors.New("script is not an atomic swap contract")
+	}
+	return c, nil
+}
+
+//生成随机的秘密
+func newSwapSecret() []byte {
+	secret := make([]byte, swapSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Panic(err)
+	}
+	return secret
+}
+
+//合约交易中付款给合约的输出的位置
+func findContractOutput(tx *Transaction, contract []byte) (int, error) {
+	script := payToScriptHashScript(HashPubKey(contract))
+	for i, out := range tx.Vout {
+		if bytes.Equal(out.ScriptPubKey, script) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("transaction %x does not pay to the contract", tx.ID)
+}
+
+//从wallet付款amount到合约 返回合约交易
+func NewSwapContractTransaction(wallet *Wallet, contract []byte, amount, fee int, utxoSet *UTXOSet) *Transaction {
+	return NewUTXOTransaction(wallet, ScriptHashAddress(contract), amount, fee, 0, utxoSet)
+}
+
+//花费合约输出的交易 secret不为nil时赎回 否则在合约的锁定时间之后退款
+//付款给签名的钱包 金额为合约的输出减去手续费
+func NewSwapSpendTransaction(wallet *Wallet, contractTx *Transaction, contract, secret []byte, fee int) (*Transaction, error) {
+	c, err := extractSwapContract(contract)
+	if err != nil {
+		return nil, err
+	}
+	vout, err := findContractOutput(contractTx, contract)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyHash := HashPubKey(wallet.PublickKey)
+	lockTime := int64(0)
+	if secret != nil {
+		if !bytes.Equal(pubKeyHash, c.RecipientHash) {
+			return nil, errors.New("wallet is not the recipient of the contract")
+		}
+		if hash := sha256.Sum256(secret); !bytes.Equal(hash[:], c.SecretHash) {
+			return nil, errors.New("secret does not match the contract's secret hash")
+		}
+	} else {
+		if !bytes.Equal(pubKeyHash, c.RefundHash) {
+			return nil, errors.New("wallet is not the refund address of the contract")
+		}
+		//退款交易的锁定时间不早于合约的锁定时间 OP_CHECKLOCKTIMEVERIFY才能通过
+		lockTime = c.LockTime
+	}
+	value := contractTx.Vout[vout].Value - fee
+	if value <= 0 {
+		return nil, fmt.Errorf("fee %d is not less than the contract amount %d", fee, contractTx.Vout[vout].Value)
+	}
+
+	tx := Transaction{nil, []TXInput{{contractTx.ID, vout, nil, 0}}, []TXOutput{{value, payToPubKeyHashScript(pubKeyHash)}}, lockTime}
+	tx.SetID()
+	signature, err := signHash(wallet.PrivateKey, tx.signatureHash(0, contract))
+	if err != nil {
+		return nil, err
+	}
+	builder := NewScriptBuilder().AddData(signature).AddData(wallet.PublickKey)
+	if secret != nil {
+		builder.AddData(secret).AddInt64(1)
+	} else {
+		builder.AddInt64(0)
+	}
+	tx.Vin[0].ScriptSig = builder.AddData(contract).Script()
+	return &tx, nil
+}
+
+//在链上查找花费合约输出的交易 从解锁脚本中取出秘密
+//合约还没有被花费时返回nil 被退款时秘密为nil
+func (bc *BlockChain) findSwapSpend(contractTx *Transaction, contract []byte) (*Transaction, []byte, error) {
+	c, err := extractSwapContract(contract)
+	if err != nil {
+		return nil, nil, err
+	}
+	vout, err := findContractOutput(contractTx, contract)
+	if err != nil {
+		return nil, nil, err
+	}
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			for _, vin := range tx.Vin {
+				if vin.Vout != vout || !bytes.Equal(vin.Txid, contractTx.ID) {
+					continue
+				}
+				for _, data := range pushedData(vin.ScriptSig) {
+					if hash := sha256.Sum256(data); bytes.Equal(hash[:], c.SecretHash) {
+						return tx, data, nil
+					}
+				}
+				return tx, nil, nil
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			return nil, nil, nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package Block
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+//付款给合约的交易 合约输出是第0个输出
+func testContractTx(contract []byte) *Transaction {
+	tx := &Transaction{
+		Vin:  []TXInput{{make([]byte, 32), 0, nil, maxTxInSequenceNum}},
+		Vout: []TXOutput{{10, payToScriptHashScript(HashPubKey(contract))}},
+	}
+	tx.SetID()
+	return tx
+}
+
+//不经过NewSwapSpendTransaction的检查 直接构造花费合约的交易
+//claim为true时走赎回分支并压入secret 否则走退款分支
+func testSwapSpend(t *testing.T, w *Wallet, contractTx *Transaction, contract, secret []byte, claim bool, lockTime int64, sequence uint32) *Transaction {
+	tx := &Transaction{nil, []TXInput{{contractTx.ID, 0, nil, sequence}}, []TXOutput{{9, payToPubKeyHashScript(HashPubKey(w.PublickKey))}}, lockTime}
+	tx.SetID()
+	builder := NewScriptBuilder().AddData(testSign(t, w, tx, contract)).AddData(w.PublickKey)
+	if claim {
+		builder.AddData(secret).AddInt64(1)
+	} else {
+		builder.AddInt64(0)
+	}
+	tx.Vin[0].ScriptSig = builder.AddData(contract).Script()
+	return tx
+}
+
+func TestSwapContract(t *testing.T) {
+	recipient, refunder := newTestWallet(), newTestWallet()
+	secret := newSwapSecret()
+	secretHash := sha256.Sum256(secret)
+	c := &swapContract{HashPubKey(recipient.PublickKey), HashPubKey(refunder.PublickKey), secretHash[:], lockTimeThreshold + 1000}
+	contract := c.Script()
+	contractTx := testContractTx(contract)
+
+	tests := []struct {
+		name      string
+		wallet    *Wallet
+		secret    []byte
+		claim     bool
+		lockTime  int64
+		sequence  uint32
+		errSubstr string
+	}{
+		{"claim with the secret", recipient, secret, true, 0, 0, ""},
+		{"claim with another secret", recipient, newSwapSecret(), true, 0, 0, "OP_EQUALVERIFY failed"},
+		{"claim with a short secret", recipient, secret[1:], true, 0, 0, "OP_EQUALVERIFY failed"},
+		{"claim by the refunder", refunder, secret, true, 0, 0, "OP_EQUALVERIFY failed"},
+		{"refund at the lock time", refunder, nil, false, c.LockTime, 0, ""},
+		{"refund one second before the lock time", refunder, nil, false, c.LockTime - 1, 0, "is later than transaction lock time"},
+		{"refund without a lock time", refunder, nil, false, 0, 0, "of different types"},
+		{"refund with the final sequence number", refunder, nil, false, c.LockTime, maxTxInSequenceNum, "final sequence number"},
+		{"refund by the recipient", recipient, nil, false, c.LockTime, 0, "OP_EQUALVERIFY failed"},
+	}
+	for _, test := range tests {
+		tx := testSwapSpend(t, test.wallet, contractTx, contract, test.secret, test.claim, test.lockTime, test.sequence)
+		checkScript(t, test.name, tx, contractTx.Vout[0].ScriptPubKey, test.errSubstr)
+	}
+}
+
+func TestSwapSpendTransaction(t *testing.T) {
+	recipient, refunder := newTestWallet(), newTestWallet()
+	secret := newSwapSecret()
+	secretHash := sha256.Sum256(secret)
+	c := &swapContract{HashPubKey(recipient.PublickKey), HashPubKey(refunder.PublickKey), secretHash[:], lockTimeThreshold + 1000}
+	contract := c.Script()
+	contractTx := testContractTx(contract)
+
+	//接收方用秘密赎回 交易没有锁定时间 立即生效
+	claim, err := NewSwapSpendTransaction(recipient, contractTx, contract, secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyInputScript(claim, 0, contractTx.Vout[0]); err != nil {
+		t.Fatalf("claim with the secret failed: %v", err)
+	}
+	if !claim.IsFinal(1, c.LockTime-1) {
+		t.Fatal("claim is not final before the contract lock time")
+	}
+
+	//退款交易的锁定时间是合约的锁定时间 过去中位时间超过它之后才能打包
+	refund, err := NewSwapSpendTransaction(refunder, contractTx, contract, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyInputScript(refund, 0, contractTx.Vout[0]); err != nil {
+		t.Fatalf("refund failed: %v", err)
+	}
+	if refund.IsFinal(1, c.LockTime) {
+		t.Fatal("refund is final at the contract lock time")
+	}
+	if !refund.IsFinal(1, c.LockTime+1) {
+		t.Fatal("refund is not final after the contract lock time")
+	}
+
+	tests := []struct {
+		name   string
+		wallet *Wallet
+		secret []byte
+	}{
+		{"wrong secret", recipient, newSwapSecret()},
+		{"claim by the refunder", refunder, secret},
+		{"refund by the recipient", recipient, nil},
+	}
+	for _, test := range tests {
+		if _, err := NewSwapSpendTransaction(test.wallet, contractTx, contract, test.secret, 1); err == nil {
+			t.Errorf("%s: spend transaction was created", test.name)
+		}
+	}
+	if _, err := NewSwapSpendTransaction(recipient, contractTx, contract, secret, 10); err == nil {
+		t.Error("fee equal to the contract amount was accepted")
+	}
+}
@@ -1,72 +1,88 @@
 package Block
 
 import (
-	"math/big"
 	"fmt"
 	"log"
 	"encoding/hex"
 	"bytes"
 	"encoding/gob"
 	"crypto/sha256"
-	"crypto/rand"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
 	"os"
 )
 
-const subsidy = 10
-
 //交易
 type Transaction struct {
-	ID   []byte     //交易的唯一标识
-	Vin  []TXInput  //交易所包含的输入 可以多条
-	Vout []TXOutput //交易所包含的输出 可以多条
+	ID       []byte     //交易的唯一标识
+	Vin      []TXInput  //交易所包含的输入 可以多条
+	Vout     []TXOutput //交易所包含的输出 可以多条
+	LockTime int64      //锁定时间 小于lockTimeThreshold时是区块高度 否则是unix时间 0表示不锁定
 }
 
 //输入  输入及之前的交易的输出
 type TXInput struct {
 	Txid      []byte //之前的ID
 	Vout      int    //引用的输出在之前交易中的索引
-	Signature []byte //
-	PubKey    []byte //
+	ScriptSig []byte //解锁脚本 只能压入数据 coinbase中是承诺了区块高度的任意数据
+	Sequence  uint32 //序号 用于相对锁定 全部为最大值时交易的锁定时间不起作用
 }
 
 //输出
 type TXOutput struct {
-	Value      int    //金额
-	PubKeyHash []byte //验证
+	Value        int    //金额
+	ScriptPubKey []byte //锁定脚本 与解锁脚本一起执行成功才能花费
 }
 
+//一笔交易中尚未花费的输出 键为输出在交易中的原始索引
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs    map[int]TXOutput
+	Height     int  //交易所在区块的高度
+	IsCoinbase bool //是否为coinbase交易的输出
+}
+
+//输出能否在高度为spendHeight的区块中花费
+//coinbase的输出需要经过CoinbaseMaturity个块才能花费 创世块的奖励作为初始分配不受限制
+func (outs TXOutputs) IsMature(spendHeight int) bool {
+	if !outs.IsCoinbase || outs.Height == 0 {
+		return true
+	}
+	return spendHeight-outs.Height >= netParams.CoinbaseMaturity
+}
+
+//输出的唯一标识 交易ID加输出索引
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
 }
 
+//输入是否用公钥哈希为pubHashKey的公钥解锁 即标准解锁脚本<signature> <pubKey>
 func (in *TXInput) UsesKey(pubHashKey []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
+	pushed := pushedData(in.ScriptSig)
+	if len(pushed) != 2 {
+		return false
+	}
+	lockingHash := HashPubKey(pushed[1])
 	return bytes.Compare(lockingHash, pubHashKey) == 0
 }
 
+//输出是否是付款给pubHashKey的标准脚本
 func (out *TXOutput) IsLockedWithKey(pubHashKey []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubHashKey) == 0
+	pubKeyHash := extractPubKeyHash(out.ScriptPubKey)
+	return pubKeyHash != nil && bytes.Compare(pubKeyHash, pubHashKey) == 0
 }
 
+//把输出锁定到地址 普通地址付款给其中的公钥哈希 多重签名地址使用其中的脚本
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
-
-}
-
-func (tx *Transaction) SetID() {
-	var encoded bytes.Buffer
-	var hash [32]byte
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+	script, err := lockingScript(string(address))
 	if err != nil {
 		log.Panic(err)
 	}
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hash[:]
+	out.ScriptPubKey = script
+}
+
+func (tx *Transaction) SetID() {
+	tx.ID = tx.computeID()
 }
 
 func NewTXOutput(value int, address string) *TXOutput {
@@ -75,35 +91,111 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
-func NewCoinbaseTX(to, data string) *Transaction {
+//coinbase输入中承诺的数据长度 区块高度(8字节) + extranonce(8字节) 之后是任意数据
+const coinbaseCommitmentLen = 16
+
+//生成高度为height的区块的coinbase交易 金额为该高度的出块奖励加上区块中所有交易的手续费
+//输入中承诺了区块高度 不同区块的coinbase交易ID不会重复
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	coinbaseData := append(Int64ToBytes(int64(height)), Int64ToBytes(0)...)
+	coinbaseData = append(coinbaseData, []byte(data)...)
+	txin := TXInput{[]byte{}, -1, coinbaseData, maxTxInSequenceNum}
+	txout := NewTXOutput(CalcBlockSubsidy(height)+fees, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.SetID()
 	return &tx
 }
 
+//修改coinbase中的extranonce并重新计算交易ID
+//nonce用尽之后改变extranonce就能得到新的merkle根继续挖矿
+func (tx *Transaction) SetExtraNonce(extraNonce uint64) {
+	binary.BigEndian.PutUint64(tx.Vin[0].ScriptSig[8:coinbaseCommitmentLen], extraNonce)
+	tx.ID = nil
+	tx.SetID()
+}
+
+//coinstake交易 第一个输出为空 PoS的出块者用它质押输出并领取奖励
+func (tx Transaction) IsCoinstake() bool {
+	return !tx.IsCoinbase() && len(tx.Vin) == 1 && len(tx.Vout) >= 2 && tx.Vout[0].Value == 0 && len(tx.Vout[0].ScriptPubKey) == 0
+}
+
+//coinbase交易中承诺的区块高度
+func (tx Transaction) CoinbaseHeight() (int, error) {
+	if !tx.IsCoinbase() || len(tx.Vin[0].ScriptSig) < coinbaseCommitmentLen {
+		return 0, errors.New("Coinbase does not commit to a height")
+	}
+	return int(binary.BigEndian.Uint64(tx.Vin[0].ScriptSig[:8])), nil
+}
+
 func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, utxoSet *UTXOSet) *Transaction {
-	pubKeyHash := HashPubKey(wallet.PublickKey)
+//交易所有输出的金额之和
+func (tx Transaction) OutputValue() int {
+	total := 0
+	for _, out := range tx.Vout {
+		total += out.Value
+	}
+	return total
+}
 
-	toHash := Base58Decode([]byte(to))
-	toHash = toHash[1:len(toHash)-4]
+//生成一笔转账交易 输入总额减去输出总额就是付给矿工的手续费fee
+//lockTime不为0时交易在这个高度或时间之后才能打包
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, lockTime int64, utxoSet *UTXOSet) *Transaction {
+	tx := newUnsignedTransaction(payToPubKeyHashScript(HashPubKey(wallet.PublickKey)), to, amount, fee, lockTime, utxoSet)
+	utxoSet.Blockchain.SignTransaction(tx, wallet.PrivateKey)
+	return tx
+}
+
+//生成花费多重签名地址from的转账交易 找零回到from
+//from是脚本哈希地址时redeemScript为其中的多重签名赎回脚本 它被放入每个输入的解锁脚本 签名者据此签名
+//交易没有签名 由各个签名者依次用SignTransaction添加签名
+func NewMultiSigTransaction(from string, redeemScript []byte, to string, amount, fee int, utxoSet *UTXOSet) *Transaction {
+	script, err := lockingScript(from)
+	if err != nil {
+		log.Panic(err)
+	}
+	multiSig := script
+	if scriptHash := extractScriptHash(script); scriptHash != nil {
+		if bytes.Compare(HashPubKey(redeemScript), scriptHash) != 0 {
+			log.Panic("ERROR: Redeem script does not match the sender address")
+		}
+		multiSig = redeemScript
+	}
+	if required, _ := extractMultiSig(multiSig); required == 0 {
+		log.Panic("ERROR: Sender address is not a multisig address")
+	}
+	tx := newUnsignedTransaction(script, to, amount, fee, 0, utxoSet)
+	if extractScriptHash(script) != nil {
+		for i := range tx.Vin {
+			tx.Vin[i].ScriptSig = pushDataScript([][]byte{redeemScript})
+		}
+	}
+	return tx
+}
 
-	if bytes.Compare(pubKeyHash, toHash) == 0 {
+//用锁定脚本为fromScript的输出支付amount和手续费fee 找零回到fromScript
+//输入的序号为0 不设置相对锁定 锁定时间可以生效
+func newUnsignedTransaction(fromScript []byte, to string, amount, fee int, lockTime int64, utxoSet *UTXOSet) *Transaction {
+	toScript, err := lockingScript(to)
+	if err != nil {
+		log.Panic(err)
+	}
+	if bytes.Compare(fromScript, toScript) == 0 {
 		fmt.Println("Cannot transacte to yourself")
 		os.Exit(1)
 	}
 	var inputs []TXInput
 	var outputs []TXOutput
-	acc, validOutputs := utxoSet.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
+	if fee < 0 {
+		log.Panic("ERROR: Fee cannot be negative")
+	}
+	acc, validOutputs := utxoSet.FindSpendableScriptOutputs(fromScript, amount+fee)
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 	for txid, outs := range validOutputs {
@@ -113,108 +205,206 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, utxoSet *UTXOSet)
 		}
 
 		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublickKey}
+			input := TXInput{txID, out, nil, 0}
 			inputs = append(inputs, input)
 		}
 	}
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	outputs = append(outputs, TXOutput{amount, toScript})
 
-	from := fmt.Sprintf("%s", wallet.GetAddress())
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, TXOutput{acc - amount - fee, fromScript})
 
 	}
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	tx.SetID()
-	utxoSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 	return &tx
 }
 
+//按照每1000字节feeRate的费率生成转账交易
+//手续费取决于交易大小 而交易大小又取决于选中的输入 所以反复计算直到手续费不再变化
+func NewUTXOTransactionWithFeeRate(wallet *Wallet, to string, amount, feeRate int, lockTime int64, utxoSet *UTXOSet) (*Transaction, int) {
+	fee := 0
+	for {
+		tx := NewUTXOTransaction(wallet, to, amount, fee, lockTime, utxoSet)
+		required := CalcFee(tx, feeRate)
+		if required <= fee {
+			return tx, fee
+		}
+		fee = required
+	}
+}
+
+//按照每1000字节feeRate的费率计算交易的手续费 不足1000字节的部分向上取整
+func CalcFee(tx *Transaction, feeRate int) int {
+	size := len(tx.Serialize())
+	return (size*feeRate + 999) / 1000
+}
+
+//用私钥为交易中锁定到它的公钥哈希的输入生成解锁脚本
+//多重签名的输入中加入这个私钥的签名 其他输入保持不变
+//付款给脚本哈希的输入 解锁脚本的最后已经压入了赎回脚本 按赎回脚本签名后仍然把它放在最后
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
 
 	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
+		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		if prevTx.ID == nil || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
+	pubKey := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
+	pubKeyHash := HashPubKey(pubKey)
+	for inID, vin := range tx.Vin {
+		prevOut := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+		script := prevOut.ScriptPubKey
+		redeemScript := tx.redeemScript(inID, script)
+		if redeemScript != nil {
+			pushed := pushedData(tx.Vin[inID].ScriptSig)
+			tx.Vin[inID].ScriptSig = pushDataScript(pushed[:len(pushed)-1])
+			script = redeemScript
+		}
+		if pkh := extractPubKeyHash(script); pkh != nil && bytes.Compare(pkh, pubKeyHash) == 0 {
+			signature, err := signHash(privKey, tx.signatureHash(inID, script))
+			if err != nil {
+				log.Panic(err)
+			}
+			tx.Vin[inID].ScriptSig = payToPubKeyHashSigScript(signature, pubKey)
+		} else {
+			tx.addMultiSigSignature(inID, script, privKey, pubKey)
+		}
+		if redeemScript != nil {
+			tx.Vin[inID].ScriptSig = append(tx.Vin[inID].ScriptSig, pushDataScript([][]byte{redeemScript})...)
+		}
+	}
 
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+}
 
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+//花费付款给脚本哈希的输出script时 解锁脚本最后压入的赎回脚本 哈希不相符或者不是脚本哈希输出时返回nil
+func (tx *Transaction) redeemScript(inIndex int, script []byte) []byte {
+	scriptHash := extractScriptHash(script)
+	pushed := pushedData(tx.Vin[inIndex].ScriptSig)
+	if scriptHash == nil || len(pushed) == 0 {
+		return nil
+	}
+	redeemScript := pushed[len(pushed)-1]
+	if bytes.Compare(HashPubKey(redeemScript), scriptHash) != 0 {
+		return nil
+	}
+	return redeemScript
+}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
+//如果输入花费的是包含pubKey的多重签名脚本 把私钥的签名加入解锁脚本
+//已有的签名保持不变 签名按公钥在脚本中的顺序排列 达到需要的数量后不再增加
+func (tx *Transaction) addMultiSigSignature(inIndex int, script []byte, privKey ecdsa.PrivateKey, pubKey []byte) {
+	required, pubKeys := extractMultiSig(script)
+	if required == 0 {
+		return
+	}
+	signatures := tx.multiSigSignatures(inIndex, script)
+	if len(signatures) >= required {
+		return
+	}
+	for i, key := range pubKeys {
+		if bytes.Compare(key, pubKey) != 0 || signatures[i] != nil {
+			continue
+		}
+		signature, err := signHash(privKey, tx.signatureHash(inIndex, script))
 		if err != nil {
 			log.Panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-
-		tx.Vin[inID].Signature = signature
-		txCopy.Vin[inID].PubKey = nil
+		signatures[i] = signature
 	}
+	var ordered [][]byte
+	for i := range pubKeys {
+		if signatures[i] != nil {
+			ordered = append(ordered, signatures[i])
+		}
+	}
+	tx.Vin[inIndex].ScriptSig = pushDataScript(ordered)
+}
 
+//多重签名输入的解锁脚本中有效的签名 键为签名对应的公钥在脚本中的位置
+func (tx *Transaction) multiSigSignatures(inIndex int, script []byte) map[int][]byte {
+	_, pubKeys := extractMultiSig(script)
+	hash := tx.signatureHash(inIndex, script)
+	signatures := make(map[int][]byte)
+	for _, signature := range pushedData(tx.Vin[inIndex].ScriptSig) {
+		for i, pubKey := range pubKeys {
+			if signatures[i] == nil && verifyHashSignature(pubKey, signature, hash) {
+				signatures[i] = signature
+				break
+			}
+		}
+	}
+	return signatures
 }
 
+//去掉所有解锁脚本的副本
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	for _, in := range tx.Vin {
-		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, nil})
+		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Vout {
-		outputs = append(outputs, TXOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TXOutput{out.Value, out.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 	return txCopy
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+//第inIndex个输入的签名哈希 签名覆盖全部输入和输出
+//解锁脚本不能签名自己 所以全部去掉 被签名的输入换成它花费的锁定脚本subScript
+func (tx *Transaction) signatureHash(inIndex int, subScript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inIndex].ScriptSig = subScript
+	hash := sha256.Sum256(txCopy.Serialize())
+	return hash[:]
+}
+
+//验证交易的每个输入 prevOuts保存输入引用的输出 键为outpointKey
+//每个输入的解锁脚本和它花费的输出的锁定脚本一起执行成功才能通过
+func (tx *Transaction) Verify(prevOuts map[string]TXOutput) bool {
+	return tx.verifyScripts(prevOuts) == nil
+}
+
+//与Verify相同 返回第一个失败的输入的原因
+func (tx *Transaction) verifyScripts(prevOuts map[string]TXOutput) error {
 	if tx.IsCoinbase() {
-		return true
+		return nil
 	}
 
-	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+	for inID, vin := range tx.Vin {
+		prevOut, ok := prevOuts[outpointKey(vin.Txid, vin.Vout)]
+		if !ok {
+			return scriptError("input %d spends unknown output %s", inID, outpointKey(vin.Txid, vin.Vout))
+		}
+		if err := verifyInputScript(tx, inID, prevOut); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
-	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:sigLen/2])
-		s.SetBytes(vin.Signature[sigLen/2:])
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:keyLen/2])
-		y.SetBytes(vin.PubKey[keyLen/2:])
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
-		}
-		txCopy.Vin[inID].PubKey = nil
+//交易的ID 解锁脚本不参与计算 签名之前就能确定ID
+//coinbase的输入承诺了区块高度和extranonce 需要参与计算
+func (tx *Transaction) computeID() []byte {
+	txCopy := Transaction{nil, make([]TXInput, len(tx.Vin)), tx.Vout, tx.LockTime}
+	for i, vin := range tx.Vin {
+		txCopy.Vin[i] = TXInput{vin.Txid, vin.Vout, nil, vin.Sequence}
+	}
+	if tx.IsCoinbase() {
+		txCopy.Vin[0].ScriptSig = tx.Vin[0].ScriptSig
 	}
-	return true
+	hash := sha256.Sum256(txCopy.Serialize())
+	return hash[:]
 }
 
 //序列化所有输出
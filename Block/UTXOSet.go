@@ -4,10 +4,51 @@ import (
 	"log"
 	"github.com/boltdb/bolt"
 	"encoding/hex"
+	"fmt"
+	"bytes"
+	"encoding/gob"
+	"errors"
 )
 
 const utxoBucket = "chainstate"
 
+//chainstate中TXOutputs的格式版本 格式改变时增加 打开旧格式的数据库时重建chainstate
+const chainstateVersion = "2"
+
+//保存每个已连接区块的回滚数据
+//键：区块的hash    值：连接前被改动的chainstate条目
+const undoBucket = "undo"
+
+//chainstate中一个键在区块连接前的值
+type undoEntry struct {
+	Key   []byte
+	Value []byte //nil表示连接前不存在
+}
+
+type blockUndo struct {
+	Entries []undoEntry
+}
+
+func (undo blockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializeUndo(data []byte) blockUndo {
+	var undo blockUndo
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return undo
+}
+
 type UTXOSet struct {
 	Blockchain *BlockChain
 }
@@ -45,14 +86,42 @@ func (u UTXOSet) Reindex() {
 				log.Panic(err)
 			}
 		}
+		//全部写入之后才记录版本 中途退出时下次打开会重新建立
+		return tx.Bucket([]byte(metaBucket)).Put([]byte("chainstate"), []byte(chainstateVersion))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+//旧格式的chainstate无法解码 由区块重建
+//回滚数据中保存的是旧格式的条目 一并删除 之后新连接的区块会重新记录
+func (bc *BlockChain) migrateChainstate() {
+	fmt.Println("Chainstate was written in an older format, reindexing...")
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(undoBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+	UTXOSet{bc}.Reindex()
 }
 
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+	return u.FindSpendableScriptOutputs(payToPubKeyHashScript(pubKeyHash), amount)
+}
+
+//寻找锁定脚本为script的可花费输出 累加到amount为止
+func (u UTXOSet) FindSpendableScriptOutputs(script []byte, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulate := 0
 	db := u.Blockchain.DB
+	//未成熟的coinbase输出不能在下一个块中花费
+	spendHeight := u.Blockchain.GetBestHeight() + 1
 
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
@@ -61,9 +130,12 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
+			if !outs.IsMature(spendHeight) {
+				continue
+			}
 
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulate < amount {
+				if bytes.Equal(out.ScriptPubKey, script) && accumulate < amount {
 					accumulate += out.Value
 					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
 				}
@@ -77,6 +149,93 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 	return accumulate, unspentOutputs
 }
 
+//在高度为spendHeight的区块中花费交易的输入之前的检查 返回交易的手续费
+//交易池接收交易和矿工打包交易时使用 spendHeight通常为当前高度加一
+//锁定时间和相对锁定总是按接在主链末端之后的区块检查
+func (u UTXOSet) CheckTransactionInputs(transaction *Transaction, spendHeight int) (int, error) {
+	if transaction.IsCoinbase() {
+		return 0, nil
+	}
+
+	var fee int
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		fee, _, err = checkTxInputs(tx.Bucket([]byte(utxoBucket)), transaction, spendHeight, false)
+		if err != nil {
+			return err
+		}
+		tip := blockFromTx(tx, tx.Bucket([]byte(blocksBucket)).Get([]byte("l")))
+		return checkTxLocks(tx, transaction, tip)
+	})
+	return fee, err
+}
+
+//检查交易引用的输出 输出必须存在 coinbase的输出必须已经成熟 输入总额不能小于输出总额
+//coinstake可以重新质押未成熟的输出 并且可以领取奖励 此时手续费为负数
+//返回交易的手续费和引用的输出(键为outpointKey)
+func checkTxInputs(b *bolt.Bucket, transaction *Transaction, spendHeight int, coinstake bool) (int, map[string]TXOutput, error) {
+	inputValue := 0
+	prevOuts := make(map[string]TXOutput)
+	for _, vin := range transaction.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		outsBytes := b.Get(vin.Txid)
+		if outsBytes == nil {
+			return 0, nil, ruleError(ErrMissingInput, fmt.Sprintf("transaction %x spends missing output %s", transaction.ID, key))
+		}
+		outs := DeserializeOutputs(outsBytes)
+		out, ok := outs.Outputs[vin.Vout]
+		if !ok {
+			return 0, nil, ruleError(ErrMissingInput, fmt.Sprintf("transaction %x spends missing output %s", transaction.ID, key))
+		}
+		if !coinstake && !outs.IsMature(spendHeight) {
+			return 0, nil, ruleError(ErrImmatureSpend, fmt.Sprintf("transaction %x spends coinbase output %s from height %d at height %d, needs %d confirmations",
+				transaction.ID, key, outs.Height, spendHeight, netParams.CoinbaseMaturity))
+		}
+		prevOuts[key] = out
+		inputValue += out.Value
+		if out.Value < 0 || out.Value > netParams.MaxMoney || inputValue > netParams.MaxMoney {
+			return 0, nil, ruleError(ErrBadTxOutput, fmt.Sprintf("transaction %x spends more than %d in total", transaction.ID, netParams.MaxMoney))
+		}
+	}
+
+	//输入总额不能小于输出总额 差额是交易的手续费
+	if !coinstake && inputValue < transaction.OutputValue() {
+		return 0, nil, ruleError(ErrSpendTooHigh, fmt.Sprintf("transaction %x spends %d but only has %d in inputs", transaction.ID, transaction.OutputValue(), inputValue))
+	}
+	return inputValue - transaction.OutputValue(), prevOuts, nil
+}
+
+//计算地址的余额 未成熟的coinbase奖励单独统计
+func (u UTXOSet) GetBalance(pubKeyHash []byte) (spendable, immature int) {
+	return u.GetScriptBalance(payToPubKeyHashScript(pubKeyHash))
+}
+
+//计算锁定脚本为script的输出的余额
+func (u UTXOSet) GetScriptBalance(script []byte) (spendable, immature int) {
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		return b.ForEach(func(k, v []byte) error {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				if !bytes.Equal(out.ScriptPubKey, script) {
+					continue
+				}
+				if outs.IsMature(spendHeight) {
+					spendable += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return spendable, immature
+}
+
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
 	db := u.Blockchain.DB
@@ -102,53 +261,178 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+//将区块中的交易应用到UTXO集 同时记录回滚所需的数据
 func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.DB
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+	err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		return u.connectBlock(tx, block)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+//在给定的数据库事务中连接区块
+//每个被改动的键在第一次改动前的值都保存在undo桶中 断开区块时按原样恢复
+func (u UTXOSet) connectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := blockUndo{}
+	touched := make(map[string]bool)
 
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
+	//改动键之前先保存它原来的值 nil表示原来不存在
+	record := func(key []byte) {
+		if touched[string(key)] {
+			return
+		}
+		touched[string(key)] = true
+		var old []byte
+		if v := b.Get(key); v != nil {
+			old = append([]byte{}, v...)
+		}
+		undo.Entries = append(undo.Entries, undoEntry{append([]byte{}, key...), old})
+	}
+
+	//重复签名的质押者在作恶区块中获得的coinstake输出被没收 没收在交易之前进行 区块中的交易不能再花费它们
+	//只没收仍然付款给作恶质押者的输出
+	getBlock := func(hash []byte) *Block {
+		return blockFromTx(tx, hash)
+	}
+	for _, evidence := range block.Evidence {
+		ids, stakerHash := evidence.offendingCoinstakes(getBlock)
+		for _, id := range ids {
+			data := b.Get(id)
+			if data == nil {
+				continue
+			}
+			record(id)
+			outs := DeserializeOutputs(data)
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithKey(stakerHash) {
+					delete(outs.Outputs, outIdx)
 				}
 			}
-
-			newOutputs := TXOutputs{}
-
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			var err error
+			if len(outs.Outputs) == 0 {
+				err = b.Delete(id)
+			} else {
+				err = b.Put(id, outs.Serialize())
+			}
+			if err != nil {
+				return err
 			}
+		}
+	}
 
-			err := b.Put(tx.ID, newOutputs.Serialize())
+	//假定有效的区块及其祖先不执行脚本
+	checkSignatures := !isAssumedValid(tx, block.Hash)
+	parent := blockFromTx(tx, block.PrevHash)
+	fees := 0
+	for i, transaction := range block.Transactions {
+		coinstake := u.Blockchain.isCoinstake(block, i)
+		if parent != nil {
+			if err := checkTxLocks(tx, transaction, parent); err != nil {
+				return err
+			}
+		}
+		if transaction.IsCoinbase() == false {
+			fee, prevOuts, err := checkTxInputs(b, transaction, block.Height, coinstake)
 			if err != nil {
-				log.Panic(err)
+				return err
+			}
+			if checkSignatures {
+				if err := transaction.verifyScripts(prevOuts); err != nil {
+					return ruleError(ErrBadSignature, fmt.Sprintf("transaction %x failed script verification: %s", transaction.ID, err))
+				}
+			}
+			fees += fee
+
+			for _, vin := range transaction.Vin {
+				record(vin.Txid)
+
+				outs := DeserializeOutputs(b.Get(vin.Txid))
+				delete(outs.Outputs, vin.Vout)
+				if len(outs.Outputs) == 0 {
+					err := b.Delete(vin.Txid)
+					if err != nil {
+						return err
+					}
+				} else {
+					err := b.Put(vin.Txid, outs.Serialize())
+					if err != nil {
+						return err
+					}
+				}
 			}
 		}
-		return nil
-	})
+
+		//coinstake的输出和coinbase一样需要成熟后才能花费
+		newOutputs := TXOutputs{make(map[int]TXOutput), block.Height, transaction.IsCoinbase() || coinstake}
+
+		for outIdx, out := range transaction.Vout {
+			newOutputs.Outputs[outIdx] = out
+		}
+
+		//同一个ID的交易还有未花费的输出时不能覆盖 否则这些输出会丢失
+		if b.Get(transaction.ID) != nil {
+			return ruleError(ErrOverwriteTx, fmt.Sprintf("transaction %x would overwrite an unspent transaction", transaction.ID))
+		}
+		record(transaction.ID)
+		err := b.Put(transaction.ID, newOutputs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	//coinbase最多领取出块奖励加上区块中所有交易的手续费 coinstake领取的奖励已经从手续费中扣除
+	if err := checkOutputValues(block.Transactions[0]); err != nil {
+		return err
+	}
+	coinbaseValue := block.Transactions[0].OutputValue()
+	if allowed := CalcBlockSubsidy(block.Height) + fees; coinbaseValue > allowed {
+		return ruleError(ErrBadCoinbaseValue, fmt.Sprintf("coinbase pays %d, more than the allowed %d", coinbaseValue, allowed))
+	}
+
+	undoBucket, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	return undoBucket.Put(block.Hash, undo.Serialize())
+}
 
+//在回滚的数据库事务中连接区块 检查区块中的交易能否应用到UTXO集 不改变数据库
+func (u UTXOSet) checkConnectBlock(block *Block) error {
+	errDryRun := errors.New("dry run")
+	err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		if err := u.connectBlock(tx, block); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
+
+//在给定的数据库事务中断开区块 把UTXO集恢复到连接这个块之前的状态
+func (u UTXOSet) disconnectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undoBucket := tx.Bucket([]byte(undoBucket))
+	if undoBucket == nil || undoBucket.Get(block.Hash) == nil {
+		return fmt.Errorf("no undo data for block %x", block.Hash)
+	}
+	undo := DeserializeUndo(undoBucket.Get(block.Hash))
+
+	for i := len(undo.Entries) - 1; i >= 0; i-- {
+		entry := undo.Entries[i]
+		var err error
+		if entry.Value == nil {
+			err = b.Delete(entry.Key)
+		} else {
+			err = b.Put(entry.Key, entry.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return undoBucket.Delete(block.Hash)
 }
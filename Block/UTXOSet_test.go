@@ -0,0 +1,56 @@
+package Block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+//没有格式版本的旧chainstate在打开时由区块重建
+func TestOldChainstateIsReindexed(t *testing.T) {
+	bc, wallet, cleanup := newTestChain(t, &PowEngine{})
+	defer cleanup()
+	pubKeyHash := HashPubKey(wallet.PublickKey)
+	expected, _ := UTXOSet{bc}.GetBalance(pubKeyHash)
+
+	//旧格式的条目只有输出的列表
+	type legacyOutputs struct {
+		Outputs []TXOutput
+	}
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		for _, k := range keys {
+			outs := DeserializeOutputs(b.Get(k))
+			var legacy legacyOutputs
+			for _, out := range outs.Outputs {
+				legacy.Outputs = append(legacy.Outputs, out)
+			}
+			var buff bytes.Buffer
+			if err := gob.NewEncoder(&buff).Encode(legacy); err != nil {
+				return err
+			}
+			if err := b.Put(k, buff.Bytes()); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(metaBucket)).Delete([]byte("chainstate"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.DB.Close()
+
+	reopened := NewBlockchain("test_" + strings.Replace(t.Name(), "/", "_", -1))
+	bc.DB = reopened.DB
+	if balance, _ := (UTXOSet{reopened}).GetBalance(pubKeyHash); balance != expected {
+		t.Fatalf("balance after reindex is %d, expected %d", balance, expected)
+	}
+}
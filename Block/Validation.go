@@ -0,0 +1,288 @@
+package Block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+//区块或交易被拒绝的原因
+type ErrorCode int
+
+const (
+	ErrDuplicateBlock ErrorCode = iota //区块已经存在
+	ErrOrphanBlock                     //父块未知
+	ErrNoTransactions                  //区块中没有交易
+	ErrBadBlockHash                    //区块哈希与区块头不符
+	ErrHighHash                        //哈希值不满足工作量证明
+	ErrBadMerkleRoot                   //merkle根与区块中的交易不符
+	ErrBadBits                         //难度与按父块计算出的不一致
+	ErrBadSeal                         //区块的封装数据格式错误或签名不正确
+	ErrUnauthorizedSigner              //区块的签名者不在授权列表中
+	ErrRecentlySigned                  //签名者出块过于频繁
+	ErrBadVote                         //区块中的投票或签名者列表不合法
+	ErrBadStake                        //质押的输出不满足PoS出块条件
+	ErrBadCoinstake                    //coinstake交易缺失或者与区块头不符
+	ErrBadEvidence                     //作恶证据不合法
+	ErrBadCommit                       //PBFT的提交证明不合法
+	ErrFinalityConflict                //区块与已经最终确定的区块冲突
+	ErrBadCheckpoint                   //区块与检查点的hash不符
+	ErrForkTooOld                      //区块在最近的检查点之前分叉
+	ErrBadVersion                      //区块版本低于允许的最低版本
+	ErrBadHeight                       //高度不等于父块高度加一
+	ErrTimeTooOld                      //时间戳不晚于过去中位时间
+	ErrTimeTooNew                      //时间戳超前网络调整时间太多
+	ErrFirstTxNotCoinbase              //第一笔交易不是coinbase
+	ErrMultipleCoinbases               //存在多笔coinbase交易
+	ErrBadCoinbaseHeight               //coinbase没有承诺区块的高度
+	ErrBadCoinbaseValue                //coinbase的金额超过了允许的奖励
+	ErrBadTxID                         //交易ID与交易内容不符
+	ErrBadTxOutput                     //交易没有输入输出或者输出金额不合法
+	ErrDuplicateTx                     //区块中有重复的交易
+	ErrOverwriteTx                     //交易ID与一笔尚有未花费输出的交易重复
+	ErrDoubleSpend                     //同一个输出被花费了多次
+	ErrMissingInput                    //引用的输出不存在或者已经被花费
+	ErrSpendTooHigh                    //输出总额超过了输入总额
+	ErrImmatureSpend                   //花费了尚未成熟的coinbase输出
+	ErrBadSignature                    //解锁脚本执行失败 例如签名验证失败
+	ErrUnfinalizedTx                   //交易的锁定时间还没有到
+	ErrSequenceLocked                  //输入的相对锁定时间还没有到
+	ErrInvalidAncestor                 //区块或者它的祖先连接到主链时失败
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrDuplicateBlock:     "ErrDuplicateBlock",
+	ErrOrphanBlock:        "ErrOrphanBlock",
+	ErrNoTransactions:     "ErrNoTransactions",
+	ErrBadBlockHash:       "ErrBadBlockHash",
+	ErrHighHash:           "ErrHighHash",
+	ErrBadMerkleRoot:      "ErrBadMerkleRoot",
+	ErrBadBits:            "ErrBadBits",
+	ErrBadSeal:            "ErrBadSeal",
+	ErrUnauthorizedSigner: "ErrUnauthorizedSigner",
+	ErrRecentlySigned:     "ErrRecentlySigned",
+	ErrBadVote:            "ErrBadVote",
+	ErrBadStake:           "ErrBadStake",
+	ErrBadCoinstake:       "ErrBadCoinstake",
+	ErrBadEvidence:        "ErrBadEvidence",
+	ErrBadCommit:          "ErrBadCommit",
+	ErrFinalityConflict:   "ErrFinalityConflict",
+	ErrBadCheckpoint:      "ErrBadCheckpoint",
+	ErrForkTooOld:         "ErrForkTooOld",
+	ErrBadVersion:         "ErrBadVersion",
+	ErrBadHeight:          "ErrBadHeight",
+	ErrTimeTooOld:         "ErrTimeTooOld",
+	ErrTimeTooNew:         "ErrTimeTooNew",
+	ErrFirstTxNotCoinbase: "ErrFirstTxNotCoinbase",
+	ErrMultipleCoinbases:  "ErrMultipleCoinbases",
+	ErrBadCoinbaseHeight:  "ErrBadCoinbaseHeight",
+	ErrBadCoinbaseValue:   "ErrBadCoinbaseValue",
+	ErrBadTxID:            "ErrBadTxID",
+	ErrBadTxOutput:        "ErrBadTxOutput",
+	ErrDuplicateTx:        "ErrDuplicateTx",
+	ErrOverwriteTx:        "ErrOverwriteTx",
+	ErrDoubleSpend:        "ErrDoubleSpend",
+	ErrMissingInput:       "ErrMissingInput",
+	ErrSpendTooHigh:       "ErrSpendTooHigh",
+	ErrImmatureSpend:      "ErrImmatureSpend",
+	ErrBadSignature:       "ErrBadSignature",
+	ErrUnfinalizedTx:      "ErrUnfinalizedTx",
+	ErrSequenceLocked:     "ErrSequenceLocked",
+	ErrInvalidAncestor:    "ErrInvalidAncestor",
+}
+
+func (e ErrorCode) String() string {
+	if s := errorCodeStrings[e]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+//违反共识规则的错误
+type RuleError struct {
+	ErrorCode   ErrorCode
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+func ruleError(c ErrorCode, desc string) RuleError {
+	return RuleError{c, desc}
+}
+
+//判断错误是否为指定原因的RuleError
+func IsErrorCode(err error, c ErrorCode) bool {
+	rerr, ok := err.(RuleError)
+	return ok && rerr.ErrorCode == c
+}
+
+//区块写入数据库或者转发之前的检查
+//先做不依赖链状态的检查 再根据父块检查高度和难度
+//依赖UTXO集的检查(输入是否存在 签名 手续费 coinbase金额)在区块连接到主链时进行
+func (bc *BlockChain) ValidateBlock(block *Block) error {
+	parent, err := bc.checkBlockHeader(block)
+	if err != nil {
+		return err
+	}
+	if be, ok := bc.engine.(bodyEngine); ok {
+		if err := be.verifyBody(bc, block); err != nil {
+			return err
+		}
+	} else if len(block.Evidence) > 0 {
+		return ruleError(ErrBadEvidence, fmt.Sprintf("block %x contains evidence its consensus does not use", block.Hash))
+	}
+	return bc.checkBlockContext(block, parent)
+}
+
+//除了共识引擎对区块内容的检查之外 ValidateBlock在区块头上做的检查 返回父块
+//PBFT在提议的区块得到提交证明之前用它检查提议
+func (bc *BlockChain) checkBlockHeader(block *Block) (*Block, error) {
+	if bc.HasBlock(block.Hash) {
+		return nil, ruleError(ErrDuplicateBlock, fmt.Sprintf("already have block %x", block.Hash))
+	}
+
+	if err := CheckBlockSanity(block); err != nil {
+		return nil, err
+	}
+
+	parent, err := bc.GetBlock(block.PrevHash)
+	if err != nil {
+		//没有合法封装的块不能作为孤块占用孤块池
+		sealer, ok := bc.engine.(orphanSealer)
+		if !ok {
+			return nil, fmt.Errorf("parent %x of block %x is unknown", block.PrevHash, block.Hash)
+		}
+		if err := sealer.verifyOrphanSeal(&block.BlockHeader); err != nil {
+			return nil, err
+		}
+		return nil, ruleError(ErrOrphanBlock, fmt.Sprintf("parent %x of block %x is unknown", block.PrevHash, block.Hash))
+	}
+	if err := bc.checkCheckpoints(block); err != nil {
+		return nil, err
+	}
+	//最终确定的区块之前不能再产生分叉
+	if _, finalHeight := bc.FinalBlock(); block.Height <= finalHeight {
+		return nil, ruleError(ErrFinalityConflict, fmt.Sprintf("block %x at height %d conflicts with the final block at height %d", block.Hash, block.Height, finalHeight))
+	}
+	//由共识引擎检查区块头中的共识字段和封装
+	if err := bc.engine.VerifyHeader(bc, &block.BlockHeader, block.Height); err != nil {
+		return nil, err
+	}
+	if err := bc.engine.VerifySeal(bc, &block.BlockHeader, block.Height); err != nil {
+		return nil, err
+	}
+	return &parent, nil
+}
+
+//不依赖链状态的检查
+func CheckBlockSanity(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return ruleError(ErrNoTransactions, fmt.Sprintf("block %x does not contain any transactions", block.Hash))
+	}
+
+	if !bytes.Equal(block.BlockHeader.BlockHash(), block.Hash) {
+		return ruleError(ErrBadBlockHash, fmt.Sprintf("block %x does not match its header", block.Hash))
+	}
+	if block.Version < blockVersion {
+		return ruleError(ErrBadVersion, fmt.Sprintf("block %x has version %d, min %d", block.Hash, block.Version, blockVersion))
+	}
+	//不能超前网络调整时间太多
+	if maxTimestamp := AdjustedTime() + netParams.MaxFutureBlockTime; block.Timestamp > maxTimestamp {
+		return ruleError(ErrTimeTooNew, fmt.Sprintf("block %x timestamp %d is too far in the future, max %d", block.Hash, block.Timestamp, maxTimestamp))
+	}
+	//区块头中的merkle根必须与交易重新计算出的一致 否则说明交易被篡改
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return ruleError(ErrBadMerkleRoot, fmt.Sprintf("block %x has a merkle root that does not match its transactions", block.Hash))
+	}
+
+	if !block.Transactions[0].IsCoinbase() {
+		return ruleError(ErrFirstTxNotCoinbase, fmt.Sprintf("first transaction in block %x is not a coinbase", block.Hash))
+	}
+
+	//coinbase必须承诺区块的高度
+	if height, err := block.Transactions[0].CoinbaseHeight(); err != nil || height != block.Height {
+		return ruleError(ErrBadCoinbaseHeight, fmt.Sprintf("coinbase in block %x does not commit to height %d", block.Hash, block.Height))
+	}
+
+	seenTxs := make(map[string]bool)
+	spent := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return ruleError(ErrMultipleCoinbases, fmt.Sprintf("block %x contains a second coinbase at index %d", block.Hash, i))
+		}
+		if err := CheckTransactionSanity(tx); err != nil {
+			return err
+		}
+
+		txID := hex.EncodeToString(tx.ID)
+		if seenTxs[txID] {
+			return ruleError(ErrDuplicateTx, fmt.Sprintf("block %x contains transaction %s twice", block.Hash, txID))
+		}
+		seenTxs[txID] = true
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spent[key] {
+				return ruleError(ErrDoubleSpend, fmt.Sprintf("output %s is spent twice in block %x", key, block.Hash))
+			}
+			spent[key] = true
+		}
+	}
+	return nil
+}
+
+//每个输出和输出总额都不能超过货币总量 求和时不会溢出
+func checkOutputValues(tx *Transaction) error {
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > netParams.MaxMoney {
+			return ruleError(ErrBadTxOutput, fmt.Sprintf("transaction %x has an output of %d, must be between 0 and %d", tx.ID, out.Value, netParams.MaxMoney))
+		}
+		total += out.Value
+		if total > netParams.MaxMoney {
+			return ruleError(ErrBadTxOutput, fmt.Sprintf("transaction %x pays more than %d in total", tx.ID, netParams.MaxMoney))
+		}
+	}
+	return nil
+}
+
+//不依赖链状态的交易检查
+func CheckTransactionSanity(tx *Transaction) error {
+	if !bytes.Equal(tx.computeID(), tx.ID) {
+		return ruleError(ErrBadTxID, fmt.Sprintf("transaction %x has a mismatching ID", tx.ID))
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return ruleError(ErrBadTxOutput, fmt.Sprintf("transaction %x has no inputs or outputs", tx.ID))
+	}
+	if err := checkOutputValues(tx); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if seen[key] {
+			return ruleError(ErrDoubleSpend, fmt.Sprintf("transaction %x spends output %s twice", tx.ID, key))
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+//根据父块检查区块的高度和时间戳
+func (bc *BlockChain) checkBlockContext(block, parent *Block) error {
+	if block.Height != parent.Height+1 {
+		return ruleError(ErrBadHeight, fmt.Sprintf("block %x has height %d, expected %d", block.Hash, block.Height, parent.Height+1))
+	}
+
+	//时间戳必须晚于过去11个块时间戳的中位数
+	if medianTime := bc.CalcPastMedianTime(parent); block.Timestamp <= medianTime {
+		return ruleError(ErrTimeTooOld, fmt.Sprintf("block %x timestamp %d is not after median time %d", block.Hash, block.Timestamp, medianTime))
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package Block
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+)
+
+//版本的最高三位为001时 低29位中的每一位表示对一个部署的支持
+const (
+	versionBitsTopBits = 0x20000000
+	versionBitsTopMask = 0xe0000000
+)
+
+//软分叉部署的状态 每个确认窗口的最后一个块决定下一个窗口所有区块的状态
+type ThresholdState int
+
+const (
+	ThresholdDefined  ThresholdState = iota //还没有到开始时间
+	ThresholdStarted                        //矿工可以发出信号
+	ThresholdLockedIn                       //一个窗口中发出信号的区块达到阈值 下一个窗口开始生效
+	ThresholdActive                         //新规则生效
+	ThresholdFailed                         //超时之前没有锁定
+)
+
+var thresholdStateStrings = map[ThresholdState]string{
+	ThresholdDefined:  "defined",
+	ThresholdStarted:  "started",
+	ThresholdLockedIn: "locked_in",
+	ThresholdActive:   "active",
+	ThresholdFailed:   "failed",
+}
+
+func (s ThresholdState) String() string {
+	if str := thresholdStateStrings[s]; str != "" {
+		return str
+	}
+	return fmt.Sprintf("Unknown ThresholdState (%d)", int(s))
+}
+
+//一次软分叉部署 StartTime和Timeout与过去中位时间比较
+type Deployment struct {
+	Name      string
+	Bit       uint8 //版本中表示支持的位
+	StartTime int64 //从这个时间开始统计信号
+	Timeout   int64 //到这个时间还没有锁定则部署失败
+}
+
+//已定义的部署 新的共识规则在这里增加一项 并用deploymentActive判断是否执行
+const (
+	DeploymentTestDummy = iota //只用于测试状态转换 不对应任何规则
+	definedDeployments
+)
+
+//不会超时的部署使用的Timeout
+const noDeploymentTimeout = math.MaxInt64
+
+//每个部署在每个窗口最后一个块之后的状态 按区块hash缓存
+var thresholdCache = struct {
+	sync.Mutex
+	states [definedDeployments]map[string]ThresholdState
+}{}
+
+func cachedThresholdState(id int, hash []byte) (ThresholdState, bool) {
+	thresholdCache.Lock()
+	defer thresholdCache.Unlock()
+	state, ok := thresholdCache.states[id][hex.EncodeToString(hash)]
+	return state, ok
+}
+
+func cacheThresholdState(id int, hash []byte, state ThresholdState) {
+	thresholdCache.Lock()
+	defer thresholdCache.Unlock()
+	if thresholdCache.states[id] == nil {
+		thresholdCache.states[id] = make(map[string]ThresholdState)
+	}
+	thresholdCache.states[id][hex.EncodeToString(hash)] = state
+}
+
+//区块是否对部署发出了信号
+func signalsDeployment(block *Block, deployment *Deployment) bool {
+	return uint32(block.Version)&versionBitsTopMask == versionBitsTopBits && uint32(block.Version)&(1<<deployment.Bit) != 0
+}
+
+//沿PrevHash向前走n个块
+func (bc *BlockChain) ancestor(block *Block, n int) (*Block, error) {
+	for ; n > 0; n-- {
+		parent, err := bc.GetBlock(block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		block = &parent
+	}
+	return block, nil
+}
+
+//父块为prevHash的区块所处的部署状态 确认窗口与难度调整的窗口相同
+//窗口之内状态不变 所以只需要从前一个窗口的最后一个块开始 逐个窗口向后推算
+func (bc *BlockChain) thresholdState(prevHash []byte, id int) (ThresholdState, error) {
+	deployment := &netParams.Deployments[id]
+	window := netParams.RetargetInterval
+	if len(prevHash) == 0 {
+		return ThresholdDefined, nil
+	}
+	prev, err := bc.GetBlock(prevHash)
+	if err != nil {
+		return ThresholdDefined, err
+	}
+	//第一个窗口之内都是defined
+	if prev.Height+1 < window {
+		return ThresholdDefined, nil
+	}
+	node, err := bc.ancestor(&prev, (prev.Height+1)%window)
+	if err != nil {
+		return ThresholdDefined, err
+	}
+
+	//向前找到状态已知的窗口 沿途记录需要推算的窗口
+	var periods []*Block
+	state := ThresholdDefined
+	for node != nil {
+		if cached, ok := cachedThresholdState(id, node.Hash); ok {
+			state = cached
+			break
+		}
+		//还没有到开始时间的窗口一定是defined 不必再向前
+		if bc.CalcPastMedianTime(node) < deployment.StartTime {
+			cacheThresholdState(id, node.Hash, ThresholdDefined)
+			break
+		}
+		periods = append(periods, node)
+		if node.Height+1 < 2*window {
+			break
+		}
+		if node, err = bc.ancestor(node, window); err != nil {
+			return ThresholdDefined, err
+		}
+	}
+
+	//从最早的窗口开始推算状态
+	for i := len(periods) - 1; i >= 0; i-- {
+		node := periods[i]
+		medianTime := bc.CalcPastMedianTime(node)
+		switch state {
+		case ThresholdDefined:
+			if medianTime >= deployment.Timeout {
+				state = ThresholdFailed
+			} else if medianTime >= deployment.StartTime {
+				state = ThresholdStarted
+			}
+		case ThresholdStarted:
+			if medianTime >= deployment.Timeout {
+				state = ThresholdFailed
+				break
+			}
+			count, err := bc.countSignals(node, deployment, window)
+			if err != nil {
+				return ThresholdDefined, err
+			}
+			if count >= netParams.RuleChangeActivationThreshold {
+				state = ThresholdLockedIn
+			}
+		case ThresholdLockedIn:
+			state = ThresholdActive
+		}
+		cacheThresholdState(id, node.Hash, state)
+	}
+	return state, nil
+}
+
+//统计block及其之前共n个块中对部署发出信号的区块数 不足n个时到创世块为止
+func (bc *BlockChain) countSignals(block *Block, deployment *Deployment, n int) (int, error) {
+	count := 0
+	for i := 0; i < n; i++ {
+		if signalsDeployment(block, deployment) {
+			count++
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		parent, err := bc.GetBlock(block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		block = &parent
+	}
+	return count, nil
+}
+
+//父块为prevHash的区块是否执行部署id的规则
+func (bc *BlockChain) deploymentActive(prevHash []byte, id int) (bool, error) {
+	state, err := bc.thresholdState(prevHash, id)
+	if err != nil {
+		return false, err
+	}
+	return state == ThresholdActive, nil
+}
+
+//在prevHash之后生成的区块的版本 对处于started和locked_in状态的部署发出信号
+func (bc *BlockChain) computeBlockVersion(prevHash []byte) (int32, error) {
+	version := uint32(versionBitsTopBits)
+	for id := range netParams.Deployments {
+		state, err := bc.thresholdState(prevHash, id)
+		if err != nil {
+			return 0, err
+		}
+		if state == ThresholdStarted || state == ThresholdLockedIn {
+			version |= 1 << netParams.Deployments[id].Bit
+		}
+	}
+	return int32(version), nil
+}
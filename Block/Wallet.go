@@ -10,13 +10,19 @@ import (
 	"encoding/gob"
 	"bytes"
 	"fmt"
+	"errors"
 	"os"
 	"log"
+	"math/big"
 )
 
 const walletFile = "wallet_%s.dat"
 
 const version = byte(0x00)
+//多重签名地址的版本 地址中直接包含完整的锁定脚本
+const multiSigVersion = byte(0x07)
+//脚本哈希地址的版本 地址中是赎回脚本的哈希 花费时才公开赎回脚本
+const scriptHashVersion = byte(0x05)
 const addressChecksumLen = 4
 
 type Wallet struct {
@@ -61,6 +67,37 @@ func HashPubKey(pubKey []byte) []byte {
 	return publicRIPEMD160
 }
 
+//用私钥对哈希签名 r和s都补齐到32字节
+func signHash(privKey ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	return signature, nil
+}
+
+//用公钥验证signHash生成的签名
+func verifyHashSignature(pubKey, signature, hash []byte) bool {
+	if len(pubKey) == 0 || len(signature) != 64 {
+		return false
+	}
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:keyLen/2])
+	y.SetBytes(pubKey[keyLen/2:])
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
+}
+
 func checksum(payload []byte) []byte {
 	firstSHA := sha256.Sum256(payload)
 	secondSHA := sha256.Sum256(firstSHA[:])
@@ -139,10 +176,58 @@ func (ws *Wallets) SaveToFile(nodeID string) {
 
 
 func ValidateAddress(address string) bool{
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-addressChecksumLen]
-	targetChecksum := checksum(append([]byte{version},pubKeyHash...))
-	return bytes.Compare(actualChecksum,targetChecksum) == 0
-}
\ No newline at end of file
+	_, err := lockingScript(address)
+	return err == nil
+}
+
+//多重签名锁定脚本的地址
+func MultiSigAddress(script []byte) string {
+	return encodeAddress(multiSigVersion, script)
+}
+
+//付款给赎回脚本哈希的地址 赎回脚本可以是任意的花费条件
+func ScriptHashAddress(redeemScript []byte) string {
+	return encodeAddress(scriptHashVersion, HashPubKey(redeemScript))
+}
+
+func encodeAddress(version byte, payload []byte) string {
+	versionedPayload := append([]byte{version}, payload...)
+	fullPayload := append(versionedPayload, checksum(versionedPayload)...)
+	return string(Base58Encode(fullPayload))
+}
+
+//付款给地址的锁定脚本 普通地址付款给公钥哈希 脚本哈希地址付款给赎回脚本的哈希
+//多重签名地址使用其中的脚本
+func lockingScript(address string) ([]byte, error) {
+	if address == "" {
+		return nil, errors.New("address is empty")
+	}
+	fullPayload := Base58Decode([]byte(address))
+	if len(fullPayload) <= 1+addressChecksumLen {
+		return nil, fmt.Errorf("address %s is too short", address)
+	}
+	versionedPayload := fullPayload[:len(fullPayload)-addressChecksumLen]
+	actualChecksum := fullPayload[len(fullPayload)-addressChecksumLen:]
+	if !bytes.Equal(actualChecksum, checksum(versionedPayload)) {
+		return nil, fmt.Errorf("address %s has a bad checksum", address)
+	}
+	payload := versionedPayload[1:]
+	switch versionedPayload[0] {
+	case version:
+		if len(payload) != 20 {
+			return nil, fmt.Errorf("address %s has a bad public key hash", address)
+		}
+		return payToPubKeyHashScript(payload), nil
+	case scriptHashVersion:
+		if len(payload) != 20 {
+			return nil, fmt.Errorf("address %s has a bad script hash", address)
+		}
+		return payToScriptHashScript(payload), nil
+	case multiSigVersion:
+		if required, _ := extractMultiSig(payload); required == 0 {
+			return nil, fmt.Errorf("address %s has a bad multisig script", address)
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("address %s has unknown version %d", address, versionedPayload[0])
+}
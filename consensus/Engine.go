@@ -0,0 +1,45 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+)
+
+//封装空间(例如PoW的nonce)全部尝试过仍然没有成功
+//调用者可以改变区块内容(例如coinbase的extranonce)后重新封装
+var ErrNonceExhausted = errors.New("nonce space exhausted")
+
+//共识引擎需要读取的链上数据
+type ChainReader interface {
+	//根据哈希获取区块头 主链和分叉上的区块都可以查到
+	GetHeader(hash []byte) (*Header, error)
+}
+
+//共识引擎 决定区块如何产生 如何校验以及哪条分支是主链
+//height为header所在的高度 父块的高度为height-1
+type Engine interface {
+	//引擎的名称 创建区块链时记录在数据库中
+	Name() string
+
+	//填写区块头中由共识决定的字段 例如难度
+	Prepare(chain ChainReader, header *Header, height int) error
+
+	//封装区块 例如寻找满足难度的nonce 可以通过ctx取消
+	Seal(ctx context.Context, chain ChainReader, header *Header, height int) error
+
+	//检查区块头中由共识决定的字段是否与父块推算出的一致
+	VerifyHeader(chain ChainReader, header *Header, height int) error
+
+	//检查区块的封装是否合法
+	VerifySeal(chain ChainReader, header *Header, height int) error
+
+	//区块对分叉选择的贡献 从创世块开始累计值最大的分支是主链
+	CalcWork(chain ChainReader, header *Header, height int) *big.Int
+}
+
+//需要用私钥签名区块的共识引擎 挖矿节点启动时设置出块使用的密钥
+type Signer interface {
+	Authorize(key ecdsa.PrivateKey)
+}
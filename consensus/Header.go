@@ -0,0 +1,89 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//区块头中哈希的长度
+const HashLen = 32
+
+//区块头序列化后固定部分的长度 之后是变长的Extra
+//version(4) + prevHash(32) + merkleRoot(32) + timestamp(8) + bits(4) + nonce(8)
+const HeaderLen = 88
+
+//nonce在序列化结果中的偏移 挖矿时只需要改写这8个字节
+const NonceOffset = HeaderLen - 8
+
+//区块头 不包含交易也可以计算区块的哈希并在节点间传递
+type Header struct {
+	Version    int32  //区块版本
+	PrevHash   []byte //前一块哈希值 创世块为空
+	MerkleRoot []byte //交易的merkle根
+	Timestamp  int64  //时间戳
+	Bits       uint32 //难度目标的紧凑表示
+	Nonce      int    //工作量证明
+	Extra      []byte //共识引擎使用的附加数据 例如PoA的签名和投票
+}
+
+//将区块头序列化 创世块的PrevHash用0填充 Extra为空时长度固定为HeaderLen
+//PrevHash和MerkleRoot写在固定的位置 长度不是HashLen时返回错误
+func (h *Header) Serialize() ([]byte, error) {
+	if len(h.PrevHash) != HashLen && len(h.PrevHash) != 0 {
+		return nil, fmt.Errorf("Block header has a %d-byte previous hash, expected %d", len(h.PrevHash), HashLen)
+	}
+	if len(h.MerkleRoot) != HashLen {
+		return nil, fmt.Errorf("Block header has a %d-byte merkle root, expected %d", len(h.MerkleRoot), HashLen)
+	}
+	data := make([]byte, HeaderLen, HeaderLen+len(h.Extra))
+	binary.BigEndian.PutUint32(data[0:4], uint32(h.Version))
+	copy(data[4:36], h.PrevHash)
+	copy(data[36:68], h.MerkleRoot)
+	binary.BigEndian.PutUint64(data[68:76], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(data[76:80], h.Bits)
+	binary.BigEndian.PutUint64(data[NonceOffset:], uint64(h.Nonce))
+	return append(data, h.Extra...), nil
+}
+
+//反序列化区块头
+func DeserializeHeader(data []byte) (Header, error) {
+	var h Header
+	if len(data) < HeaderLen {
+		return h, errors.New("Block header has wrong length")
+	}
+	h.Version = int32(binary.BigEndian.Uint32(data[0:4]))
+	h.PrevHash = append([]byte{}, data[4:36]...)
+	//全0的前一块哈希表示创世块
+	if isZeroHash(h.PrevHash) {
+		h.PrevHash = []byte{}
+	}
+	h.MerkleRoot = append([]byte{}, data[36:68]...)
+	h.Timestamp = int64(binary.BigEndian.Uint64(data[68:76]))
+	h.Bits = binary.BigEndian.Uint32(data[76:80])
+	h.Nonce = int(binary.BigEndian.Uint64(data[NonceOffset:HeaderLen]))
+	if len(data) > HeaderLen {
+		h.Extra = append([]byte{}, data[HeaderLen:]...)
+	}
+	return h, nil
+}
+
+//区块的哈希 只由区块头计算 不能序列化的区块头返回nil 不会与任何区块的哈希相等
+func (h *Header) BlockHash() []byte {
+	data, err := h.Serialize()
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func isZeroHash(hash []byte) bool {
+	for _, b := range hash {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
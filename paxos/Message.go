@@ -0,0 +1,95 @@
+package paxos
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+//选票 轮次相同时按节点ID比较 保证不同节点的选票互不相同
+type Ballot struct {
+	Round uint64
+	Node  string
+}
+
+//比较两张选票 b小于other时返回负数 相等时返回0 大于时返回正数
+func (b Ballot) Compare(other Ballot) int {
+	switch {
+	case b.Round < other.Round:
+		return -1
+	case b.Round > other.Round:
+		return 1
+	case b.Node < other.Node:
+		return -1
+	case b.Node > other.Node:
+		return 1
+	}
+	return 0
+}
+
+//消息类型
+type MessageType int
+
+const (
+	MsgPrepare   MessageType = iota //阶段1a 候选者请求承诺 Slot为它还不知道结果的第一个位置
+	MsgPromise                      //阶段1b 接受者承诺不再接受更小的选票 并带上Slot之后接受过的值
+	MsgAccept                       //阶段2a 领导者请求接受者在Slot接受Value
+	MsgAccepted                     //阶段2b 接受者通知所有学习者自己接受了Value
+	MsgNack                         //接受者已经承诺了更大的选票Ballot
+	MsgHeartbeat                    //领导者的心跳 Slot为领导者还不知道结果的第一个位置
+	MsgCatchup                      //学习者向领导者请求从Slot开始已经确定的值
+	MsgDecide                       //领导者通知学习者Slot上确定的值
+	MsgForward                      //非领导者把提案转发给领导者
+)
+
+var messageTypeStrings = map[MessageType]string{
+	MsgPrepare:   "Prepare",
+	MsgPromise:   "Promise",
+	MsgAccept:    "Accept",
+	MsgAccepted:  "Accepted",
+	MsgNack:      "Nack",
+	MsgHeartbeat: "Heartbeat",
+	MsgCatchup:   "Catchup",
+	MsgDecide:    "Decide",
+	MsgForward:   "Forward",
+}
+
+func (t MessageType) String() string {
+	if s, ok := messageTypeStrings[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+//接受者在某个位置接受过的值
+type AcceptedEntry struct {
+	Slot   uint64
+	Ballot Ballot
+	Value  []byte
+}
+
+//节点之间传递的消息 不同类型的消息使用其中的不同字段
+type Message struct {
+	Type    MessageType
+	From    string
+	To      string
+	Ballot  Ballot
+	Slot    uint64
+	Value   []byte
+	Entries []AcceptedEntry //Promise中接受过的值
+}
+
+func (m *Message) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	if err := encoder.Encode(m); err != nil {
+		panic(err)
+	}
+	return result.Bytes()
+}
+
+func DeserializeMessage(data []byte) (Message, error) {
+	var msg Message
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&msg)
+	return msg, err
+}
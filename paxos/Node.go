@@ -0,0 +1,479 @@
+package paxos
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Catchup一次最多回复多少个确定的值
+const maxCatchupEntries = 100
+
+//节点配置
+type Config struct {
+	ID             string   //节点ID 使用TCPTransport时为监听地址
+	Peers          []string //集群中所有节点的ID 包括自己
+	HeartbeatTicks int      //领导者每隔多少个tick发送心跳并重发还没有确定的提案
+	ElectionTicks  int      //多少个tick没有领导者的消息后发起选举 实际在[ElectionTicks,2*ElectionTicks)之间随机
+	Applied        uint64   //已经应用过的最后一个位置 重启后从它的下一个位置开始应用
+
+	//按位置顺序应用确定的值 领导者为填补空位提出的空操作不会被应用
+	Apply func(slot uint64, value []byte)
+}
+
+//Multi-Paxos节点 同时扮演提案者 接受者和学习者
+//稳定的领导者对之后所有位置只执行一次阶段1 之后每个提案只需要阶段2
+//所有状态由一个互斥锁保护 发给自己的消息在当前处理结束前依次处理
+type Node struct {
+	mtx       sync.Mutex
+	config    Config
+	quorum    int
+	storage   *Storage
+	transport Transport
+	rand      *rand.Rand
+
+	//接受者
+	promised Ballot                   //承诺过的最大选票
+	accepted map[uint64]AcceptedEntry //每个位置接受过的值
+
+	//学习者
+	chosen        map[uint64][]byte                    //每个位置确定的值 nil为空操作
+	firstUnchosen uint64                               //第一个还不知道结果的位置
+	votes         map[uint64]map[Ballot]map[string]bool //位置->选票->接受了它的接受者
+	applied       uint64                               //已经应用的最后一个位置
+	applying      bool                                 //正在调用Apply
+
+	//提案者
+	ballot    Ballot             //本节点作为候选者或领导者使用的选票
+	maxRound  uint64             //见过的最大轮次 新的选票必须比它大
+	leader    string             //已知的领导者
+	isLeader  bool               //本节点是领导者
+	preparing bool               //本节点正在执行阶段1
+	promises  map[string]Message //阶段1收到的承诺
+	nextSlot  uint64             //领导者下一个提案使用的位置
+	pending   map[uint64][]byte  //已经发出Accept还没有确定的值
+	queue     [][]byte           //还没有领导者时暂存的提案
+
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+
+	local []Message //发给自己的消息
+}
+
+//创建节点并从storage中恢复持久化的状态
+func NewNode(config Config, storage *Storage, transport Transport) (*Node, error) {
+	member := false
+	for _, peer := range config.Peers {
+		if peer == config.ID {
+			member = true
+		}
+	}
+	if !member {
+		return nil, errors.New("paxos: node is not one of its peers")
+	}
+	if config.HeartbeatTicks <= 0 || config.ElectionTicks <= config.HeartbeatTicks {
+		return nil, errors.New("paxos: election ticks must be greater than heartbeat ticks")
+	}
+
+	promised, accepted, chosen, err := storage.load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:    config,
+		quorum:    len(config.Peers)/2 + 1,
+		storage:   storage,
+		transport: transport,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		promised:  promised,
+		accepted:  accepted,
+		chosen:    chosen,
+		votes:     make(map[uint64]map[Ballot]map[string]bool),
+		applied:   config.Applied,
+		maxRound:  promised.Round,
+		pending:   make(map[uint64][]byte),
+	}
+	n.firstUnchosen = 1
+	n.advance()
+	n.resetElectionTimeout()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+//已知的领导者 不知道时为空
+func (n *Node) Leader() string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.leader
+}
+
+func (n *Node) IsLeader() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.isLeader
+}
+
+//slot上确定的值 还不知道结果时返回false
+func (n *Node) Chosen(slot uint64) ([]byte, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	value, ok := n.chosen[slot]
+	return value, ok
+}
+
+//提出一个值 领导者直接为它分配位置 其他节点转发给领导者
+//提案可能因为消息丢失或领导者故障而丢失 调用者在Apply中确认 必要时重新提出
+func (n *Node) Propose(value []byte) {
+	n.mtx.Lock()
+	n.propose(value)
+	n.flush()
+	n.mtx.Unlock()
+	n.deliver()
+}
+
+//处理收到的消息
+func (n *Node) Step(msg Message) {
+	n.mtx.Lock()
+	n.handle(msg)
+	n.flush()
+	n.mtx.Unlock()
+	n.deliver()
+}
+
+//推进逻辑时钟 领导者发送心跳 其他节点检查领导者是否超时
+func (n *Node) Tick() {
+	n.mtx.Lock()
+	if n.isLeader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.config.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcast(Message{Type: MsgHeartbeat, Ballot: n.ballot, Slot: n.firstUnchosen})
+			//Accept或者Accepted丢失时重新发送
+			for slot, value := range n.pending {
+				n.broadcast(Message{Type: MsgAccept, Ballot: n.ballot, Slot: slot, Value: value})
+			}
+		}
+	} else {
+		n.electionElapsed++
+		if n.electionElapsed >= n.electionTimeout {
+			n.startElection()
+		}
+	}
+	n.flush()
+	n.mtx.Unlock()
+	n.deliver()
+}
+
+//每隔interval推进一次逻辑时钟 直到ctx被取消
+func (n *Node) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.Tick()
+		}
+	}
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.config.ElectionTicks + n.rand.Intn(n.config.ElectionTicks)
+}
+
+func (n *Node) send(msg Message) {
+	msg.From = n.config.ID
+	if msg.To == n.config.ID {
+		n.local = append(n.local, msg)
+		return
+	}
+	n.transport.Send(msg)
+}
+
+func (n *Node) broadcast(msg Message) {
+	for _, peer := range n.config.Peers {
+		msg.To = peer
+		n.send(msg)
+	}
+}
+
+//处理发给自己的消息
+func (n *Node) flush() {
+	for len(n.local) > 0 {
+		msg := n.local[0]
+		n.local = n.local[1:]
+		n.handle(msg)
+	}
+}
+
+func (n *Node) handle(msg Message) {
+	if msg.Ballot.Round > n.maxRound {
+		n.maxRound = msg.Ballot.Round
+	}
+	switch msg.Type {
+	case MsgPrepare:
+		n.onPrepare(msg)
+	case MsgPromise:
+		n.onPromise(msg)
+	case MsgAccept:
+		n.onAccept(msg)
+	case MsgAccepted:
+		n.onAccepted(msg)
+	case MsgNack:
+		n.onNack(msg)
+	case MsgHeartbeat:
+		n.onHeartbeat(msg)
+	case MsgCatchup:
+		n.onCatchup(msg)
+	case MsgDecide:
+		n.choose(msg.Slot, msg.Value)
+	case MsgForward:
+		n.propose(msg.Value)
+	}
+}
+
+func (n *Node) propose(value []byte) {
+	switch {
+	case n.isLeader:
+		slot := n.nextSlot
+		n.nextSlot++
+		n.pending[slot] = value
+		n.broadcast(Message{Type: MsgAccept, Ballot: n.ballot, Slot: slot, Value: value})
+	case n.leader != "" && n.leader != n.config.ID:
+		n.send(Message{Type: MsgForward, To: n.leader, Value: value})
+	default:
+		n.queue = append(n.queue, value)
+	}
+}
+
+//收到更大的选票后不再作为领导者或候选者
+func (n *Node) stepDown(ballot Ballot) {
+	if (n.isLeader || n.preparing) && n.ballot.Compare(ballot) < 0 {
+		n.isLeader = false
+		n.preparing = false
+		n.pending = make(map[uint64][]byte)
+	}
+}
+
+//使用比见过的所有选票都大的选票执行阶段1
+func (n *Node) startElection() {
+	n.maxRound++
+	n.ballot = Ballot{n.maxRound, n.config.ID}
+	n.isLeader = false
+	n.preparing = true
+	n.leader = ""
+	n.promises = make(map[string]Message)
+	n.resetElectionTimeout()
+	n.broadcast(Message{Type: MsgPrepare, Ballot: n.ballot, Slot: n.firstUnchosen})
+}
+
+//阶段1b 承诺不再接受更小的选票 并告诉候选者Slot之后接受过的值
+func (n *Node) onPrepare(msg Message) {
+	if msg.Ballot.Compare(n.promised) < 0 {
+		n.send(Message{Type: MsgNack, To: msg.From, Ballot: n.promised})
+		return
+	}
+	if msg.Ballot != n.promised {
+		//承诺写入磁盘之后才能回复
+		if err := n.storage.savePromised(msg.Ballot); err != nil {
+			return
+		}
+		n.promised = msg.Ballot
+	}
+	n.stepDown(msg.Ballot)
+	if msg.From != n.config.ID {
+		n.leader = ""
+		n.resetElectionTimeout()
+	}
+
+	var entries []AcceptedEntry
+	for slot, entry := range n.accepted {
+		if slot >= msg.Slot {
+			entries = append(entries, entry)
+		}
+	}
+	n.send(Message{Type: MsgPromise, To: msg.From, Ballot: msg.Ballot, Entries: entries})
+}
+
+func (n *Node) onPromise(msg Message) {
+	if !n.preparing || msg.Ballot != n.ballot {
+		return
+	}
+	n.promises[msg.From] = msg
+	if len(n.promises) >= n.quorum {
+		n.becomeLeader()
+	}
+}
+
+//获得多数承诺后成为领导者
+//多数接受者中选票最大的值可能已经被确定 必须在同一个位置重新提出 其余空位用空操作填补
+func (n *Node) becomeLeader() {
+	n.preparing = false
+	n.isLeader = true
+	n.leader = n.config.ID
+	n.heartbeatElapsed = 0
+	n.pending = make(map[uint64][]byte)
+
+	highest := make(map[uint64]AcceptedEntry)
+	last := n.firstUnchosen - 1
+	for _, promise := range n.promises {
+		for _, entry := range promise.Entries {
+			if current, ok := highest[entry.Slot]; !ok || current.Ballot.Compare(entry.Ballot) < 0 {
+				highest[entry.Slot] = entry
+			}
+			if entry.Slot > last {
+				last = entry.Slot
+			}
+		}
+	}
+	for slot := n.firstUnchosen; slot <= last; slot++ {
+		if _, ok := n.chosen[slot]; ok {
+			continue
+		}
+		value := highest[slot].Value
+		n.pending[slot] = value
+		n.broadcast(Message{Type: MsgAccept, Ballot: n.ballot, Slot: slot, Value: value})
+	}
+	n.nextSlot = last + 1
+
+	n.broadcast(Message{Type: MsgHeartbeat, Ballot: n.ballot, Slot: n.firstUnchosen})
+	queue := n.queue
+	n.queue = nil
+	for _, value := range queue {
+		n.propose(value)
+	}
+}
+
+//阶段2b 接受值并通知所有学习者
+func (n *Node) onAccept(msg Message) {
+	if msg.Ballot.Compare(n.promised) < 0 {
+		n.send(Message{Type: MsgNack, To: msg.From, Ballot: n.promised})
+		return
+	}
+	entry := AcceptedEntry{msg.Slot, msg.Ballot, msg.Value}
+	//接受的值写入磁盘之后才能回复
+	if err := n.storage.saveAccepted(msg.Ballot, entry); err != nil {
+		return
+	}
+	n.promised = msg.Ballot
+	n.accepted[msg.Slot] = entry
+	n.stepDown(msg.Ballot)
+	n.followLeader(msg.From)
+	n.broadcast(Message{Type: MsgAccepted, Ballot: msg.Ballot, Slot: msg.Slot, Value: msg.Value})
+}
+
+//多数接受者在同一个选票下接受了同一个值 这个值被确定
+func (n *Node) onAccepted(msg Message) {
+	if _, ok := n.chosen[msg.Slot]; ok {
+		return
+	}
+	if n.votes[msg.Slot] == nil {
+		n.votes[msg.Slot] = make(map[Ballot]map[string]bool)
+	}
+	if n.votes[msg.Slot][msg.Ballot] == nil {
+		n.votes[msg.Slot][msg.Ballot] = make(map[string]bool)
+	}
+	n.votes[msg.Slot][msg.Ballot][msg.From] = true
+	if len(n.votes[msg.Slot][msg.Ballot]) >= n.quorum {
+		n.choose(msg.Slot, msg.Value)
+	}
+}
+
+func (n *Node) onNack(msg Message) {
+	n.stepDown(msg.Ballot)
+}
+
+//领导者的心跳 落后的学习者请求补齐确定的值
+func (n *Node) onHeartbeat(msg Message) {
+	if msg.Ballot.Compare(n.promised) < 0 {
+		n.send(Message{Type: MsgNack, To: msg.From, Ballot: n.promised})
+		return
+	}
+	n.stepDown(msg.Ballot)
+	n.followLeader(msg.From)
+	if n.firstUnchosen < msg.Slot {
+		n.send(Message{Type: MsgCatchup, To: msg.From, Slot: n.firstUnchosen})
+	}
+}
+
+//记录领导者 把暂存的提案转发给它
+func (n *Node) followLeader(leader string) {
+	if leader == n.config.ID {
+		return
+	}
+	n.leader = leader
+	n.resetElectionTimeout()
+	queue := n.queue
+	n.queue = nil
+	for _, value := range queue {
+		n.propose(value)
+	}
+}
+
+func (n *Node) onCatchup(msg Message) {
+	for slot, count := msg.Slot, 0; slot < n.firstUnchosen && count < maxCatchupEntries; slot, count = slot+1, count+1 {
+		n.send(Message{Type: MsgDecide, To: msg.From, Slot: slot, Value: n.chosen[slot]})
+	}
+}
+
+//记录确定的值
+func (n *Node) choose(slot uint64, value []byte) {
+	if _, ok := n.chosen[slot]; ok {
+		return
+	}
+	if err := n.storage.saveChosen(slot, value); err != nil {
+		return
+	}
+	n.chosen[slot] = value
+	delete(n.votes, slot)
+	delete(n.pending, slot)
+	n.advance()
+}
+
+//移动到第一个还不知道结果的位置
+func (n *Node) advance() {
+	for {
+		if _, ok := n.chosen[n.firstUnchosen]; !ok {
+			break
+		}
+		n.firstUnchosen++
+	}
+	if n.isLeader && n.nextSlot < n.firstUnchosen {
+		n.nextSlot = n.firstUnchosen
+	}
+}
+
+//按顺序应用确定的值 Apply在锁外调用 可以在其中调用Propose
+//同一时间只有一个调用者在应用 其他调用者新确定的值由它继续应用
+func (n *Node) deliver() {
+	n.mtx.Lock()
+	if n.applying || n.config.Apply == nil {
+		n.mtx.Unlock()
+		return
+	}
+	n.applying = true
+	for {
+		value, ok := n.chosen[n.applied+1]
+		if !ok {
+			break
+		}
+		n.applied++
+		if value == nil {
+			continue
+		}
+		slot := n.applied
+		n.mtx.Unlock()
+		n.config.Apply(slot, value)
+		n.mtx.Lock()
+	}
+	n.applying = false
+	n.mtx.Unlock()
+}
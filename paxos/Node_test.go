@@ -0,0 +1,270 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//记录经过的所有消息 之后可以重放给接收者
+type recordingTransport struct {
+	mtx  sync.Mutex
+	next Transport
+	sent []Message
+}
+
+func (r *recordingTransport) Send(msg Message) {
+	r.mtx.Lock()
+	r.sent = append(r.sent, msg)
+	r.mtx.Unlock()
+	r.next.Send(msg)
+}
+
+type testNode struct {
+	db     *bolt.DB
+	node   *Node
+	cancel context.CancelFunc
+	down   bool
+}
+
+//运行在进程内网络上的集群 每个节点的数据库放在临时目录中
+type testCluster struct {
+	t        *testing.T
+	dir      string
+	peers    []string
+	network  *MemoryNetwork
+	recorder *recordingTransport
+	nodes    map[string]*testNode
+	proposed int
+}
+
+func newTestCluster(t *testing.T, size int, loss, duplicate float64) *testCluster {
+	dir, err := ioutil.TempDir("", "paxos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewMemoryNetwork(loss, duplicate)
+	c := &testCluster{
+		t:        t,
+		dir:      dir,
+		network:  network,
+		recorder: &recordingTransport{next: network},
+		nodes:    make(map[string]*testNode),
+	}
+	for i := 0; i < size; i++ {
+		c.peers = append(c.peers, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.peers {
+		c.start(id)
+	}
+	return c
+}
+
+//启动节点 数据库已经存在时从中恢复
+func (c *testCluster) start(id string) {
+	db, err := bolt.Open(filepath.Join(c.dir, id+".db"), 0600, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	storage, err := NewStorage(db)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	node, err := NewNode(Config{ID: id, Peers: c.peers, HeartbeatTicks: 2, ElectionTicks: 10}, storage, c.recorder)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.nodes[id] = &testNode{db, node, cancel, false}
+	c.network.Join(node)
+	c.network.SetDown(id, false)
+	go node.Run(ctx, 5*time.Millisecond)
+}
+
+//让节点宕机 它收发的消息全部丢失
+func (c *testCluster) stop(id string) {
+	tn := c.nodes[id]
+	c.network.SetDown(id, true)
+	tn.cancel()
+	tn.db.Close()
+	tn.down = true
+}
+
+func (c *testCluster) close() {
+	for id, tn := range c.nodes {
+		if !tn.down {
+			c.stop(id)
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+func (c *testCluster) live() []string {
+	var ids []string
+	for _, id := range c.peers {
+		if !c.nodes[id].down {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//由正常的节点轮流提出count个新的值
+func (c *testCluster) propose(count int) [][]byte {
+	live := c.live()
+	var values [][]byte
+	for i := 0; i < count; i++ {
+		value := []byte(fmt.Sprintf("value%d", c.proposed))
+		c.proposed++
+		values = append(values, value)
+		c.nodes[live[i%len(live)]].node.Propose(value)
+		time.Sleep(5 * time.Millisecond)
+	}
+	return values
+}
+
+//节点从位置1开始连续确定的值
+func (c *testCluster) learned(id string) [][]byte {
+	var log [][]byte
+	for slot := uint64(1); ; slot++ {
+		value, ok := c.nodes[id].node.Chosen(slot)
+		if !ok {
+			return log
+		}
+		log = append(log, value)
+	}
+}
+
+//等待所有正常的节点学到相同的序列 并且序列包含values中的每个值
+//任何时候两个节点在同一个位置学到不同的值都会让测试失败 提案丢失时重新提出缺少的值
+func (c *testCluster) waitAgreement(values [][]byte) [][]byte {
+	for attempt := 0; attempt < 400; attempt++ {
+		time.Sleep(50 * time.Millisecond)
+		live := c.live()
+		first := c.learned(live[0])
+		agreed := true
+		for _, id := range live[1:] {
+			log := c.learned(id)
+			for i := 0; i < len(log) && i < len(first); i++ {
+				if !bytes.Equal(log[i], first[i]) {
+					c.t.Fatalf("%s learned %q at slot %d, %s learned %q", id, log[i], i+1, live[0], first[i])
+				}
+			}
+			if len(log) != len(first) {
+				agreed = false
+			}
+		}
+
+		var missing [][]byte
+		for _, value := range values {
+			found := false
+			for _, v := range first {
+				if bytes.Equal(v, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, value)
+			}
+		}
+		if agreed && len(missing) == 0 {
+			return first
+		}
+		if attempt%10 == 9 {
+			for i, value := range missing {
+				c.nodes[live[i%len(live)]].node.Propose(value)
+			}
+		}
+	}
+	c.t.Fatal("nodes did not learn the same sequence of values")
+	return nil
+}
+
+//等待正常的节点中只有一个领导者
+func (c *testCluster) leader() string {
+	for attempt := 0; attempt < 200; attempt++ {
+		var leaders []string
+		for _, id := range c.live() {
+			if c.nodes[id].node.IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatal("no single leader was elected")
+	return ""
+}
+
+//把记录的所有消息按相反的顺序重新交给接收者
+func (c *testCluster) replay() {
+	c.recorder.mtx.Lock()
+	sent := append([]Message{}, c.recorder.sent...)
+	c.recorder.mtx.Unlock()
+	for i := len(sent) - 1; i >= 0; i-- {
+		msg, err := DeserializeMessage(sent[i].Serialize())
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if tn := c.nodes[msg.To]; !tn.down {
+			tn.node.Step(msg)
+		}
+	}
+}
+
+func TestAgreementWithMessageLoss(t *testing.T) {
+	c := newTestCluster(t, 5, 0.3, 0)
+	defer c.close()
+	c.waitAgreement(c.propose(20))
+}
+
+func TestAgreementWithDuplicatedMessages(t *testing.T) {
+	c := newTestCluster(t, 5, 0, 0.5)
+	defer c.close()
+	values := c.propose(20)
+	before := c.waitAgreement(values)
+
+	//重放之后已经学到的值不能改变
+	c.replay()
+	after := c.waitAgreement(values)
+	for i := range before {
+		if !bytes.Equal(before[i], after[i]) {
+			t.Fatalf("slot %d changed from %q to %q after messages were replayed", i+1, before[i], after[i])
+		}
+	}
+}
+
+func TestAgreementAfterLeaderFailure(t *testing.T) {
+	c := newTestCluster(t, 5, 0.1, 0.1)
+	defer c.close()
+	values := c.propose(10)
+	c.waitAgreement(values)
+
+	crashed := c.leader()
+	c.stop(crashed)
+	values = append(values, c.propose(10)...)
+	before := c.waitAgreement(values)
+	if leader := c.leader(); leader == crashed {
+		t.Fatalf("crashed leader %s is still the leader", crashed)
+	}
+
+	//原领导者从数据库重启后补齐日志
+	c.start(crashed)
+	after := c.waitAgreement(values)
+	for i := range before {
+		if !bytes.Equal(before[i], after[i]) {
+			t.Fatalf("slot %d changed from %q to %q after %s restarted", i+1, before[i], after[i], crashed)
+		}
+	}
+}
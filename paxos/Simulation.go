@@ -0,0 +1,191 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//模拟的参数
+type SimulationConfig struct {
+	Nodes     int     //集群节点数
+	Values    int     //提出的值的个数
+	Loss      float64 //消息丢失的概率
+	Duplicate float64 //消息重复的概率
+	Dir       string  //节点数据库所在的目录
+}
+
+//模拟中的一个节点 记录它按顺序应用的值
+type simNode struct {
+	id      string
+	path    string
+	db      *bolt.DB
+	node    *Node
+	cancel  context.CancelFunc
+	applied uint64
+	log     [][]byte
+	seen    map[string]bool
+}
+
+//在进程内的网络上运行一个集群 检查消息丢失 重复和领导者故障时所有节点得到相同的序列
+//提出一半的值后领导者宕机 剩下的节点选出新的领导者 全部提出后原领导者从数据库重启并补齐日志
+//提案和转发可能丢失或重复 客户端重新提出还没有应用的值 应用时跳过已经应用过的值
+func Simulate(config SimulationConfig) error {
+	network := NewMemoryNetwork(config.Loss, config.Duplicate)
+	var peers []string
+	for i := 0; i < config.Nodes; i++ {
+		peers = append(peers, fmt.Sprintf("node%d", i))
+	}
+
+	var mtx sync.Mutex
+	nodes := make(map[string]*simNode)
+	start := func(sn *simNode) error {
+		db, err := bolt.Open(sn.path, 0600, nil)
+		if err != nil {
+			return err
+		}
+		storage, err := NewStorage(db)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		node, err := NewNode(Config{
+			ID:             sn.id,
+			Peers:          peers,
+			HeartbeatTicks: 2,
+			ElectionTicks:  10,
+			Applied:        sn.applied,
+			Apply: func(slot uint64, value []byte) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				sn.applied = slot
+				if !sn.seen[string(value)] {
+					sn.seen[string(value)] = true
+					sn.log = append(sn.log, value)
+				}
+			},
+		}, storage, network)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sn.db, sn.node, sn.cancel = db, node, cancel
+		network.Join(node)
+		network.SetDown(sn.id, false)
+		go node.Run(ctx, 5*time.Millisecond)
+		return nil
+	}
+	stop := func(sn *simNode) {
+		network.SetDown(sn.id, true)
+		sn.cancel()
+		sn.db.Close()
+	}
+
+	for _, id := range peers {
+		sn := &simNode{id: id, path: filepath.Join(config.Dir, "paxos_"+id+".db"), seen: make(map[string]bool)}
+		os.Remove(sn.path)
+		if err := start(sn); err != nil {
+			return err
+		}
+		nodes[id] = sn
+	}
+	defer func() {
+		for _, sn := range nodes {
+			stop(sn)
+			os.Remove(sn.path)
+		}
+	}()
+
+	//等待所有正常的节点应用全部已经提出的值 超时后重新提出缺少的值
+	var values [][]byte
+	var crashed *simNode
+	wait := func() error {
+		for attempt := 0; attempt < 100; attempt++ {
+			time.Sleep(100 * time.Millisecond)
+			mtx.Lock()
+			var missing [][]byte
+			for _, value := range values {
+				for _, sn := range nodes {
+					if sn != crashed && !sn.seen[string(value)] {
+						missing = append(missing, value)
+						break
+					}
+				}
+			}
+			mtx.Unlock()
+			if len(missing) == 0 {
+				return nil
+			}
+			for i, value := range missing {
+				proposer := nodes[peers[i%len(peers)]]
+				if proposer != crashed {
+					proposer.node.Propose(value)
+				}
+			}
+		}
+		return fmt.Errorf("paxos: values were not applied on every node")
+	}
+
+	for i := 0; i < config.Values; i++ {
+		value := []byte(fmt.Sprintf("value%d", i))
+		values = append(values, value)
+		proposer := nodes[peers[i%len(peers)]]
+		if proposer != crashed {
+			proposer.node.Propose(value)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		if i == config.Values/2 {
+			if err := wait(); err != nil {
+				return err
+			}
+			for _, sn := range nodes {
+				if sn.node.IsLeader() {
+					crashed = sn
+				}
+			}
+			if crashed == nil {
+				return fmt.Errorf("paxos: no leader after %d values", i+1)
+			}
+			fmt.Printf("%s (leader) crashed\n", crashed.id)
+			stop(crashed)
+		}
+	}
+	if err := wait(); err != nil {
+		return err
+	}
+	if crashed != nil {
+		fmt.Printf("%s restarted from %s\n", crashed.id, crashed.path)
+		if err := start(crashed); err != nil {
+			return err
+		}
+		crashed = nil
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	first := nodes[peers[0]]
+	for _, id := range peers {
+		sn := nodes[id]
+		fmt.Printf("%s applied %d values, leader: %t\n", sn.id, len(sn.log), sn.node.IsLeader())
+		if len(sn.log) != len(first.log) {
+			return fmt.Errorf("paxos: %s applied %d values, %s applied %d", sn.id, len(sn.log), first.id, len(first.log))
+		}
+		for i := range sn.log {
+			if !bytes.Equal(sn.log[i], first.log[i]) {
+				return fmt.Errorf("paxos: %s and %s disagree at value %d", sn.id, first.id, i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package paxos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/boltdb/bolt"
+)
+
+//接受者的持久化状态 回复Promise和Accepted之前必须写入 节点崩溃重启后不会违背之前的承诺
+//键："promised"   值：承诺过的最大选票
+const acceptorBucket = "paxos_acceptor"
+
+//键：位置(8字节大端)   值：该位置接受过的选票和值
+const acceptedBucket = "paxos_accepted"
+
+//学习者已经知道的结果
+//键：位置(8字节大端)   值：该位置确定的值
+const chosenBucket = "paxos_chosen"
+
+//保存在bolt数据库中的Paxos状态 可以和区块链共用一个数据库
+type Storage struct {
+	db *bolt.DB
+}
+
+//在db中创建Paxos使用的桶
+func NewStorage(db *bolt.DB) (*Storage, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{acceptorBucket, acceptedBucket, chosenBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db}, nil
+}
+
+func slotKey(slot uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, slot)
+	return key
+}
+
+func encode(v interface{}) []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	if err := encoder.Encode(v); err != nil {
+		panic(err)
+	}
+	return result.Bytes()
+}
+
+func decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (s *Storage) savePromised(ballot Ballot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(acceptorBucket)).Put([]byte("promised"), encode(ballot))
+	})
+}
+
+//接受一个值时同时更新承诺 两者在同一个事务中写入
+func (s *Storage) saveAccepted(promised Ballot, entry AcceptedEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(acceptorBucket)).Put([]byte("promised"), encode(promised)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(acceptedBucket)).Put(slotKey(entry.Slot), encode(entry))
+	})
+}
+
+func (s *Storage) saveChosen(slot uint64, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(chosenBucket)).Put(slotKey(slot), encode(AcceptedEntry{Slot: slot, Value: value}))
+	})
+}
+
+//读取全部持久化状态
+func (s *Storage) load() (promised Ballot, accepted map[uint64]AcceptedEntry, chosen map[uint64][]byte, err error) {
+	accepted = make(map[uint64]AcceptedEntry)
+	chosen = make(map[uint64][]byte)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket([]byte(acceptorBucket)).Get([]byte("promised")); data != nil {
+			if err := decode(data, &promised); err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket([]byte(acceptedBucket)).ForEach(func(k, v []byte) error {
+			var entry AcceptedEntry
+			if err := decode(v, &entry); err != nil {
+				return err
+			}
+			accepted[entry.Slot] = entry
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(chosenBucket)).ForEach(func(k, v []byte) error {
+			var entry AcceptedEntry
+			if err := decode(v, &entry); err != nil {
+				return err
+			}
+			chosen[entry.Slot] = entry.Value
+			return nil
+		})
+	})
+	return promised, accepted, chosen, err
+}
@@ -0,0 +1,115 @@
+package paxos
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//节点之间的消息传输 Send必须是异步的 不需要保证送达 也不需要保证顺序
+//消息丢失和重复由协议本身处理
+type Transport interface {
+	Send(msg Message)
+}
+
+//通过TCP传输消息 节点ID就是节点监听的地址 每条消息使用一个连接
+type TCPTransport struct{}
+
+func (TCPTransport) Send(msg Message) {
+	go func() {
+		conn, err := net.DialTimeout("tcp", msg.To, time.Second)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, bytes.NewReader(msg.Serialize()))
+	}()
+}
+
+//在addr上监听其他节点的消息并交给node处理 直到监听出错
+func ListenTCP(addr string, node *Node) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			data, err := ioutil.ReadAll(conn)
+			if err != nil {
+				return
+			}
+			if msg, err := DeserializeMessage(data); err == nil {
+				node.Step(msg)
+			}
+		}(conn)
+	}
+}
+
+//进程内模拟的网络 可以按概率丢弃和重复消息 也可以让节点宕机
+//用于在一个进程中演示和检查集群在消息丢失 重复和领导者故障时的行为
+type MemoryNetwork struct {
+	mtx       sync.Mutex
+	nodes     map[string]*Node
+	down      map[string]bool
+	loss      float64 //消息丢失的概率
+	duplicate float64 //消息重复的概率
+	rand      *rand.Rand
+}
+
+func NewMemoryNetwork(loss, duplicate float64) *MemoryNetwork {
+	return &MemoryNetwork{
+		nodes:     make(map[string]*Node),
+		down:      make(map[string]bool),
+		loss:      loss,
+		duplicate: duplicate,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+//把节点接入网络
+func (n *MemoryNetwork) Join(node *Node) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.nodes[node.ID()] = node
+}
+
+//让节点宕机或者恢复 宕机节点收发的消息全部丢失
+func (n *MemoryNetwork) SetDown(id string, down bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.down[id] = down
+}
+
+func (n *MemoryNetwork) Send(msg Message) {
+	n.mtx.Lock()
+	node := n.nodes[msg.To]
+	if node == nil || n.down[msg.From] || n.down[msg.To] || n.rand.Float64() < n.loss {
+		n.mtx.Unlock()
+		return
+	}
+	copies := 1
+	if n.rand.Float64() < n.duplicate {
+		copies = 2
+	}
+	n.mtx.Unlock()
+
+	//经过序列化 接收者不会和发送者共享切片
+	data := msg.Serialize()
+	for i := 0; i < copies; i++ {
+		go func() {
+			if m, err := DeserializeMessage(data); err == nil {
+				node.Step(m)
+			}
+		}()
+	}
+}
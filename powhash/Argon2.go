@@ -0,0 +1,125 @@
+package powhash
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+//仿照Argon2d的内存困难哈希 每次哈希填充argonBlocks个1KB的块 共256KB
+//与Argon2d相同 引用的块由前一个块的内容决定 所以不能预先知道需要哪些块 只能全部保存
+//压缩函数与Argon2相同 使用BlaMka置换 初始化和输出用SHA-256代替Blake2b
+const (
+	argonBlocks = 256
+	argonPasses = 1
+	argonWords  = 128 //每个块128个64位字
+)
+
+type argonBlock [argonWords]uint64
+
+func Argon2(data []byte) []byte {
+	memory := make([]argonBlock, argonBlocks)
+	h0 := sha256.Sum256(data)
+	argonInit(&memory[0], h0[:], 0)
+	argonInit(&memory[1], h0[:], 1)
+
+	for pass := 0; pass < argonPasses; pass++ {
+		for i := 0; i < argonBlocks; i++ {
+			if pass == 0 && i < 2 {
+				continue
+			}
+			prev := (i + argonBlocks - 1) % argonBlocks
+			//第一遍只能引用已经填充过的块 之后可以引用任意一块
+			candidates := uint64(i)
+			if pass > 0 {
+				candidates = argonBlocks
+			}
+			ref := memory[prev][0] % candidates
+			var next argonBlock
+			argonCompress(&next, &memory[prev], &memory[ref])
+			if pass > 0 {
+				for k := range next {
+					memory[i][k] ^= next[k]
+				}
+			} else {
+				memory[i] = next
+			}
+		}
+	}
+
+	out := make([]byte, argonWords*8)
+	for k, w := range memory[argonBlocks-1] {
+		binary.LittleEndian.PutUint64(out[k*8:], w)
+	}
+	hash := sha256.Sum256(out)
+	return hash[:]
+}
+
+//用H0和块的序号以计数器模式展开出1KB的初始块
+func argonInit(block *argonBlock, h0 []byte, index uint32) {
+	input := make([]byte, len(h0)+8)
+	copy(input, h0)
+	binary.LittleEndian.PutUint32(input[len(h0):], index)
+	for counter := 0; counter < argonWords/4; counter++ {
+		binary.LittleEndian.PutUint32(input[len(h0)+4:], uint32(counter))
+		sum := sha256.Sum256(input)
+		for k := 0; k < 4; k++ {
+			block[counter*4+k] = binary.LittleEndian.Uint64(sum[k*8:])
+		}
+	}
+}
+
+//Argon2的压缩函数G R=X^Y 对R的8行和8列分别做BlaMka置换 结果再与R异或
+func argonCompress(out, x, y *argonBlock) {
+	var r argonBlock
+	for k := range r {
+		r[k] = x[k] ^ y[k]
+	}
+	q := r
+	for i := 0; i < 8; i++ {
+		var row [16]int
+		for j := range row {
+			row[j] = 16*i + j
+		}
+		blamkaRound(&q, &row)
+	}
+	for i := 0; i < 8; i++ {
+		var column [16]int
+		for j := 0; j < 8; j++ {
+			column[2*j] = 2*i + 16*j
+			column[2*j+1] = 2*i + 16*j + 1
+		}
+		blamkaRound(&q, &column)
+	}
+	for k := range out {
+		out[k] = q[k] ^ r[k]
+	}
+}
+
+//对idx指定的16个字做一轮Blake2b的置换 加法换成BlaMka的乘加
+func blamkaRound(v *argonBlock, idx *[16]int) {
+	blamkaG(v, idx[0], idx[4], idx[8], idx[12])
+	blamkaG(v, idx[1], idx[5], idx[9], idx[13])
+	blamkaG(v, idx[2], idx[6], idx[10], idx[14])
+	blamkaG(v, idx[3], idx[7], idx[11], idx[15])
+	blamkaG(v, idx[0], idx[5], idx[10], idx[15])
+	blamkaG(v, idx[1], idx[6], idx[11], idx[12])
+	blamkaG(v, idx[2], idx[7], idx[8], idx[13])
+	blamkaG(v, idx[3], idx[4], idx[9], idx[14])
+}
+
+func blamkaG(v *argonBlock, a, b, c, d int) {
+	v[a] = blamka(v[a], v[b])
+	v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+	v[c] = blamka(v[c], v[d])
+	v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+	v[a] = blamka(v[a], v[b])
+	v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+	v[c] = blamka(v[c], v[d])
+	v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+}
+
+//x + y + 2 * 低32位(x) * 低32位(y) 乘法使GPU和ASIC上的优化更困难
+func blamka(x, y uint64) uint64 {
+	return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+}
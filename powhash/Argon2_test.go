@@ -0,0 +1,42 @@
+package powhash
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+//Argon2是本项目自己的构造 没有公开的测试向量
+//固定的输出防止修改参数或者实现时无意中改变已有区块链的工作量证明
+func TestArgon2Regression(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{}, "d2c2f552e50e9acd948043ad3e95d991dac6085c2662c90ea42bc7b0c759ef9f"},
+		{[]byte("abc"), "4533a3ebed5cc3a734943f00eb805b6b3e42dcb38de66da71727decbdd098d30"},
+		{make([]byte, 80), "f05eae4561800c0d2e6a7b7b181b48faa6313f177698c2bd4025a6de65af925e"},
+	}
+	for _, test := range tests {
+		if out := Argon2(test.data); hex.EncodeToString(out) != test.expected {
+			t.Errorf("Argon2(%x) = %x, expected %s", test.data, out, test.expected)
+		}
+	}
+}
+
+//BlaMka的乘加只使用两个输入的低32位
+func TestBlamka(t *testing.T) {
+	tests := []struct {
+		x, y, expected uint64
+	}{
+		{0, 0, 0},
+		{1, 1, 4},
+		{3, 5, 38},
+		{1 << 32, 1 << 32, 1 << 33},
+		{0xffffffff, 2, 0xffffffff + 2 + 2*0xffffffff*2},
+	}
+	for _, test := range tests {
+		if out := blamka(test.x, test.y); out != test.expected {
+			t.Errorf("blamka(%#x, %#x) = %#x, expected %#x", test.x, test.y, out, test.expected)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package powhash
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+//工作量证明使用的哈希函数 输入序列化的区块头 输出32字节的哈希值
+type Func func(data []byte) []byte
+
+//可以选择的哈希函数 创建区块链时选定后记录在数据库中
+var funcs = map[string]Func{
+	"sha256":  Sha256,
+	"sha256d": Sha256d,
+	"scrypt":  Scrypt,
+	"argon2":  Argon2,
+}
+
+//根据名称获取哈希函数
+func Lookup(name string) (Func, error) {
+	f, ok := funcs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown PoW hash function %q", name)
+	}
+	return f, nil
+}
+
+//所有可选哈希函数的名称
+func Names() []string {
+	var names []string
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//单次SHA-256 与区块哈希相同 早期创建的区块链使用
+func Sha256(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+//两次SHA-256 与比特币相同
+func Sha256d(data []byte) []byte {
+	first := sha256.Sum256(data)
+	hash := sha256.Sum256(first[:])
+	return hash[:]
+}
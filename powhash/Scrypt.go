@@ -0,0 +1,129 @@
+package powhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+//与莱特币相同的scrypt参数 N=1024 r=1 p=1 每次哈希使用128KB内存
+const (
+	scryptN = 1024
+	scryptR = 1
+	scryptP = 1
+)
+
+//scrypt工作量证明 区块头同时作为口令和盐
+func Scrypt(data []byte) []byte {
+	return scrypt(data, data, scryptN, scryptR, scryptP, 32)
+}
+
+//RFC 7914中的scrypt n必须是2的幂
+func scrypt(password, salt []byte, n, r, p, keyLen int) []byte {
+	b := pbkdf2(password, salt, p*128*r)
+	x := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*n)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[j*4:])
+		}
+		roMix(x, v, n, r)
+		for j, w := range x {
+			binary.LittleEndian.PutUint32(block[j*4:], w)
+		}
+	}
+	return pbkdf2(password, b, keyLen)
+}
+
+//迭代次数为1的PBKDF2-HMAC-SHA256
+func pbkdf2(password, salt []byte, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	counter := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		key = prf.Sum(key)
+	}
+	return key[:keyLen]
+}
+
+//先顺序填充n个块 再按块的内容随机读取 计算过程中必须保存全部n个块
+func roMix(x, v []uint32, n, r int) {
+	size := 32 * r
+	y := make([]uint32, size)
+	for i := 0; i < n; i++ {
+		copy(v[i*size:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < n; i++ {
+		j := int(x[size-16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*size+k]
+		}
+		blockMix(x, y, r)
+	}
+}
+
+//b由2r个64字节的块组成 依次与前一个结果异或后做Salsa20/8 偶数位置的结果排在前面
+func blockMix(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for j := range x {
+			x[j] ^= b[i*16+j]
+		}
+		salsa208(&x)
+		offset := (i/2)*16 + (i%2)*r*16
+		copy(y[offset:], x[:])
+	}
+	copy(b, y)
+}
+
+//8轮的Salsa20核心函数
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		//列
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+		//行
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
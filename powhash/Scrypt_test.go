@@ -0,0 +1,79 @@
+package powhash
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+//RFC 7914第8节的Salsa20/8核心函数
+func TestSalsa208(t *testing.T) {
+	input := mustDecode(t, "7e879a214f3ec9867ca940e641718f26baee555b8c61c1b50df846116dcd3b1d"+
+		"ee24f319df9b3d8514121e4b5ac5aa3276021d2909c74829edebc68db8b8c25e")
+	expected := "a41f859c6608cc993b81cacb020cef05044b2181a2fd337dfd7b1c6396682f29" +
+		"b4393168e3c9e6bcfe6bc5b7a06d96bae424cc102c91745c24ad673dc7618f81"
+	var b [16]uint32
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint32(input[i*4:])
+	}
+	salsa208(&b)
+	out := make([]byte, 64)
+	for i, w := range b {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	if hex.EncodeToString(out) != expected {
+		t.Fatalf("salsa20/8 returned %x, expected %s", out, expected)
+	}
+}
+
+//RFC 7914第11节 迭代次数为1的PBKDF2-HMAC-SHA256
+func TestPbkdf2(t *testing.T) {
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if out := pbkdf2([]byte("passwd"), []byte("salt"), 64); hex.EncodeToString(out) != expected {
+		t.Fatalf("pbkdf2 returned %x, expected %s", out, expected)
+	}
+}
+
+//RFC 7914第12节的测试向量 N=1048576的一组需要1GB内存 没有包括
+func TestScryptVectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		n, r, p        int
+		expected       string
+	}{
+		{"", "", 16, 1, 1,
+			"77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+				"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16,
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+				"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1,
+			"7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2" +
+				"d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	}
+	for _, test := range tests {
+		out := scrypt([]byte(test.password), []byte(test.salt), test.n, test.r, test.p, 64)
+		if hex.EncodeToString(out) != test.expected {
+			t.Errorf("scrypt(%q, %q, N=%d, r=%d, p=%d) = %x, expected %s",
+				test.password, test.salt, test.n, test.r, test.p, out, test.expected)
+		}
+	}
+}
+
+//工作量证明使用莱特币的参数 区块头同时作为口令和盐
+func TestScryptPow(t *testing.T) {
+	header := make([]byte, 80)
+	expected := "161d0876f3b93b1048cda1bdeaa7332ee210f7131b42013cb43913a6553a4b69"
+	if out := Scrypt(header); hex.EncodeToString(out) != expected {
+		t.Fatalf("Scrypt returned %x, expected %s", out, expected)
+	}
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+//日志条目的类型
+type EntryType int
+
+const (
+	EntryNormal EntryType = iota //普通条目 Data由应用解释 领导者上任时追加的空条目不交给应用
+	EntryConfig                  //成员变更 Peers为变更后的全部成员 追加到日志时立即生效
+)
+
+//日志条目
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Type  EntryType
+	Data  []byte
+	Peers []string
+}
+
+//快照代替日志中Index及之前的全部条目
+type Snapshot struct {
+	Index uint64   //快照包含的最后一个条目
+	Term  uint64   //该条目的任期
+	Peers []string //该条目处的成员
+	Data  []byte   //应用生成的状态
+}
+
+//消息类型
+type MessageType int
+
+const (
+	MsgVote       MessageType = iota //候选者请求投票 LogIndex和LogTerm为候选者最后一个条目
+	MsgVoteResp                      //投票结果 Reject为true时拒绝
+	MsgAppend                        //领导者复制条目 LogIndex和LogTerm为Entries之前的条目 Commit为领导者的提交位置 没有条目时作为心跳
+	MsgAppendResp                    //成功时Index为与领导者一致的最后位置 失败时Index为建议领导者下次尝试的位置
+	MsgSnapshot                      //领导者发送快照 跟随者需要的条目已经被压缩
+	MsgForward                       //跟随者把提案转发给领导者
+)
+
+var messageTypeStrings = map[MessageType]string{
+	MsgVote:       "Vote",
+	MsgVoteResp:   "VoteResp",
+	MsgAppend:     "Append",
+	MsgAppendResp: "AppendResp",
+	MsgSnapshot:   "Snapshot",
+	MsgForward:    "Forward",
+}
+
+func (t MessageType) String() string {
+	if s, ok := messageTypeStrings[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+//节点之间传递的消息 不同类型的消息使用其中的不同字段
+type Message struct {
+	Type     MessageType
+	From     string
+	To       string
+	Term     uint64
+	LogIndex uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+	Reject   bool
+	Index    uint64
+	Snapshot Snapshot
+	Data     []byte //Forward中的提案
+}
+
+func (m *Message) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	if err := encoder.Encode(m); err != nil {
+		panic(err)
+	}
+	return result.Bytes()
+}
+
+func DeserializeMessage(data []byte) (Message, error) {
+	var msg Message
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&msg)
+	return msg, err
+}
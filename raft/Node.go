@@ -0,0 +1,670 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//领导者一条Append消息中最多带多少个条目
+const maxAppendEntries = 64
+
+var (
+	ErrNotLeader     = errors.New("raft: not the leader")
+	ErrConfigPending = errors.New("raft: a membership change is in progress")
+	ErrConfigChange  = errors.New("raft: membership changes must add or remove exactly one node")
+)
+
+//节点之间的消息传输 Send必须是异步的 不需要保证送达 也不需要保证顺序
+type Transport interface {
+	Send(msg Message)
+}
+
+//节点配置
+type Config struct {
+	ID             string   //节点ID
+	Peers          []string //初始成员 包括自己 日志和快照中没有成员变更时使用
+	HeartbeatTicks int      //领导者每隔多少个tick发送心跳
+	ElectionTicks  int      //多少个tick没有领导者的消息后发起选举 实际在[ElectionTicks,2*ElectionTicks)之间随机
+
+	//应用了多少个条目之后生成快照并压缩日志 为0时不生成快照
+	SnapshotEntries uint64
+
+	//按顺序应用提交的条目 重启后快照之后的条目会重新应用 应用必须是幂等的
+	Apply func(entry Entry)
+	//生成包含已经应用的全部条目的状态
+	Snapshot func() ([]byte, error)
+	//用领导者发来的快照恢复状态
+	Restore func(snapshot Snapshot)
+}
+
+//节点的角色
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+//Raft节点 通过领导者选举和日志复制让所有节点按相同的顺序应用相同的条目
+//所有状态由一个互斥锁保护 Apply Snapshot和Restore在锁外按顺序调用
+type Node struct {
+	mtx       sync.Mutex
+	config    Config
+	storage   *Storage
+	transport Transport
+	rand      *rand.Rand
+
+	//持久化状态
+	term     uint64
+	vote     string
+	log      []Entry  //快照之后的条目
+	snapshot Snapshot //最近一次的快照
+
+	role   role
+	leader string   //已知的领导者
+	peers  []string //当前成员 即日志中最后一个成员变更条目中的成员
+
+	commit   uint64    //已经提交的最后一个条目
+	applied  uint64    //已经应用的最后一个条目
+	applying bool      //正在调用Apply
+	restore  *Snapshot //等待交给Restore的快照
+
+	votes map[string]bool   //候选者收到的投票
+	next  map[string]uint64 //领导者下一个发给每个成员的条目
+	match map[string]uint64 //每个成员与领导者一致的最后位置
+
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+}
+
+//创建节点并从storage中恢复持久化的状态
+func NewNode(config Config, storage *Storage, transport Transport) (*Node, error) {
+	if config.HeartbeatTicks <= 0 || config.ElectionTicks <= config.HeartbeatTicks {
+		return nil, errors.New("raft: election ticks must be greater than heartbeat ticks")
+	}
+	term, vote, snapshot, entries, err := storage.load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:    config,
+		storage:   storage,
+		transport: transport,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		term:      term,
+		vote:      vote,
+		log:       entries,
+		snapshot:  snapshot,
+		commit:    snapshot.Index,
+		applied:   snapshot.Index,
+	}
+	n.peers = n.peersAt(n.lastIndex())
+	n.resetElectionTimeout()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+//已知的领导者 不知道时为空
+func (n *Node) Leader() string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.leader
+}
+
+func (n *Node) IsLeader() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.role == leader
+}
+
+func (n *Node) Term() uint64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.term
+}
+
+//当前成员
+func (n *Node) Peers() []string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return append([]string{}, n.peers...)
+}
+
+//提出一个普通条目 领导者追加到日志 跟随者转发给领导者
+//条目可能因为领导者故障而丢失 调用者在Apply中确认 必要时重新提出
+func (n *Node) Propose(data []byte) error {
+	n.mtx.Lock()
+	var err error
+	switch {
+	case n.role == leader:
+		n.appendEntry(Entry{Type: EntryNormal, Data: data})
+	case n.leader != "":
+		n.send(Message{Type: MsgForward, To: n.leader, Data: data})
+	default:
+		err = ErrNotLeader
+	}
+	n.mtx.Unlock()
+	n.deliver()
+	return err
+}
+
+//领导者提出成员变更 每次只能增加或者删除一个成员 上一次变更提交之前不能开始下一次
+//新成员从领导者收到日志或快照后追上进度 领导者被删除时在变更提交后退位
+func (n *Node) ProposeConfig(peers []string, data []byte) error {
+	n.mtx.Lock()
+	defer n.deliver()
+	defer n.mtx.Unlock()
+	if n.role != leader {
+		return ErrNotLeader
+	}
+	for _, entry := range n.log {
+		if entry.Type == EntryConfig && entry.Index > n.commit {
+			return ErrConfigPending
+		}
+	}
+	changed := 0
+	for _, peer := range peers {
+		if !contains(n.peers, peer) {
+			changed++
+		}
+	}
+	for _, peer := range n.peers {
+		if !contains(peers, peer) {
+			changed++
+		}
+	}
+	if changed != 1 || len(peers) == 0 {
+		return ErrConfigChange
+	}
+	n.appendEntry(Entry{Type: EntryConfig, Data: data, Peers: append([]string{}, peers...)})
+	return nil
+}
+
+//处理收到的消息
+func (n *Node) Step(msg Message) {
+	n.mtx.Lock()
+	n.handle(msg)
+	n.mtx.Unlock()
+	n.deliver()
+}
+
+//推进逻辑时钟 领导者发送心跳 其他成员检查领导者是否超时
+func (n *Node) Tick() {
+	n.mtx.Lock()
+	if n.role == leader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.config.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+	} else {
+		n.electionElapsed++
+		if n.electionElapsed >= n.electionTimeout {
+			//已经被删除的节点不再发起选举
+			if contains(n.peers, n.config.ID) {
+				n.campaign()
+			} else {
+				n.resetElectionTimeout()
+			}
+		}
+	}
+	n.mtx.Unlock()
+	n.deliver()
+}
+
+//每隔interval推进一次逻辑时钟 直到ctx被取消
+func (n *Node) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.Tick()
+		}
+	}
+}
+
+func contains(peers []string, id string) bool {
+	for _, peer := range peers {
+		if peer == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.config.ElectionTicks + n.rand.Intn(n.config.ElectionTicks)
+}
+
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *Node) send(msg Message) {
+	msg.From = n.config.ID
+	msg.Term = n.term
+	n.transport.Send(msg)
+}
+
+//任期和投票写入磁盘后才能继续 写入失败时节点不能再安全地参与选举
+func (n *Node) persistState() {
+	if err := n.storage.saveState(n.term, n.vote); err != nil {
+		log.Panic(err)
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snapshot.Term
+}
+
+//index处条目的任期 条目已经被压缩或者不存在时返回false
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term, true
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapshot.Index-1].Term, true
+}
+
+func (n *Node) entryAt(index uint64) Entry {
+	return n.log[index-n.snapshot.Index-1]
+}
+
+//index处的成员 即index及之前最后一个成员变更条目中的成员
+func (n *Node) peersAt(index uint64) []string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type == EntryConfig && n.log[i].Index <= index {
+			return n.log[i].Peers
+		}
+	}
+	if len(n.snapshot.Peers) > 0 {
+		return n.snapshot.Peers
+	}
+	return n.config.Peers
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.persistState()
+	}
+	n.role = follower
+	n.leader = leader
+}
+
+//增加任期并请求其他成员投票
+func (n *Node) campaign() {
+	n.term++
+	n.vote = n.config.ID
+	n.persistState()
+	n.role = candidate
+	n.leader = ""
+	n.votes = map[string]bool{n.config.ID: true}
+	n.resetElectionTimeout()
+	if n.quorum() == 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		if peer != n.config.ID {
+			n.send(Message{Type: MsgVote, To: peer, LogIndex: n.lastIndex(), LogTerm: n.lastTerm()})
+		}
+	}
+}
+
+//成为领导者后追加一个空条目 提交它的同时提交之前任期的条目
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.config.ID
+	n.heartbeatElapsed = 0
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	for _, peer := range n.peers {
+		n.next[peer] = n.lastIndex() + 1
+	}
+	n.appendEntry(Entry{Type: EntryNormal})
+}
+
+//领导者追加条目并发送给其他成员
+func (n *Node) appendEntry(entry Entry) {
+	entry.Term = n.term
+	entry.Index = n.lastIndex() + 1
+	if err := n.storage.appendEntries([]Entry{entry}); err != nil {
+		log.Panic(err)
+	}
+	n.log = append(n.log, entry)
+	if entry.Type == EntryConfig {
+		n.peers = entry.Peers
+		for _, peer := range n.peers {
+			if _, ok := n.next[peer]; !ok {
+				n.next[peer] = entry.Index
+			}
+		}
+	}
+	n.match[n.config.ID] = entry.Index
+	n.maybeCommit()
+	n.broadcastAppend()
+}
+
+func (n *Node) broadcastAppend() {
+	for _, peer := range n.peers {
+		if peer != n.config.ID {
+			n.sendAppend(peer)
+		}
+	}
+}
+
+//从peer的下一个位置开始发送条目 需要的条目已经被压缩时发送快照
+func (n *Node) sendAppend(peer string) {
+	next := n.next[peer]
+	if next <= n.snapshot.Index {
+		n.send(Message{Type: MsgSnapshot, To: peer, Snapshot: n.snapshot})
+		return
+	}
+	prevTerm, _ := n.termAt(next - 1)
+	var entries []Entry
+	for index := next; index <= n.lastIndex() && len(entries) < maxAppendEntries; index++ {
+		entries = append(entries, n.entryAt(index))
+	}
+	n.send(Message{Type: MsgAppend, To: peer, LogIndex: next - 1, LogTerm: prevTerm, Entries: entries, Commit: n.commit})
+}
+
+//提交当前任期中被多数成员复制的最后一个条目 之前的条目随之提交
+func (n *Node) maybeCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 0
+		for _, peer := range n.peers {
+			if n.match[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commit = index
+			//让跟随者尽快知道新的提交位置
+			n.broadcastAppend()
+			break
+		}
+	}
+	//删除自己的成员变更提交后退位
+	if !contains(n.peers, n.config.ID) && !n.configPending() {
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) configPending() bool {
+	for i := len(n.log) - 1; i >= 0 && n.log[i].Index > n.commit; i-- {
+		if n.log[i].Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) handle(msg Message) {
+	if msg.Type == MsgForward {
+		if n.role == leader {
+			n.appendEntry(Entry{Type: EntryNormal, Data: msg.Data})
+		}
+		return
+	}
+	if msg.Term > n.term {
+		//在领导者的心跳间隔内忽略投票请求 防止已经被删除的节点干扰集群
+		if msg.Type == MsgVote && n.leader != "" && (n.role == leader || n.electionElapsed < n.config.ElectionTicks) {
+			return
+		}
+		leader := ""
+		if msg.Type == MsgAppend || msg.Type == MsgSnapshot {
+			leader = msg.From
+		}
+		n.becomeFollower(msg.Term, leader)
+	}
+	if msg.Term < n.term {
+		//让过期的领导者或候选者知道新的任期
+		switch msg.Type {
+		case MsgAppend, MsgSnapshot:
+			n.send(Message{Type: MsgAppendResp, To: msg.From, Reject: true})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: true})
+		}
+		return
+	}
+
+	switch msg.Type {
+	case MsgVote:
+		n.onVote(msg)
+	case MsgVoteResp:
+		n.onVoteResp(msg)
+	case MsgAppend:
+		n.onAppend(msg)
+	case MsgAppendResp:
+		n.onAppendResp(msg)
+	case MsgSnapshot:
+		n.onSnapshot(msg)
+	}
+}
+
+//每个任期只投一票 只投给日志至少和自己一样新的候选者
+func (n *Node) onVote(msg Message) {
+	upToDate := msg.LogTerm > n.lastTerm() || (msg.LogTerm == n.lastTerm() && msg.LogIndex >= n.lastIndex())
+	grant := (n.vote == "" || n.vote == msg.From) && upToDate
+	if grant {
+		n.vote = msg.From
+		n.persistState()
+		n.resetElectionTimeout()
+	}
+	n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: !grant})
+}
+
+func (n *Node) onVoteResp(msg Message) {
+	if n.role != candidate {
+		return
+	}
+	n.votes[msg.From] = !msg.Reject
+	granted, rejected := 0, 0
+	for _, peer := range n.peers {
+		if vote, ok := n.votes[peer]; ok && vote {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum():
+		n.becomeLeader()
+	case rejected >= n.quorum():
+		n.becomeFollower(n.term, "")
+	}
+}
+
+//跟随者检查前一个条目是否一致 一致时删除冲突的条目并追加新条目
+func (n *Node) onAppend(msg Message) {
+	n.becomeFollower(msg.Term, msg.From)
+	n.resetElectionTimeout()
+
+	if msg.LogIndex > n.lastIndex() {
+		n.send(Message{Type: MsgAppendResp, To: msg.From, Reject: true, Index: n.lastIndex() + 1})
+		return
+	}
+	//被压缩的条目已经提交 一定与领导者一致
+	if term, ok := n.termAt(msg.LogIndex); ok && term != msg.LogTerm {
+		n.send(Message{Type: MsgAppendResp, To: msg.From, Reject: true, Index: msg.LogIndex})
+		return
+	}
+
+	var entries []Entry
+	for i, entry := range msg.Entries {
+		if entry.Index <= n.snapshot.Index {
+			continue
+		}
+		if term, ok := n.termAt(entry.Index); ok && term == entry.Term {
+			continue
+		}
+		entries = msg.Entries[i:]
+		break
+	}
+	if len(entries) > 0 {
+		if err := n.storage.appendEntries(entries); err != nil {
+			log.Panic(err)
+		}
+		n.log = append(n.log[:entries[0].Index-n.snapshot.Index-1], entries...)
+		n.peers = n.peersAt(n.lastIndex())
+	}
+
+	last := msg.LogIndex + uint64(len(msg.Entries))
+	if last < n.snapshot.Index {
+		last = n.snapshot.Index
+	}
+	if commit := msg.Commit; commit > n.commit {
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commit {
+			n.commit = commit
+		}
+	}
+	n.send(Message{Type: MsgAppendResp, To: msg.From, Index: last})
+}
+
+func (n *Node) onAppendResp(msg Message) {
+	if n.role != leader {
+		return
+	}
+	if msg.Reject {
+		next := msg.Index
+		if next <= n.match[msg.From] {
+			next = n.match[msg.From] + 1
+		}
+		if next < n.next[msg.From] || n.next[msg.From] == 0 {
+			n.next[msg.From] = next
+			n.sendAppend(msg.From)
+		}
+		return
+	}
+	if msg.Index > n.match[msg.From] {
+		n.match[msg.From] = msg.Index
+		n.maybeCommit()
+	}
+	if msg.Index+1 > n.next[msg.From] {
+		n.next[msg.From] = msg.Index + 1
+	}
+	if n.role == leader && n.next[msg.From] <= n.lastIndex() {
+		n.sendAppend(msg.From)
+	}
+}
+
+//安装领导者的快照 快照之后与它一致的条目保留 其余条目全部删除
+func (n *Node) onSnapshot(msg Message) {
+	n.becomeFollower(msg.Term, msg.From)
+	n.resetElectionTimeout()
+
+	snapshot := msg.Snapshot
+	if snapshot.Index <= n.commit {
+		n.send(Message{Type: MsgAppendResp, To: msg.From, Index: n.commit})
+		return
+	}
+	term, ok := n.termAt(snapshot.Index)
+	keep := ok && term == snapshot.Term
+	if err := n.storage.saveSnapshot(snapshot, !keep); err != nil {
+		log.Panic(err)
+	}
+	if keep {
+		n.log = append([]Entry{}, n.log[snapshot.Index-n.snapshot.Index:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapshot = snapshot
+	n.peers = n.peersAt(n.lastIndex())
+	n.commit = snapshot.Index
+	n.applied = snapshot.Index
+	n.restore = &snapshot
+	n.send(Message{Type: MsgAppendResp, To: msg.From, Index: snapshot.Index})
+}
+
+//用应用在index处生成的状态代替之前的条目
+func (n *Node) compact(index uint64, data []byte) {
+	if index <= n.snapshot.Index {
+		return
+	}
+	term, _ := n.termAt(index)
+	snapshot := Snapshot{Index: index, Term: term, Peers: n.peersAt(index), Data: data}
+	if err := n.storage.saveSnapshot(snapshot, false); err != nil {
+		log.Panic(err)
+	}
+	n.log = append([]Entry{}, n.log[index-n.snapshot.Index:]...)
+	n.snapshot = snapshot
+}
+
+//按顺序应用提交的条目 需要时恢复快照或者生成快照 都在锁外调用
+//同一时间只有一个调用者在应用 其他调用者新提交的条目由它继续应用
+func (n *Node) deliver() {
+	n.mtx.Lock()
+	if n.applying {
+		n.mtx.Unlock()
+		return
+	}
+	n.applying = true
+	for {
+		if snapshot := n.restore; snapshot != nil {
+			n.restore = nil
+			n.mtx.Unlock()
+			if n.config.Restore != nil {
+				n.config.Restore(*snapshot)
+			}
+			n.mtx.Lock()
+			continue
+		}
+		if n.applied < n.commit {
+			n.applied++
+			entry := n.entryAt(n.applied)
+			n.mtx.Unlock()
+			if n.config.Apply != nil && (entry.Type == EntryConfig || entry.Data != nil) {
+				n.config.Apply(entry)
+			}
+			n.mtx.Lock()
+			continue
+		}
+		if n.config.SnapshotEntries > 0 && n.config.Snapshot != nil && n.applied-n.snapshot.Index >= n.config.SnapshotEntries {
+			index := n.applied
+			n.mtx.Unlock()
+			data, err := n.config.Snapshot()
+			n.mtx.Lock()
+			if err != nil {
+				break
+			}
+			n.compact(index, data)
+			continue
+		}
+		break
+	}
+	n.applying = false
+	n.mtx.Unlock()
+}
@@ -0,0 +1,478 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//进程内的网络 只有同一个分区中的节点能够互相通信 宕机节点收发的消息全部丢失
+type memoryNetwork struct {
+	mtx   sync.Mutex
+	nodes map[string]*Node
+	group map[string]int
+	down  map[string]bool
+	alive map[string]*sync.RWMutex //停止节点时等待正在处理的消息
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{
+		nodes: make(map[string]*Node),
+		group: make(map[string]int),
+		down:  make(map[string]bool),
+		alive: make(map[string]*sync.RWMutex),
+	}
+}
+
+func (n *memoryNetwork) join(node *Node) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.nodes[node.ID()] = node
+	n.down[node.ID()] = false
+	if n.alive[node.ID()] == nil {
+		n.alive[node.ID()] = new(sync.RWMutex)
+	}
+}
+
+//把ids和其他节点隔开 ids之间仍然可以通信
+func (n *memoryNetwork) partition(ids ...string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for _, id := range ids {
+		n.group[id] = 1
+	}
+}
+
+func (n *memoryNetwork) heal() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.group = make(map[string]int)
+}
+
+func (n *memoryNetwork) reachable(from, to string) bool {
+	return n.nodes[to] != nil && !n.down[from] && !n.down[to] && n.group[from] == n.group[to]
+}
+
+func (n *memoryNetwork) Send(msg Message) {
+	n.mtx.Lock()
+	ok := n.reachable(msg.From, msg.To)
+	n.mtx.Unlock()
+	if !ok {
+		return
+	}
+
+	//经过序列化 接收者不会和发送者共享切片
+	data := msg.Serialize()
+	go func() {
+		m, err := DeserializeMessage(data)
+		if err != nil {
+			return
+		}
+		n.mtx.Lock()
+		node, alive := n.nodes[m.To], n.alive[m.To]
+		n.mtx.Unlock()
+		alive.RLock()
+		defer alive.RUnlock()
+		n.mtx.Lock()
+		ok := n.reachable(m.From, m.To)
+		n.mtx.Unlock()
+		if ok {
+			node.Step(m)
+		}
+	}()
+}
+
+//测试节点 应用的状态是按顺序应用的普通条目
+type testNode struct {
+	db     *bolt.DB
+	node   *Node
+	cancel context.CancelFunc
+	done   chan struct{}
+	down   bool
+
+	mtx      sync.Mutex
+	applied  [][]byte
+	restores int
+}
+
+type testCluster struct {
+	t        *testing.T
+	dir      string
+	peers    []string
+	network  *memoryNetwork
+	nodes    map[string]*testNode
+	proposed int
+}
+
+func newTestCluster(t *testing.T, size int, snapshotEntries uint64) *testCluster {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCluster{
+		t:       t,
+		dir:     dir,
+		network: newMemoryNetwork(),
+		nodes:   make(map[string]*testNode),
+	}
+	for i := 0; i < size; i++ {
+		c.peers = append(c.peers, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.peers {
+		c.start(id, c.peers, snapshotEntries)
+	}
+	return c
+}
+
+//用初始成员peers启动节点 数据库已经存在时从中恢复
+func (c *testCluster) start(id string, peers []string, snapshotEntries uint64) {
+	db, err := bolt.Open(filepath.Join(c.dir, id+".db"), 0600, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	storage, err := NewStorage(db)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tn := &testNode{db: db, done: make(chan struct{})}
+	config := Config{
+		ID:              id,
+		Peers:           peers,
+		HeartbeatTicks:  2,
+		ElectionTicks:   10,
+		SnapshotEntries: snapshotEntries,
+		Apply: func(entry Entry) {
+			if entry.Type == EntryNormal {
+				tn.mtx.Lock()
+				tn.applied = append(tn.applied, entry.Data)
+				tn.mtx.Unlock()
+			}
+		},
+		Snapshot: func() ([]byte, error) {
+			tn.mtx.Lock()
+			defer tn.mtx.Unlock()
+			return encode(tn.applied), nil
+		},
+		Restore: func(snapshot Snapshot) {
+			var applied [][]byte
+			if err := decode(snapshot.Data, &applied); err != nil {
+				panic(err)
+			}
+			tn.mtx.Lock()
+			tn.applied = applied
+			tn.restores++
+			tn.mtx.Unlock()
+		},
+	}
+	tn.node, err = NewNode(config, storage, c.network)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tn.cancel = cancel
+	c.nodes[id] = tn
+	c.network.join(tn.node)
+	go func() {
+		defer close(tn.done)
+		tn.node.Run(ctx, 5*time.Millisecond)
+	}()
+}
+
+//让节点宕机 等待它正在处理的消息和时钟结束后关闭数据库
+func (c *testCluster) stop(id string) {
+	tn := c.nodes[id]
+	c.network.mtx.Lock()
+	c.network.down[id] = true
+	alive := c.network.alive[id]
+	c.network.mtx.Unlock()
+	tn.cancel()
+	<-tn.done
+	alive.Lock()
+	tn.db.Close()
+	alive.Unlock()
+	tn.down = true
+}
+
+func (c *testCluster) close() {
+	for id, tn := range c.nodes {
+		if !tn.down {
+			c.stop(id)
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+func (c *testCluster) live() []string {
+	var ids []string
+	for id, tn := range c.nodes {
+		if !tn.down {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (c *testCluster) applied(id string) [][]byte {
+	tn := c.nodes[id]
+	tn.mtx.Lock()
+	defer tn.mtx.Unlock()
+	return append([][]byte{}, tn.applied...)
+}
+
+func without(ids []string, removed ...string) []string {
+	var result []string
+	for _, id := range ids {
+		if !contains(removed, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+//等待ids中只有一个领导者 并且其他节点都知道它
+func (c *testCluster) leader(ids []string) string {
+	for attempt := 0; attempt < 400; attempt++ {
+		var leaders []string
+		for _, id := range ids {
+			if c.nodes[id].node.IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			known := true
+			for _, id := range ids {
+				known = known && c.nodes[id].node.Leader() == leaders[0]
+			}
+			if known {
+				return leaders[0]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("%v did not agree on a single leader", ids)
+	return ""
+}
+
+//向ids中的领导者提出values 不知道领导者时交给任意一个节点转发
+func (c *testCluster) proposeTo(ids []string, values [][]byte) {
+	for _, value := range values {
+		target := ids[0]
+		for _, id := range ids {
+			if c.nodes[id].node.IsLeader() {
+				target = id
+			}
+		}
+		c.nodes[target].node.Propose(value)
+	}
+}
+
+//在ids中提出count个新的值
+func (c *testCluster) propose(ids []string, count int) [][]byte {
+	var values [][]byte
+	for i := 0; i < count; i++ {
+		values = append(values, []byte(fmt.Sprintf("value%d", c.proposed)))
+		c.proposed++
+	}
+	c.proposeTo(ids, values)
+	return values
+}
+
+func containsValue(log [][]byte, value []byte) bool {
+	for _, v := range log {
+		if bytes.Equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+//等待ids应用相同的序列 并且序列包含values中的每个值
+//任何时候两个节点在同一个位置应用了不同的值都会让测试失败 提案丢失时重新提出缺少的值
+func (c *testCluster) waitApplied(ids []string, values [][]byte) [][]byte {
+	for attempt := 0; attempt < 400; attempt++ {
+		time.Sleep(25 * time.Millisecond)
+		first := c.applied(ids[0])
+		agreed := true
+		for _, id := range ids[1:] {
+			log := c.applied(id)
+			for i := 0; i < len(log) && i < len(first); i++ {
+				if !bytes.Equal(log[i], first[i]) {
+					c.t.Fatalf("%s applied %q at %d, %s applied %q", id, log[i], i, ids[0], first[i])
+				}
+			}
+			if len(log) != len(first) {
+				agreed = false
+			}
+		}
+
+		var missing [][]byte
+		for _, value := range values {
+			if !containsValue(first, value) {
+				missing = append(missing, value)
+			}
+		}
+		if agreed && len(missing) == 0 {
+			return first
+		}
+		if attempt%20 == 19 {
+			c.proposeTo(ids, missing)
+		}
+	}
+	c.t.Fatalf("%v did not apply the same sequence of values", ids)
+	return nil
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+	defer c.close()
+	first := c.leader(c.live())
+	term := c.nodes[first].node.Term()
+
+	c.stop(first)
+	second := c.leader(c.live())
+	if second == first {
+		t.Fatalf("crashed leader %s is still the leader", first)
+	}
+	if newTerm := c.nodes[second].node.Term(); newTerm <= term {
+		t.Fatalf("new leader %s has term %d, the crashed leader had term %d", second, newTerm, term)
+	}
+}
+
+func TestLogRepairAfterPartition(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+	defer c.close()
+	all := c.live()
+	values := c.propose(all, 5)
+	c.waitApplied(all, values)
+
+	//原领导者和一个跟随者成为少数派 它们追加的条目无法提交
+	old := c.leader(all)
+	follower := without(all, old)[0]
+	c.network.partition(old, follower)
+	var lost [][]byte
+	for i := 0; i < 5; i++ {
+		value := []byte(fmt.Sprintf("lost%d", i))
+		lost = append(lost, value)
+		c.nodes[old].node.Propose(value)
+	}
+
+	majority := without(all, old, follower)
+	if leader := c.leader(majority); leader == old {
+		t.Fatalf("partitioned leader %s leads the majority", old)
+	}
+	values = append(values, c.propose(majority, 5)...)
+	c.waitApplied(majority, values)
+
+	//恢复后少数派删除冲突的条目 复制多数派的日志
+	c.network.heal()
+	log := c.waitApplied(all, values)
+	for _, value := range lost {
+		if containsValue(log, value) {
+			t.Fatalf("uncommitted entry %q from the minority was applied", value)
+		}
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	defer c.close()
+	all := c.live()
+	values := c.propose(all, 3)
+	c.waitApplied(all, values)
+
+	lagging := without(all, c.leader(all))[0]
+	c.network.partition(lagging)
+	others := without(all, lagging)
+	values = append(values, c.propose(others, 20)...)
+	c.waitApplied(others, values)
+
+	//领导者已经压缩了落后节点需要的条目 只能发送快照
+	leader := c.leader(others)
+	n := c.nodes[leader].node
+	n.mtx.Lock()
+	compacted := n.snapshot.Index
+	n.mtx.Unlock()
+	l := c.nodes[lagging].node
+	l.mtx.Lock()
+	behind := l.lastIndex()
+	l.mtx.Unlock()
+	if compacted <= behind {
+		t.Fatalf("leader compacted to %d, lagging node is at %d", compacted, behind)
+	}
+
+	c.network.heal()
+	c.waitApplied(all, values)
+	tn := c.nodes[lagging]
+	tn.mtx.Lock()
+	restores := tn.restores
+	tn.mtx.Unlock()
+	if restores == 0 {
+		t.Fatalf("%s caught up without installing a snapshot", lagging)
+	}
+}
+
+func TestMembershipChange(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.close()
+	old := c.live()
+	values := c.propose(old, 5)
+	c.waitApplied(old, values)
+
+	//新节点从原来的成员启动 收到成员变更之前不会发起选举
+	c.start("node3", c.peers, 0)
+	added := append(append([]string{}, c.peers...), "node3")
+	c.changeMembers(old, added)
+	values = append(values, c.propose(added, 5)...)
+	c.waitApplied(added, values)
+	for _, id := range added {
+		if peers := c.nodes[id].node.Peers(); len(peers) != len(added) {
+			t.Fatalf("%s has members %v after adding node3", id, peers)
+		}
+	}
+
+	//删除领导者 它在变更提交后退位 剩下的成员选出新的领导者
+	removed := c.leader(added)
+	rest := without(added, removed)
+	c.changeMembers(added, rest)
+	if leader := c.leader(rest); leader == removed {
+		t.Fatalf("removed node %s is still the leader", removed)
+	}
+	values = append(values, c.propose(rest, 5)...)
+	c.waitApplied(rest, values)
+	if c.nodes[removed].node.IsLeader() {
+		t.Fatalf("removed node %s did not step down", removed)
+	}
+}
+
+//由ids中的领导者提出成员变更 直到ids都知道新的成员
+func (c *testCluster) changeMembers(ids, peers []string) {
+	for attempt := 0; attempt < 400; attempt++ {
+		leader := c.leader(ids)
+		err := c.nodes[leader].node.ProposeConfig(peers, nil)
+		if err != nil && err != ErrNotLeader && err != ErrConfigPending {
+			c.t.Fatal(err)
+		}
+		if err == nil || err == ErrConfigPending {
+			break
+		}
+	}
+	for attempt := 0; attempt < 400; attempt++ {
+		done := true
+		for _, id := range peers {
+			done = done && len(c.nodes[id].node.Peers()) == len(peers)
+		}
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("members did not change to %v", peers)
+}
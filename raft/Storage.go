@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/boltdb/bolt"
+)
+
+//任期和投票 回复任何消息之前必须写入 节点崩溃重启后不会在同一个任期投两次票
+//键："term"   值：当前任期(8字节大端)
+//键："vote"   值：当前任期投票给的节点
+const stateBucket = "raft_state"
+
+//快照之后的日志条目
+//键：位置(8字节大端)   值：条目
+const logBucket = "raft_log"
+
+//最近一次的快照
+//键："snapshot"   值：快照
+const snapshotBucket = "raft_snapshot"
+
+//保存在bolt数据库中的Raft状态 可以和区块链共用一个数据库
+type Storage struct {
+	db *bolt.DB
+}
+
+//在db中创建Raft使用的桶
+func NewStorage(db *bolt.DB) (*Storage, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{stateBucket, logBucket, snapshotBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db}, nil
+}
+
+func indexKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+func encode(v interface{}) []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	if err := encoder.Encode(v); err != nil {
+		panic(err)
+	}
+	return result.Bytes()
+}
+
+func decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (s *Storage) saveState(term uint64, vote string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucket))
+		if err := b.Put([]byte("term"), indexKey(term)); err != nil {
+			return err
+		}
+		return b.Put([]byte("vote"), []byte(vote))
+	})
+}
+
+//删除from及之后的条目
+func truncate(b *bolt.Bucket, from uint64) error {
+	c := b.Cursor()
+	for k, _ := c.Seek(indexKey(from)); k != nil; k, _ = c.Seek(indexKey(from)) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//追加连续的条目 与它们冲突的旧条目(位置相同或更靠后)全部删除
+func (s *Storage) appendEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(logBucket))
+		if err := truncate(b, entries[0].Index); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := b.Put(indexKey(entry.Index), encode(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//保存快照并删除被它代替的条目 discard为true时删除全部条目
+func (s *Storage) saveSnapshot(snapshot Snapshot, discard bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(snapshotBucket)).Put([]byte("snapshot"), encode(snapshot)); err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(logBucket))
+		if discard {
+			return truncate(b, 0)
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= snapshot.Index; k, _ = c.First() {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//读取全部持久化状态
+func (s *Storage) load() (term uint64, vote string, snapshot Snapshot, entries []Entry, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket([]byte(stateBucket))
+		if data := state.Get([]byte("term")); data != nil {
+			term = binary.BigEndian.Uint64(data)
+		}
+		vote = string(state.Get([]byte("vote")))
+		if data := tx.Bucket([]byte(snapshotBucket)).Get([]byte("snapshot")); data != nil {
+			if err := decode(data, &snapshot); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(logBucket)).ForEach(func(k, v []byte) error {
+			var entry Entry
+			if err := decode(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return term, vote, snapshot, entries, err
+}